@@ -1,21 +1,30 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"collab-editor/internal/auth"
+	"collab-editor/internal/bus"
 	"collab-editor/internal/db"
 	"collab-editor/internal/document"
 	"collab-editor/internal/export"
 	"collab-editor/internal/hub"
+	"collab-editor/internal/mail"
+	"collab-editor/internal/oidc"
+	"collab-editor/internal/publish"
 )
 
 func enableCORS(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PATCH, DELETE, OPTIONS")
 		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
 
 		if r.Method == "OPTIONS" {
@@ -38,6 +47,30 @@ func main() {
 	// Initialize hub with database
 	h := hub.New(database)
 
+	// Evict sessions nobody has used for a while
+	if idle := os.Getenv("SESSION_IDLE_TIMEOUT"); idle != "" {
+		timeout, err := time.ParseDuration(idle)
+		if err != nil {
+			log.Fatal("Invalid SESSION_IDLE_TIMEOUT:", err)
+		}
+		h.SetIdleTimeout(timeout)
+	}
+	h.SetHooks(hub.Hooks{
+		Emptied: func(sessionCode string) {
+			log.Printf("Session %s has no clients left", sessionCode)
+		},
+	})
+
+	// Share sessions with other instances when running more than one
+	if os.Getenv("HUB_BUS") == "postgres" {
+		pgBus, err := bus.NewPostgres(db.ConnString())
+		if err != nil {
+			log.Fatal("Failed to connect hub bus:", err)
+		}
+		defer pgBus.Close()
+		h.SetBus(pgBus)
+	}
+
 	// Initialize auth handler
 	jwtSecret := os.Getenv("JWT_SECRET")
 	if jwtSecret == "" {
@@ -47,26 +80,112 @@ func main() {
 
 	// Set auth handler in hub
 	h.SetAuthHandler(authHandler)
+	authHandler.SetLogoutHook(h.Disconnect)
+	authHandler.SetSessionHooks(auth.SessionHooks{
+		Deleted:     h.CloseSession,
+		RoleChanged: h.SetRole,
+	})
+
+	// Links in emails and single sign-on return to the frontend
+	if frontendURL := os.Getenv("FRONTEND_URL"); frontendURL != "" {
+		authHandler.SetFrontendURL(frontendURL)
+	}
+	authHandler.SetMailer(mail.FromEnv())
+	// Behind a load balancer, count sign-in attempts by the forwarded address
+	authHandler.SetTrustProxyHeaders(os.Getenv("TRUST_PROXY_HEADERS") == "true")
+
+	// Offer single sign-on when an identity provider is configured
+	if oidcConfig, err := oidc.ConfigFromEnv(); err == nil {
+		authHandler.SetOIDC(oidc.NewProvider(oidcConfig))
+		log.Printf("Single sign-on enabled with %s", oidcConfig.Issuer)
+	} else if !errors.Is(err, oidc.ErrNotConfigured) {
+		log.Fatal("Invalid single sign-on configuration: ", err)
+	}
 
 	// Initialize export handler
-	exportHandler := export.NewExportHandler(database)
+	exportHandler := export.NewExportHandler(database, authHandler, h)
 
 	// Initialize document handler
-	documentHandler := document.NewDocumentHandler(database, authHandler)
+	documentHandler := document.NewDocumentHandler(database, authHandler, h)
+
+	// Initialize publish handler
+	publishHandler := publish.NewPublishHandler(database, authHandler, h)
 
 	// Routes
 	http.HandleFunc("/ws", enableCORS(func(w http.ResponseWriter, r *http.Request) {
 		hub.ServeWS(h, w, r)
 	}))
 
+	// Public, read-only views of published documents
+	http.HandleFunc("/p/", publishHandler.View)
+	http.HandleFunc("/ws/public", publishHandler.Follow)
+
+	// Metrics are for monitoring, not browsers, so they take a token and
+	// no CORS headers
+	metricsToken := os.Getenv("METRICS_TOKEN")
+	http.HandleFunc("/api/metrics", func(w http.ResponseWriter, r *http.Request) {
+		hub.ServeMetrics(h, metricsToken, w, r)
+	})
+
 	http.HandleFunc("/api/register", enableCORS(authHandler.Register))
 	http.HandleFunc("/api/login", enableCORS(authHandler.Login))
+	http.HandleFunc("/api/me", enableCORS(authHandler.Me))
+	http.HandleFunc("/api/me/password", enableCORS(authHandler.ChangePassword))
+	http.HandleFunc("/api/keys", enableCORS(authHandler.APIKeys))
+	http.HandleFunc("/api/2fa", enableCORS(authHandler.TwoFactor))
+	http.HandleFunc("/api/2fa/verify", enableCORS(authHandler.VerifySecondFactor))
+	http.HandleFunc("/api/2fa/setup", enableCORS(authHandler.SetupTOTP))
+	http.HandleFunc("/api/2fa/confirm", enableCORS(authHandler.ConfirmTOTP))
+	http.HandleFunc("/api/2fa/disable", enableCORS(authHandler.DisableTOTP))
+	http.HandleFunc("/api/2fa/recovery-codes", enableCORS(authHandler.RegenerateRecoveryCodes))
+	http.HandleFunc("/api/refresh", enableCORS(authHandler.Refresh))
+	http.HandleFunc("/api/logout", enableCORS(authHandler.Logout))
+	http.HandleFunc("/api/logout-all", enableCORS(authHandler.LogoutAll))
+	http.HandleFunc("/api/password/forgot", enableCORS(authHandler.ForgotPassword))
+	http.HandleFunc("/api/password/reset", enableCORS(authHandler.ResetPassword))
+	http.HandleFunc("/api/email/verify", enableCORS(authHandler.VerifyEmail))
+	http.HandleFunc("/api/email/verify/send", enableCORS(authHandler.SendVerification))
+	http.HandleFunc("/api/oidc/config", enableCORS(authHandler.OIDCConfig))
+	http.HandleFunc("/api/oidc/login", authHandler.OIDCLogin)
+	http.HandleFunc("/api/oidc/callback", authHandler.OIDCCallback)
 	http.HandleFunc("/api/sessions", enableCORS(authHandler.GetUserSessions))
 	http.HandleFunc("/api/export", enableCORS(exportHandler.ExportDocument))
 	http.HandleFunc("/api/document/save", enableCORS(documentHandler.SaveDocument))
+	http.HandleFunc("/api/document/versions", enableCORS(documentHandler.ListVersions))
+	http.HandleFunc("/api/document/version", enableCORS(documentHandler.GetVersion))
+	http.HandleFunc("/api/document/diff", enableCORS(documentHandler.DiffVersions))
+	http.HandleFunc("/api/document/restore", enableCORS(documentHandler.RestoreVersion))
+	http.HandleFunc("/api/document/blame", enableCORS(documentHandler.Blame))
+	http.HandleFunc("/api/document/publish", enableCORS(publishHandler.Publications))
+	http.HandleFunc("/api/session/members", enableCORS(documentHandler.Members))
+	http.HandleFunc("/api/session/invites", enableCORS(documentHandler.Invites))
+	http.HandleFunc("/api/session/chat", enableCORS(documentHandler.ChatHistory))
+
+	server := &http.Server{Addr: ":8080"}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
-	log.Println("Server starting on :8080")
-	if err := http.ListenAndServe(":8080", nil); err != nil {
-		log.Fatal("ListenAndServe: ", err)
+	go func() {
+		log.Println("Server starting on :8080")
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal("ListenAndServe: ", err)
+		}
+	}()
+
+	<-ctx.Done()
+	log.Println("Shutting down, saving open documents")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	// Stop accepting connections first so no new sessions start while the
+	// hub is flushing. Websockets are hijacked and left to the hub.
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("HTTP server shutdown: %v", err)
+	}
+	if err := h.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Hub shutdown: %v", err)
 	}
+	log.Println("Server stopped")
 }
\ No newline at end of file
@@ -0,0 +1,66 @@
+// Package access defines the roles a user can hold in a session and what
+// each of them is allowed to do.
+package access
+
+// Role is a user's level of access to one session. The zero value grants
+// nothing.
+type Role string
+
+const (
+	None      Role = ""
+	Owner     Role = "owner"
+	Editor    Role = "editor"
+	Commenter Role = "commenter"
+	Viewer    Role = "viewer"
+)
+
+// Parse returns the role named s. Only roles that can be granted to other
+// users are accepted; ownership is never granted.
+func Parse(s string) (Role, bool) {
+	switch r := Role(s); r {
+	case Editor, Commenter, Viewer:
+		return r, true
+	}
+	return None, false
+}
+
+// CanView reports whether the role may read the document
+func (r Role) CanView() bool {
+	return r != None
+}
+
+// CanComment reports whether the role may discuss the document without
+// changing its text
+func (r Role) CanComment() bool {
+	return r == Owner || r == Editor || r == Commenter
+}
+
+// CanEdit reports whether the role may change the document text
+func (r Role) CanEdit() bool {
+	return r == Owner || r == Editor
+}
+
+// CanManage reports whether the role may grant and revoke access
+func (r Role) CanManage() bool {
+	return r == Owner
+}
+
+var rank = map[Role]int{
+	Viewer:    1,
+	Commenter: 2,
+	Editor:    3,
+	Owner:     4,
+}
+
+// AtLeast reports whether r allows everything other does
+func (r Role) AtLeast(other Role) bool {
+	return rank[r] >= rank[other]
+}
+
+// Limit returns r, lowered to max if r allows more than max does
+func (r Role) Limit(max Role) Role {
+	if max.AtLeast(r) {
+		return r
+	}
+	return max
+}
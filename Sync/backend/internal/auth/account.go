@@ -0,0 +1,318 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"collab-editor/internal/access"
+	"collab-editor/internal/db"
+)
+
+// SessionHooks let account changes reach sessions that are open right now.
+// Either may be nil.
+type SessionHooks struct {
+	// Deleted runs for each session deleted along with its owner
+	Deleted func(sessionCode string)
+	// RoleChanged runs when a user's role in a session changes, such as
+	// when ownership is transferred
+	RoleChanged func(sessionCode string, userID int, role access.Role)
+}
+
+// Profile is what /api/me returns about the signed-in user
+type Profile struct {
+	*db.User
+	HasPassword bool `json:"has_password"`
+}
+
+// UpdateProfileRequest changes the fields that are set. Changing the email
+// needs the current password, since the email is where resets are sent.
+type UpdateProfileRequest struct {
+	Username        *string `json:"username"`
+	Email           *string `json:"email"`
+	DisplayName     *string `json:"display_name"`
+	AvatarURL       *string `json:"avatar_url"`
+	CurrentPassword string  `json:"current_password"`
+}
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+// DeleteAccountRequest confirms an account deletion with the password and
+// says what happens to the sessions the user owns: "transfer" them to the
+// user named TransferTo, or "delete" them.
+type DeleteAccountRequest struct {
+	Password   string `json:"password"`
+	Sessions   string `json:"sessions"`
+	TransferTo string `json:"transfer_to"`
+}
+
+func (h *AuthHandler) SetSessionHooks(hooks SessionHooks) {
+	h.sessionHooks = hooks
+}
+
+// Me reads (GET), updates (PATCH) and deletes (DELETE) the signed-in
+// user's account
+func (h *AuthHandler) Me(w http.ResponseWriter, r *http.Request) {
+	claims, ok := h.accountClaims(w, r)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		h.writeProfile(w, claims.UserID, nil)
+	case http.MethodPatch:
+		h.updateProfile(w, r, claims.UserID)
+	case http.MethodDelete:
+		h.deleteAccount(w, r, claims.UserID)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// ChangePassword sets a new password given the current one. Every other
+// login ends; this one stays signed in.
+func (h *AuthHandler) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	claims, ok := h.accountClaims(w, r)
+	if !ok {
+		return
+	}
+
+	var req ChangePasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if len(req.NewPassword) < 6 {
+		http.Error(w, "Password must be at least 6 characters", http.StatusBadRequest)
+		return
+	}
+	if !h.checkPassword(w, claims.UserID, req.CurrentPassword) {
+		return
+	}
+
+	if err := h.db.SetPassword(claims.UserID, req.NewPassword); err != nil {
+		http.Error(w, "Failed to change password", http.StatusInternalServerError)
+		return
+	}
+
+	logins, err := h.db.RevokeOtherLogins(claims.UserID, claims.LoginID)
+	if err != nil {
+		log.Printf("Failed to end other logins of user %d: %v", claims.UserID, err)
+	}
+	for _, login := range logins {
+		h.loggedOut(claims.UserID, login)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":       "password changed",
+		"logins_ended": len(logins),
+	})
+}
+
+func (h *AuthHandler) updateProfile(w http.ResponseWriter, r *http.Request, userID int) {
+	var req UpdateProfileRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	user, err := h.db.GetUserByID(userID)
+	if err != nil {
+		http.Error(w, "Failed to load profile", http.StatusInternalServerError)
+		return
+	}
+
+	username, email := user.Username, user.Email
+	displayName, avatarURL := user.DisplayName, user.AvatarURL
+	if req.Username != nil {
+		username = strings.TrimSpace(*req.Username)
+		if len(username) < 3 || len(username) > 50 {
+			http.Error(w, "Username must be 3 to 50 characters", http.StatusBadRequest)
+			return
+		}
+	}
+	if req.Email != nil {
+		email = strings.TrimSpace(*req.Email)
+		if !strings.Contains(email, "@") || len(email) > 100 {
+			http.Error(w, "Invalid email address", http.StatusBadRequest)
+			return
+		}
+	}
+	if req.DisplayName != nil {
+		displayName = strings.TrimSpace(*req.DisplayName)
+		if utf8.RuneCountInString(displayName) > 100 || strings.IndexFunc(displayName, unicode.IsControl) >= 0 {
+			http.Error(w, "Display name must be at most 100 printable characters", http.StatusBadRequest)
+			return
+		}
+	}
+	if req.AvatarURL != nil {
+		avatarURL = strings.TrimSpace(*req.AvatarURL)
+		if avatarURL != "" && !validAvatarURL(avatarURL) {
+			http.Error(w, "Avatar must be an http or https URL", http.StatusBadRequest)
+			return
+		}
+	}
+
+	emailChanged := !strings.EqualFold(email, user.Email)
+	if emailChanged && !h.checkPassword(w, userID, req.CurrentPassword) {
+		return
+	}
+
+	user, err = h.db.UpdateProfile(userID, username, email, displayName, avatarURL)
+	switch {
+	case errors.Is(err, db.ErrUsernameTaken):
+		http.Error(w, "Username is already taken", http.StatusConflict)
+		return
+	case errors.Is(err, db.ErrEmailTaken):
+		http.Error(w, "Email is already registered", http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, "Failed to update profile", http.StatusInternalServerError)
+		return
+	}
+
+	if emailChanged {
+		go h.sendVerification(user)
+	}
+	h.writeProfile(w, userID, user)
+}
+
+func (h *AuthHandler) deleteAccount(w http.ResponseWriter, r *http.Request, userID int) {
+	var req DeleteAccountRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if !h.checkPassword(w, userID, req.Password) {
+		return
+	}
+
+	owned, err := h.db.OwnedSessions(userID)
+	if err != nil {
+		http.Error(w, "Failed to delete account", http.StatusInternalServerError)
+		return
+	}
+
+	var transferTo int
+	switch {
+	case len(owned) == 0:
+	case req.Sessions == "delete":
+	case req.Sessions == "transfer":
+		recipient, err := h.db.GetUserByUsername(req.TransferTo)
+		if err != nil || recipient.ID == userID {
+			http.Error(w, "Choose another existing user to transfer your sessions to", http.StatusBadRequest)
+			return
+		}
+		transferTo = recipient.ID
+	default:
+		http.Error(w, fmt.Sprintf("You own %d sessions; choose whether to transfer or delete them", len(owned)), http.StatusConflict)
+		return
+	}
+
+	codes, err := h.db.DeleteUser(userID, transferTo)
+	if err != nil {
+		log.Printf("Failed to delete user %d: %v", userID, err)
+		http.Error(w, "Failed to delete account", http.StatusInternalServerError)
+		return
+	}
+	if transferTo > 0 {
+		log.Printf("Deleted user %d and transferred %d sessions to user %d", userID, len(codes), transferTo)
+	} else {
+		log.Printf("Deleted user %d and %d sessions", userID, len(codes))
+	}
+
+	h.loggedOut(userID, "")
+	for _, code := range codes {
+		if transferTo > 0 && h.sessionHooks.RoleChanged != nil {
+			h.sessionHooks.RoleChanged(code, transferTo, access.Owner)
+		}
+		if transferTo == 0 && h.sessionHooks.Deleted != nil {
+			h.sessionHooks.Deleted(code)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":   "account deleted",
+		"sessions": len(codes),
+	})
+}
+
+// accountClaims authenticates a request to manage the account, which needs
+// a signed-in user rather than an API key
+func (h *AuthHandler) accountClaims(w http.ResponseWriter, r *http.Request) (*Claims, bool) {
+	claims, err := h.RequestClaims(r)
+	if err != nil || claims == nil {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return nil, false
+	}
+	if claims.APIKeyID != 0 {
+		http.Error(w, "API keys cannot manage the account", http.StatusForbidden)
+		return nil, false
+	}
+	return claims, true
+}
+
+// checkPassword confirms a sensitive change with the user's password and
+// writes the error response if it is wrong
+func (h *AuthHandler) checkPassword(w http.ResponseWriter, userID int, password string) bool {
+	hasPassword, ok, err := h.db.CheckPassword(userID, password)
+	if err != nil {
+		http.Error(w, "Failed to check password", http.StatusInternalServerError)
+		return false
+	}
+	if !hasPassword {
+		http.Error(w, "Your account has no password yet; set one with a password reset first", http.StatusForbidden)
+		return false
+	}
+	if !ok {
+		http.Error(w, "Current password is incorrect", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// writeProfile responds with the user's profile, loading the user if it is
+// not given
+func (h *AuthHandler) writeProfile(w http.ResponseWriter, userID int, user *db.User) {
+	if user == nil {
+		var err error
+		if user, err = h.db.GetUserByID(userID); err != nil {
+			http.Error(w, "Failed to load profile", http.StatusInternalServerError)
+			return
+		}
+	}
+	hasPassword, err := h.db.HasPassword(userID)
+	if err != nil {
+		http.Error(w, "Failed to load profile", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Profile{User: user, HasPassword: hasPassword})
+}
+
+// validAvatarURL accepts absolute http and https URLs, so an avatar can never
+// be a javascript: or data: URL in someone else's browser
+func validAvatarURL(raw string) bool {
+	if len(raw) > 500 {
+		return false
+	}
+	u, err := url.Parse(raw)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
@@ -0,0 +1,197 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"collab-editor/internal/access"
+	"collab-editor/internal/db"
+)
+
+// apiKeyPrefix tells API keys apart from access tokens, and makes them easy
+// to spot when they leak into logs or repositories
+const apiKeyPrefix = "sk_"
+
+const maxAPIKeyTTL = 365 * 24 * time.Hour
+
+// Scopes an API key can have. Each caps the role the key's user acts with
+// in a session; a key never grants more than its user has.
+const (
+	ScopeRead   = "read"
+	ScopeWrite  = "write"
+	ScopeManage = "manage"
+)
+
+var scopeRoles = map[string]access.Role{
+	ScopeRead:   access.Viewer,
+	ScopeWrite:  access.Editor,
+	ScopeManage: access.Owner,
+}
+
+// errAPIKeyNotAllowed is returned where only a signed-in user may act, such
+// as managing the account itself
+var errAPIKeyNotAllowed = errors.New("API keys cannot be used here")
+
+type CreateAPIKeyRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	// ExpiresIn is in seconds; zero never expires
+	ExpiresIn int `json:"expires_in"`
+}
+
+type CreateAPIKeyResponse struct {
+	APIKey *db.APIKey `json:"api_key"`
+	Key    string     `json:"key"`
+}
+
+// MaxRole is the most the credential lets its user do in a session
+func (c *Claims) MaxRole() access.Role {
+	if c.APIKeyID == 0 {
+		return access.Owner
+	}
+	max := access.None
+	for _, scope := range c.Scopes {
+		if role := scopeRoles[scope]; role.AtLeast(max) {
+			max = role
+		}
+	}
+	return max
+}
+
+// parseAPIKey resolves an API key to the claims of its user
+func (h *AuthHandler) parseAPIKey(key string) (*Claims, error) {
+	apiKey, err := h.db.UseAPIKey(hashToken(key))
+	if err != nil {
+		return nil, err
+	}
+	return &Claims{
+		UserID: apiKey.UserID,
+		// Websockets opened with a key are closed like a login's when the
+		// key is revoked
+		LoginID:  apiKeyLogin(apiKey.ID),
+		APIKeyID: apiKey.ID,
+		Scopes:   apiKey.Scopes,
+	}, nil
+}
+
+func apiKeyLogin(keyID int) string {
+	return "key:" + strconv.Itoa(keyID)
+}
+
+// accountUser is RequestUser for endpoints that change the account itself,
+// which need the user to be signed in rather than a script with a key
+func (h *AuthHandler) accountUser(r *http.Request) (int, error) {
+	claims, err := h.RequestClaims(r)
+	if err != nil || claims == nil {
+		return 0, err
+	}
+	if claims.APIKeyID != 0 {
+		return 0, errAPIKeyNotAllowed
+	}
+	return claims.UserID, nil
+}
+
+// APIKeys lists (GET), creates (POST) and revokes (DELETE) the signed-in
+// user's API keys
+func (h *AuthHandler) APIKeys(w http.ResponseWriter, r *http.Request) {
+	userID, err := h.accountUser(r)
+	if errors.Is(err, errAPIKeyNotAllowed) {
+		http.Error(w, "API keys cannot manage API keys", http.StatusForbidden)
+		return
+	}
+	if err != nil || userID == 0 {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		keys, err := h.db.ListAPIKeys(userID)
+		if err != nil {
+			http.Error(w, "Failed to list API keys", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(keys)
+	case http.MethodPost:
+		h.createAPIKey(w, r, userID)
+	case http.MethodDelete:
+		h.revokeAPIKey(w, r, userID)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *AuthHandler) createAPIKey(w http.ResponseWriter, r *http.Request, userID int) {
+	var req CreateAPIKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > 100 {
+		http.Error(w, "Name must be 1 to 100 characters", http.StatusBadRequest)
+		return
+	}
+	if len(req.Scopes) == 0 {
+		http.Error(w, "At least one scope is required", http.StatusBadRequest)
+		return
+	}
+	for _, scope := range req.Scopes {
+		if _, ok := scopeRoles[scope]; !ok {
+			http.Error(w, "Unknown scope: "+scope, http.StatusBadRequest)
+			return
+		}
+	}
+	ttl := time.Duration(req.ExpiresIn) * time.Second
+	if ttl < 0 || ttl > maxAPIKeyTTL {
+		http.Error(w, "Keys can expire in at most a year", http.StatusBadRequest)
+		return
+	}
+
+	secret, err := randomToken(32)
+	if err != nil {
+		http.Error(w, "Failed to create API key", http.StatusInternalServerError)
+		return
+	}
+	key := apiKeyPrefix + secret
+
+	apiKey, err := h.db.CreateAPIKey(userID, req.Name, key[:len(apiKeyPrefix)+6], hashToken(key), req.Scopes, ttl)
+	if err != nil {
+		http.Error(w, "Failed to create API key", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(CreateAPIKeyResponse{APIKey: apiKey, Key: key})
+}
+
+func (h *AuthHandler) revokeAPIKey(w http.ResponseWriter, r *http.Request, userID int) {
+	keyID, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, "API key ID required", http.StatusBadRequest)
+		return
+	}
+
+	revoked, err := h.db.RevokeAPIKey(userID, keyID)
+	if err != nil {
+		http.Error(w, "Failed to revoke API key", http.StatusInternalServerError)
+		return
+	}
+	if !revoked {
+		http.Error(w, "API key not found", http.StatusNotFound)
+		return
+	}
+	h.loggedOut(userID, apiKeyLogin(keyID))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "revoked",
+		"id":     keyID,
+	})
+}
@@ -6,7 +6,10 @@ import (
 	"strings"
 	"time"
 
+	"collab-editor/internal/access"
 	"collab-editor/internal/db"
+	"collab-editor/internal/mail"
+	"collab-editor/internal/oidc"
 
 	"github.com/golang-jwt/jwt/v5"
 )
@@ -14,6 +17,14 @@ import (
 type AuthHandler struct {
 	db        *db.Database
 	jwtSecret []byte
+	onLogout  func(userID int, loginID string)
+
+	oidc        *oidc.Provider
+	mailer      mail.Sender
+	frontendURL string
+	trustProxy  bool
+
+	sessionHooks SessionHooks
 }
 
 type LoginRequest struct {
@@ -27,15 +38,21 @@ type RegisterRequest struct {
 	Password string `json:"password"`
 }
 
+// AuthResponse carries a short-lived access token, to be sent as the
+// bearer token, and the refresh token that gets the next one.
 type AuthResponse struct {
-	Token string   `json:"token"`
-	User  *db.User `json:"user"`
+	Token        string   `json:"token"`
+	RefreshToken string   `json:"refresh_token"`
+	ExpiresIn    int      `json:"expires_in"`
+	User         *db.User `json:"user"`
 }
 
 func NewAuthHandler(database *db.Database, jwtSecret string) *AuthHandler {
 	return &AuthHandler{
-		db:        database,
-		jwtSecret: []byte(jwtSecret),
+		db:          database,
+		jwtSecret:   []byte(jwtSecret),
+		mailer:      mail.LogSender{},
+		frontendURL: "http://localhost:3000",
 	}
 }
 
@@ -51,29 +68,36 @@ func (h *AuthHandler) Register(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	ip := h.clientIP(r)
+	attempt, refused := h.throttleQuota(w, attemptRegister, req.Username, ip, registerQuota)
+	if refused {
+		return
+	}
+
 	// Validate input
 	if len(req.Username) < 3 || len(req.Password) < 6 {
+		h.finishAttempt(attempt, false, "invalid input")
 		http.Error(w, "Username must be at least 3 characters and password at least 6 characters", http.StatusBadRequest)
 		return
 	}
 
 	user, err := h.db.CreateUser(req.Username, req.Email, req.Password)
 	if err != nil {
+		h.finishAttempt(attempt, false, "already exists")
 		http.Error(w, "Username or email already exists", http.StatusConflict)
 		return
 	}
+	h.finishAttempt(attempt, true, "")
+	go h.sendVerification(user)
 
-	token, err := h.generateToken(user)
+	response, err := h.startLogin(user)
 	if err != nil {
 		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(AuthResponse{
-		Token: token,
-		User:  user,
-	})
+	json.NewEncoder(w).Encode(response)
 }
 
 func (h *AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
@@ -88,23 +112,36 @@ func (h *AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	ip := h.clientIP(r)
+	attempt, refused := h.throttleFailures(w, attemptLogin, req.Username, ip)
+	if refused {
+		return
+	}
+
 	user, err := h.db.VerifyUserPassword(req.Username, req.Password)
 	if err != nil {
+		h.finishAttempt(attempt, false, "invalid credentials")
 		http.Error(w, "Invalid username or password", http.StatusUnauthorized)
 		return
 	}
+	h.finishAttempt(attempt, true, "")
 
-	token, err := h.generateToken(user)
+	// With two-factor authentication the tokens wait for a valid code
+	if pending, err := h.secondFactor(w, user); err != nil {
+		http.Error(w, "Failed to log in", http.StatusInternalServerError)
+		return
+	} else if pending {
+		return
+	}
+
+	response, err := h.startLogin(user)
 	if err != nil {
 		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(AuthResponse{
-		Token: token,
-		User:  user,
-	})
+	json.NewEncoder(w).Encode(response)
 }
 
 func (h *AuthHandler) GetUserSessions(w http.ResponseWriter, r *http.Request) {
@@ -137,35 +174,218 @@ func (h *AuthHandler) GetUserSessions(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(sessions)
 }
 
-func (h *AuthHandler) generateToken(user *db.User) (string, error) {
+func (h *AuthHandler) generateToken(user *db.User, loginID string) (string, error) {
 	claims := jwt.MapClaims{
 		"user_id":  user.ID,
 		"username": user.Username,
-		"exp":      time.Now().Add(time.Hour * 24 * 7).Unix(), // 7 days
+		"login":    loginID,
+		"exp":      time.Now().Add(accessTokenTTL).Unix(),
 	}
 
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 	return token.SignedString(h.jwtSecret)
 }
 
+// ValidateToken checks an access token and returns its user. Tokens of a
+// login that was revoked are refused even if they have not expired yet.
 func (h *AuthHandler) ValidateToken(tokenString string) (int, error) {
+	claims, err := h.ParseToken(tokenString)
+	if err != nil {
+		return 0, err
+	}
+	return claims.UserID, nil
+}
+
+// InviteClaims is what a signed invite link grants
+type InviteClaims struct {
+	InviteID    int
+	SessionCode string
+	Role        access.Role
+}
+
+// InviteToken signs an invite link. The token only proves the invite was
+// issued; whether it is still usable is tracked in the database.
+func (h *AuthHandler) InviteToken(invite *db.Invite, sessionCode string) (string, error) {
+	claims := jwt.MapClaims{
+		"invite":  invite.ID,
+		"session": sessionCode,
+		"role":    string(invite.Role),
+		"exp":     invite.ExpiresAt.Unix(),
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString(h.jwtSecret)
+}
+
+// ValidateInvite checks the signature and expiry of an invite token. Login
+// tokens are not invites and are rejected.
+func (h *AuthHandler) ValidateInvite(tokenString string) (*InviteClaims, error) {
+	return h.parseInviteClaims(tokenString, "invite")
+}
+
+// guestPassTTL bounds how long a guest keeps an invited role across
+// reconnects without the invite being charged again
+const guestPassTTL = 30 * 24 * time.Hour
+
+// GuestPass signs proof that a guest redeemed an invite. Guests send it
+// when they reconnect to get the invited role back without using up the
+// invite again; whether the invite is still active is checked separately.
+func (h *AuthHandler) GuestPass(invite *InviteClaims) (string, error) {
+	claims := jwt.MapClaims{
+		"pass":    invite.InviteID,
+		"session": invite.SessionCode,
+		"role":    string(invite.Role),
+		"exp":     time.Now().Add(guestPassTTL).Unix(),
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString(h.jwtSecret)
+}
+
+// ValidateGuestPass checks the signature and expiry of a guest pass and
+// returns the invite it was issued for
+func (h *AuthHandler) ValidateGuestPass(tokenString string) (*InviteClaims, error) {
+	return h.parseInviteClaims(tokenString, "pass")
+}
+
+// guestTabTTL bounds how long a guest can reconnect under the same
+// connection ID
+const guestTabTTL = 24 * time.Hour
+
+// GuestTab signs the tab part of a guest's connection ID, which the server
+// picks, so the guest can keep it across reconnects
+func (h *AuthHandler) GuestTab(tab string) (string, error) {
+	claims := jwt.MapClaims{
+		"tab": tab,
+		"exp": time.Now().Add(guestTabTTL).Unix(),
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString(h.jwtSecret)
+}
+
+// ValidateGuestTab checks the signature and expiry of a guest tab token and
+// returns the tab it was issued for
+func (h *AuthHandler) ValidateGuestTab(tokenString string) (string, error) {
 	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
 		return h.jwtSecret, nil
-	})
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+	if err != nil {
+		return "", err
+	}
 
-	if err != nil || !token.Valid {
-		return 0, err
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return "", jwt.ErrTokenInvalidClaims
+	}
+	tab, ok := claims["tab"].(string)
+	if !ok || tab == "" {
+		return "", jwt.ErrInvalidKey
+	}
+	return tab, nil
+}
+
+// parseInviteClaims reads an invite or guest pass, which carry the invite
+// ID under key
+func (h *AuthHandler) parseInviteClaims(tokenString, key string) (*InviteClaims, error) {
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		return h.jwtSecret, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid {
+		return nil, jwt.ErrTokenInvalidClaims
 	}
 
 	claims, ok := token.Claims.(jwt.MapClaims)
 	if !ok {
-		return 0, jwt.ErrInvalidKey
+		return nil, jwt.ErrInvalidKey
 	}
 
-	userID, ok := claims["user_id"].(float64)
+	inviteID, ok := claims[key].(float64)
 	if !ok {
-		return 0, jwt.ErrInvalidKey
+		return nil, jwt.ErrInvalidKey
+	}
+	sessionCode, _ := claims["session"].(string)
+	role, _ := claims["role"].(string)
+
+	return &InviteClaims{
+		InviteID:    int(inviteID),
+		SessionCode: sessionCode,
+		Role:        access.Role(role),
+	}, nil
+}
+
+// RequestUser returns the user behind the token in the Authorization header
+// or, for websockets and downloads that cannot set headers, the token query
+// parameter. It returns zero without an error if no token was sent.
+func (h *AuthHandler) RequestUser(r *http.Request) (int, error) {
+	claims, err := h.RequestClaims(r)
+	if err != nil || claims == nil {
+		return 0, err
+	}
+	return claims.UserID, nil
+}
+
+// RequestClaims is like RequestUser but returns the whole token. It returns
+// nil without an error if no token was sent.
+func (h *AuthHandler) RequestClaims(r *http.Request) (*Claims, error) {
+	token := r.URL.Query().Get("token")
+	if authHeader := r.Header.Get("Authorization"); authHeader != "" {
+		token = strings.TrimPrefix(authHeader, "Bearer ")
+	}
+	if token == "" {
+		return nil, nil
 	}
+	return h.ParseToken(token)
+}
+
+// SessionRole returns the role userID holds in a session, zero meaning an
+// anonymous user. Sessions nobody has claimed yet are open to everyone as
+// editors.
+func (h *AuthHandler) SessionRole(sessionCode string, userID int) (access.Role, error) {
+	role, owned, err := h.db.SessionAccess(sessionCode, userID)
+	if err != nil {
+		return access.None, err
+	}
+	if !owned {
+		return access.Editor, nil
+	}
+	return role, nil
+}
 
-	return int(userID), nil
+// Authorize works out the caller's role in a session and checks it with
+// allowed, writing the error response if the caller is refused. It returns
+// the caller's user ID, zero if anonymous, and their role.
+func (h *AuthHandler) Authorize(w http.ResponseWriter, r *http.Request, sessionCode string, allowed func(access.Role) bool) (int, access.Role, bool) {
+	claims, err := h.RequestClaims(r)
+	if err != nil {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return 0, access.None, false
+	}
+	var userID int
+	if claims != nil {
+		userID = claims.UserID
+	}
+
+	role, err := h.SessionRole(sessionCode, userID)
+	if err != nil {
+		http.Error(w, "Failed to check access", http.StatusInternalServerError)
+		return 0, access.None, false
+	}
+	if claims != nil {
+		role = role.Limit(claims.MaxRole())
+	}
+
+	if !allowed(role) {
+		if userID == 0 {
+			http.Error(w, "Login required", http.StatusUnauthorized)
+		} else {
+			http.Error(w, "Access denied", http.StatusForbidden)
+		}
+		return 0, access.None, false
+	}
+	return userID, role, true
 }
@@ -0,0 +1,273 @@
+package auth
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"collab-editor/internal/db"
+	"collab-editor/internal/oidc"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	// oidcCookie carries the state, nonce and PKCE verifier of a sign-in
+	// from the redirect to the IdP until its callback
+	oidcCookie  = "oidc_flow"
+	oidcFlowTTL = 10 * time.Minute
+)
+
+// errNoEmail is returned when the IdP shares no email for a new user
+var errNoEmail = errors.New("identity provider shared no email address")
+
+// SetOIDC enables single sign-on through provider. After signing in the
+// browser is sent back to the frontend with the tokens in the fragment.
+func (h *AuthHandler) SetOIDC(provider *oidc.Provider) {
+	h.oidc = provider
+}
+
+// OIDCConfig tells the frontend whether to offer single sign-on
+func (h *AuthHandler) OIDCConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{"enabled": h.oidc != nil})
+}
+
+// OIDCLogin starts the authorization-code flow by redirecting to the IdP
+func (h *AuthHandler) OIDCLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.oidc == nil {
+		http.Error(w, "Single sign-on is not configured", http.StatusNotFound)
+		return
+	}
+
+	state, err1 := randomToken(16)
+	nonce, err2 := randomToken(16)
+	verifier, err3 := randomToken(32)
+	if err := errors.Join(err1, err2, err3); err != nil {
+		http.Error(w, "Failed to start sign-in", http.StatusInternalServerError)
+		return
+	}
+
+	target, err := h.oidc.AuthCodeURL(r.Context(), state, nonce, verifier)
+	if err != nil {
+		log.Printf("Failed to start single sign-on: %v", err)
+		http.Error(w, "Identity provider is unavailable", http.StatusBadGateway)
+		return
+	}
+
+	flow, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"state":    state,
+		"nonce":    nonce,
+		"verifier": verifier,
+		"exp":      time.Now().Add(oidcFlowTTL).Unix(),
+	}).SignedString(h.jwtSecret)
+	if err != nil {
+		http.Error(w, "Failed to start sign-in", http.StatusInternalServerError)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcCookie,
+		Value:    flow,
+		Path:     "/api/oidc",
+		MaxAge:   int(oidcFlowTTL / time.Second),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// OIDCCallback finishes the flow: it checks the state, exchanges the code,
+// verifies the ID token and signs in the linked user, creating one on
+// first sign-in
+func (h *AuthHandler) OIDCCallback(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.oidc == nil {
+		http.Error(w, "Single sign-on is not configured", http.StatusNotFound)
+		return
+	}
+
+	// The flow cookie is single use
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcCookie,
+		Path:     "/api/oidc",
+		MaxAge:   -1,
+		HttpOnly: true,
+	})
+
+	query := r.URL.Query()
+	if e := query.Get("error"); e != "" {
+		h.oidcFailed(w, r, "Sign-in was cancelled or refused")
+		return
+	}
+
+	cookie, err := r.Cookie(oidcCookie)
+	if err != nil {
+		h.oidcFailed(w, r, "Sign-in expired, please try again")
+		return
+	}
+	flow, err := h.parseFlow(cookie.Value)
+	if err != nil || query.Get("state") == "" || query.Get("state") != flow["state"] {
+		h.oidcFailed(w, r, "Sign-in expired, please try again")
+		return
+	}
+
+	claims, err := h.oidc.Exchange(r.Context(), query.Get("code"), flow["verifier"], flow["nonce"])
+	if err != nil {
+		log.Printf("Single sign-on failed: %v", err)
+		h.oidcFailed(w, r, "Could not verify your sign-in")
+		return
+	}
+
+	user, err := h.linkedUser(claims)
+	if err != nil {
+		log.Printf("Single sign-on for %s at %s failed: %v", claims.Subject, claims.Issuer, err)
+		switch {
+		case errors.Is(err, errNoEmail):
+			h.oidcFailed(w, r, "Your identity provider did not share an email address")
+		case errors.Is(err, db.ErrEmailTaken):
+			h.oidcFailed(w, r, "An account with this email already exists, sign in with your password")
+		default:
+			h.oidcFailed(w, r, "Failed to sign in")
+		}
+		return
+	}
+
+	// The IdP stands in for the password, not for the second factor
+	challenge, err := h.challenge(user)
+	if err != nil {
+		h.oidcFailed(w, r, "Failed to sign in")
+		return
+	}
+	if challenge != "" {
+		fragment := url.Values{"challenge": {challenge}}
+		http.Redirect(w, r, h.frontendURL+"/index.html#"+fragment.Encode(), http.StatusFound)
+		return
+	}
+
+	response, err := h.startLogin(user)
+	if err != nil {
+		h.oidcFailed(w, r, "Failed to generate token")
+		return
+	}
+
+	// The fragment never reaches a server, so the tokens stay out of logs
+	fragment := url.Values{
+		"token":         {response.Token},
+		"refresh_token": {response.RefreshToken},
+		"expires_in":    {strconv.Itoa(response.ExpiresIn)},
+		"user_id":       {strconv.Itoa(user.ID)},
+		"username":      {user.Username},
+	}
+	http.Redirect(w, r, h.frontendURL+"/index.html#"+fragment.Encode(), http.StatusFound)
+}
+
+func (h *AuthHandler) parseFlow(value string) (map[string]string, error) {
+	token, err := jwt.Parse(value, func(token *jwt.Token) (interface{}, error) {
+		return h.jwtSecret, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithExpirationRequired())
+	if err != nil {
+		return nil, err
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return nil, jwt.ErrTokenInvalidClaims
+	}
+
+	flow := make(map[string]string, 3)
+	for _, key := range []string{"state", "nonce", "verifier"} {
+		v, _ := claims[key].(string)
+		if v == "" {
+			return nil, jwt.ErrTokenInvalidClaims
+		}
+		flow[key] = v
+	}
+	return flow, nil
+}
+
+// linkedUser returns the user linked to the IdP account. An unlinked
+// account is linked to the user with the same email if both the IdP and
+// we have verified it, and otherwise gets a new user.
+func (h *AuthHandler) linkedUser(claims *oidc.Claims) (*db.User, error) {
+	user, err := h.db.UserByIdentity(claims.Issuer, claims.Subject)
+	if err == nil {
+		return user, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	if claims.Email == "" {
+		return nil, errNoEmail
+	}
+
+	if claims.EmailVerified {
+		user, err := h.db.UserByEmail(claims.Email)
+		if err == nil && user.EmailVerified {
+			if err := h.db.LinkIdentity(user.ID, claims.Issuer, claims.Subject, claims.Email); err != nil {
+				return nil, err
+			}
+			log.Printf("Linked single sign-on account %s to user %d", claims.Subject, user.ID)
+			return user, nil
+		}
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+	}
+
+	return h.db.CreateExternalUser(usernameFor(claims), claims.Email, claims.EmailVerified, claims.Issuer, claims.Subject)
+}
+
+// oidcFailed sends the browser back to the frontend with an error to show
+func (h *AuthHandler) oidcFailed(w http.ResponseWriter, r *http.Request, message string) {
+	fragment := url.Values{"sso_error": {message}}
+	http.Redirect(w, r, h.frontendURL+"/index.html#"+fragment.Encode(), http.StatusFound)
+}
+
+// usernameFor picks a username for a new user from the IdP's claims,
+// keeping it to the characters and length a username may have
+func usernameFor(claims *oidc.Claims) string {
+	candidate := claims.PreferredUsername
+	if candidate == "" {
+		candidate, _, _ = strings.Cut(claims.Email, "@")
+	}
+
+	var b strings.Builder
+	for _, r := range candidate {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '_', r == '-':
+			b.WriteRune(r)
+		}
+		if b.Len() >= 40 {
+			break
+		}
+	}
+
+	name := b.String()
+	if name == "" {
+		name = "user"
+	}
+	for len(name) < 3 {
+		name += "_"
+	}
+	return name
+}
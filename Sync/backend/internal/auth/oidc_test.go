@@ -0,0 +1,266 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"collab-editor/internal/oidc"
+	"collab-editor/internal/oidc/oidctest"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const callbackURL = "http://app.test/api/oidc/callback"
+
+func newOIDCHandler(t *testing.T) (*AuthHandler, *oidctest.IdP) {
+	t.Helper()
+	idp := oidctest.New(t, "client")
+	h := NewAuthHandler(nil, "test-secret")
+	h.SetOIDC(oidc.NewProvider(oidc.Config{
+		Issuer:      idp.URL,
+		ClientID:    idp.ClientID,
+		RedirectURL: callbackURL,
+		Scopes:      []string{"openid", "email"},
+	}))
+	return h, idp
+}
+
+// startLogin runs OIDCLogin and returns the flow cookie it sets and the
+// authorization request it redirects to
+func startLogin(t *testing.T, h *AuthHandler) (*http.Cookie, url.Values) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.OIDCLogin(rec, httptest.NewRequest(http.MethodGet, "/api/oidc/login", nil))
+	if rec.Code != http.StatusFound {
+		t.Fatalf("login returned %d: %s", rec.Code, rec.Body)
+	}
+
+	var flow *http.Cookie
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == oidcCookie {
+			flow = c
+		}
+	}
+	if flow == nil {
+		t.Fatal("login set no flow cookie")
+	}
+	target, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return flow, target.Query()
+}
+
+// callback runs OIDCCallback with query and cookie and returns the
+// fragment the browser is sent back to the frontend with
+func callback(t *testing.T, h *AuthHandler, query url.Values, cookie *http.Cookie) url.Values {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, "/api/oidc/callback?"+query.Encode(), nil)
+	if cookie != nil {
+		r.AddCookie(cookie)
+	}
+	rec := httptest.NewRecorder()
+	h.OIDCCallback(rec, r)
+	if rec.Code != http.StatusFound {
+		t.Fatalf("callback returned %d: %s", rec.Code, rec.Body)
+	}
+
+	location := rec.Header().Get("Location")
+	if !strings.HasPrefix(location, h.frontendURL+"/index.html#") {
+		t.Fatalf("callback redirected to %q", location)
+	}
+	fragment, err := url.ParseQuery(strings.SplitN(location, "#", 2)[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fragment
+}
+
+// authorize follows the redirect to the IdP and returns the query the IdP
+// sends the browser back with
+func authorize(t *testing.T, idp *oidctest.IdP, request url.Values) url.Values {
+	t.Helper()
+	noRedirect := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := noRedirect.Get(idp.URL + "/authorize?" + request.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("authorize returned %s", resp.Status)
+	}
+	back, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return back.Query()
+}
+
+func TestOIDCLogin(t *testing.T) {
+	h, idp := newOIDCHandler(t)
+	cookie, request := startLogin(t, h)
+
+	if cookie.Path != "/api/oidc" || !cookie.HttpOnly {
+		t.Errorf("flow cookie is not kept to the callback: %+v", cookie)
+	}
+	flow, err := h.parseFlow(cookie.Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if request.Get("client_id") != idp.ClientID || request.Get("redirect_uri") != callbackURL {
+		t.Errorf("authorization request is for the wrong client: %v", request)
+	}
+	if request.Get("state") != flow["state"] || request.Get("nonce") != flow["nonce"] {
+		t.Error("state and nonce do not match the flow cookie")
+	}
+	if request.Get("code_challenge_method") != "S256" || request.Get("code_challenge") != oidc.Challenge(flow["verifier"]) {
+		t.Error("code challenge does not match the verifier in the flow cookie")
+	}
+}
+
+func TestOIDCLoginUnavailable(t *testing.T) {
+	h, idp := newOIDCHandler(t)
+	idp.Close()
+
+	rec := httptest.NewRecorder()
+	h.OIDCLogin(rec, httptest.NewRequest(http.MethodGet, "/api/oidc/login", nil))
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("login with the IdP down returned %d, want %d", rec.Code, http.StatusBadGateway)
+	}
+}
+
+func TestOIDCNotConfigured(t *testing.T) {
+	h := NewAuthHandler(nil, "test-secret")
+	for _, handler := range []http.HandlerFunc{h.OIDCLogin, h.OIDCCallback} {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodGet, "/api/oidc/", nil))
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("returned %d without an IdP, want %d", rec.Code, http.StatusNotFound)
+		}
+	}
+}
+
+func TestOIDCCallbackRefuses(t *testing.T) {
+	h, idp := newOIDCHandler(t)
+	cookie, request := startLogin(t, h)
+	back := authorize(t, idp, request)
+
+	withState := func(state string) url.Values {
+		return url.Values{"code": {back.Get("code")}, "state": {state}}
+	}
+	forged, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"state":    back.Get("state"),
+		"nonce":    "nonce",
+		"verifier": "verifier",
+		"exp":      time.Now().Add(time.Minute).Unix(),
+	}).SignedString([]byte("another-secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"state":    back.Get("state"),
+		"nonce":    "nonce",
+		"verifier": "verifier",
+		"exp":      time.Now().Add(-time.Minute).Unix(),
+	}).SignedString(h.jwtSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		query  url.Values
+		cookie *http.Cookie
+	}{
+		{"idp error", url.Values{"error": {"access_denied"}, "state": {back.Get("state")}}, cookie},
+		{"no cookie", back, nil},
+		{"wrong state", withState("another-state"), cookie},
+		{"no state", withState(""), cookie},
+		{"forged cookie", back, &http.Cookie{Name: oidcCookie, Value: forged}},
+		{"expired cookie", back, &http.Cookie{Name: oidcCookie, Value: expired}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fragment := callback(t, h, tt.query, tt.cookie)
+			if fragment.Get("sso_error") == "" || fragment.Get("token") != "" {
+				t.Errorf("callback was not refused: %v", fragment)
+			}
+		})
+	}
+}
+
+func TestOIDCCallbackVerifiesExchange(t *testing.T) {
+	h, idp := newOIDCHandler(t)
+	cookie, request := startLogin(t, h)
+	flow, err := h.parseFlow(cookie.Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		claims jwt.MapClaims
+		// verifier replaces the one in the flow cookie
+		verifier string
+	}{
+		{name: "wrong verifier", verifier: "another-verifier"},
+		{name: "wrong issuer", claims: jwt.MapClaims{"iss": "https://evil.test"}},
+		{name: "wrong audience", claims: jwt.MapClaims{"aud": "another-client"}},
+		{name: "wrong nonce", claims: jwt.MapClaims{"nonce": "another-nonce"}},
+		{name: "expired", claims: jwt.MapClaims{"exp": time.Now().Add(-time.Hour).Unix()}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			idp.Claims = jwt.MapClaims{"sub": "user-1"}
+			for k, v := range tt.claims {
+				idp.Claims[k] = v
+			}
+
+			// Every attempt needs a fresh code, under the same flow
+			back := authorize(t, idp, request)
+			flowCookie := cookie
+			if tt.verifier != "" {
+				value, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+					"state":    flow["state"],
+					"nonce":    flow["nonce"],
+					"verifier": tt.verifier,
+					"exp":      time.Now().Add(time.Minute).Unix(),
+				}).SignedString(h.jwtSecret)
+				if err != nil {
+					t.Fatal(err)
+				}
+				flowCookie = &http.Cookie{Name: oidcCookie, Value: value}
+			}
+
+			fragment := callback(t, h, back, flowCookie)
+			if fragment.Get("sso_error") != "Could not verify your sign-in" {
+				t.Errorf("callback was not refused: %v", fragment)
+			}
+		})
+	}
+}
+
+func TestUsernameFor(t *testing.T) {
+	tests := []struct {
+		claims oidc.Claims
+		want   string
+	}{
+		{oidc.Claims{PreferredUsername: "ana.lopez", Email: "ana@example.com"}, "ana.lopez"},
+		{oidc.Claims{Email: "bo@example.com"}, "bo_"},
+		{oidc.Claims{PreferredUsername: "Zoë Ann!"}, "ZoAnn"},
+		{oidc.Claims{PreferredUsername: "😀"}, "user"},
+		{oidc.Claims{PreferredUsername: strings.Repeat("a", 60)}, strings.Repeat("a", 40)},
+	}
+	for _, tt := range tests {
+		if got := usernameFor(&tt.claims); got != tt.want {
+			t.Errorf("usernameFor(%+v) = %q, want %q", tt.claims, got, tt.want)
+		}
+	}
+}
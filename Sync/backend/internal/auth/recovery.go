@@ -0,0 +1,220 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"collab-editor/internal/db"
+	"collab-editor/internal/mail"
+)
+
+const (
+	resetTokenTTL  = time.Hour
+	verifyTokenTTL = 48 * time.Hour
+	mailTimeout    = 30 * time.Second
+)
+
+type ForgotPasswordRequest struct {
+	Email string `json:"email"`
+}
+
+type ResetPasswordRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+type VerifyEmailRequest struct {
+	Token string `json:"token"`
+}
+
+// SetMailer sets how account emails are sent. Without it they are logged.
+func (h *AuthHandler) SetMailer(sender mail.Sender) {
+	h.mailer = sender
+}
+
+// SetFrontendURL sets where links in emails and single sign-on redirects
+// point to
+func (h *AuthHandler) SetFrontendURL(frontendURL string) {
+	h.frontendURL = strings.TrimSuffix(frontendURL, "/")
+}
+
+// ForgotPassword emails a password reset link. It answers the same whether
+// or not the email belongs to a user, so it cannot be used to find users.
+func (h *AuthHandler) ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req ForgotPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Email == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	ip := h.clientIP(r)
+	attempt, refused := h.throttleQuota(w, attemptForgot, req.Email, ip, forgotQuota)
+	if refused {
+		return
+	}
+
+	user, err := h.db.UserByEmail(req.Email)
+	h.finishAttempt(attempt, err == nil, "")
+	if err == nil {
+		go h.sendLink(user, db.TokenPasswordReset, resetTokenTTL, "reset-password.html",
+			"Reset your password",
+			"Someone asked to reset the password of your account %s.\n\nFollow this link within an hour to choose a new password:\n\n%s\n\nIf it was not you, ignore this email and your password stays the same.\n")
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"status": "If an account uses this email, a reset link is on its way",
+	})
+}
+
+// ResetPassword sets a new password with a reset link's token. Every login
+// of the user ends, since whoever held the old password is locked out.
+func (h *AuthHandler) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req ResetPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if len(req.Password) < 6 {
+		http.Error(w, "Password must be at least 6 characters", http.StatusBadRequest)
+		return
+	}
+
+	userID, err := h.db.UseUserToken(db.TokenPasswordReset, hashToken(req.Token))
+	if errors.Is(err, db.ErrLinkInvalid) {
+		http.Error(w, "Reset link is invalid or has expired", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to reset password", http.StatusInternalServerError)
+		return
+	}
+
+	if err := h.db.SetPassword(userID, req.Password); err != nil {
+		http.Error(w, "Failed to reset password", http.StatusInternalServerError)
+		return
+	}
+	// The link arrived, so the email is theirs
+	if err := h.db.MarkEmailVerified(userID); err != nil {
+		log.Printf("Failed to mark email of user %d verified: %v", userID, err)
+	}
+	if err := h.db.RevokeAllLogins(userID); err != nil {
+		log.Printf("Failed to end logins of user %d: %v", userID, err)
+	}
+	h.loggedOut(userID, "")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "password reset"})
+}
+
+// SendVerification emails the bearer token's user a new verification link
+func (h *AuthHandler) SendVerification(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, err := h.accountUser(r)
+	if err != nil || userID == 0 {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	user, err := h.db.GetUserByID(userID)
+	if err != nil {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+	if user.EmailVerified {
+		http.Error(w, "Email is already verified", http.StatusConflict)
+		return
+	}
+
+	go h.sendVerification(user)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "verification email sent"})
+}
+
+// VerifyEmail marks an email verified with a verification link's token
+func (h *AuthHandler) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req VerifyEmailRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	userID, err := h.db.UseUserToken(db.TokenVerifyEmail, hashToken(req.Token))
+	if errors.Is(err, db.ErrLinkInvalid) {
+		http.Error(w, "Verification link is invalid or has expired", http.StatusBadRequest)
+		return
+	}
+	if err == nil {
+		err = h.db.MarkEmailVerified(userID)
+	}
+	if err != nil {
+		http.Error(w, "Failed to verify email", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "email verified"})
+}
+
+func (h *AuthHandler) sendVerification(user *db.User) {
+	h.sendLink(user, db.TokenVerifyEmail, verifyTokenTTL, "verify-email.html",
+		"Verify your email",
+		"Welcome, %s!\n\nFollow this link to confirm this is your email address:\n\n%s\n")
+}
+
+// sendLink creates a single-use token and emails the user a link to page
+// carrying it. body is formatted with the username and the link. Errors are
+// logged, since callers do not wait for the email.
+func (h *AuthHandler) sendLink(user *db.User, purpose string, ttl time.Duration, page, subject, body string) {
+	token, err := randomToken(32)
+	if err != nil {
+		log.Printf("Failed to create %s link for user %d: %v", purpose, user.ID, err)
+		return
+	}
+	if err := h.db.CreateUserToken(user.ID, purpose, hashToken(token), ttl); err != nil {
+		log.Printf("Failed to create %s link for user %d: %v", purpose, user.ID, err)
+		return
+	}
+
+	// In the fragment the token is never sent to the frontend's server
+	link := h.frontendURL + "/" + page + "#" + url.Values{"token": {token}}.Encode()
+
+	ctx, cancel := context.WithTimeout(context.Background(), mailTimeout)
+	defer cancel()
+
+	err = h.mailer.Send(ctx, mail.Message{
+		To:      user.Email,
+		Subject: subject,
+		Body:    fmt.Sprintf(body, user.Username, link),
+	})
+	if err != nil {
+		log.Printf("Failed to email %s link to user %d: %v", purpose, user.ID, err)
+	}
+}
@@ -0,0 +1,189 @@
+package auth
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"collab-editor/internal/db"
+)
+
+// Kinds of attempts in the audit
+const (
+	attemptLogin    = "login"
+	attemptTOTP     = "2fa"
+	attemptRegister = "register"
+	attemptForgot   = "forgot"
+)
+
+// backoff makes each failure past the free ones double the wait before the
+// next try, and locks out entirely after lockAfter failures
+type backoff struct {
+	window    time.Duration
+	free      int
+	base      time.Duration
+	max       time.Duration
+	lockAfter int
+	lockFor   time.Duration
+}
+
+// quota allows a number of attempts per window, failed or not
+type quota struct {
+	window time.Duration
+	max    int
+}
+
+var (
+	usernameBackoff = backoff{
+		window:    time.Hour,
+		free:      3,
+		base:      time.Second,
+		max:       5 * time.Minute,
+		lockAfter: 10,
+		lockFor:   15 * time.Minute,
+	}
+	// Addresses get more slack, since many users can share one
+	ipBackoff = backoff{
+		window:    time.Hour,
+		free:      20,
+		base:      time.Second,
+		max:       5 * time.Minute,
+		lockAfter: 100,
+		lockFor:   time.Hour,
+	}
+	registerQuota = quota{window: time.Hour, max: 10}
+	forgotQuota   = quota{window: time.Hour, max: 5}
+)
+
+// wait returns how much longer to wait after the failures in a
+func (b backoff) wait(a *db.Attempts) time.Duration {
+	var d time.Duration
+	switch {
+	case a.Count >= b.lockAfter:
+		d = b.lockFor
+	case a.Count > b.free:
+		d = b.max
+		if shift := a.Count - b.free - 1; shift < 30 {
+			d = min(b.base<<shift, b.max)
+		}
+	default:
+		return 0
+	}
+	return max(d-a.SinceLatest, 0)
+}
+
+// wait returns how long until the oldest attempt in a leaves the window,
+// if the quota is used up
+func (q quota) wait(a *db.Attempts) time.Duration {
+	if a.Count < q.max {
+		return 0
+	}
+	return max(q.window-a.SinceOldest, time.Second)
+}
+
+// SetTrustProxyHeaders makes the client address come from X-Forwarded-For,
+// for when the server runs behind a load balancer
+func (h *AuthHandler) SetTrustProxyHeaders(trust bool) {
+	h.trustProxy = trust
+}
+
+// clientIP returns the address attempts are counted against
+func (h *AuthHandler) clientIP(r *http.Request) string {
+	if h.trustProxy {
+		// The proxy appends the address it saw, so the last entry is the
+		// one the client cannot forge
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			parts := strings.Split(forwarded, ",")
+			if ip := strings.TrimSpace(parts[len(parts)-1]); ip != "" {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// throttleFailures refuses with 429 when the username or the address has
+// failed kind too often recently, and with 503 when that cannot be checked.
+// Otherwise it records the attempt as failed, so it counts against
+// concurrent ones, and returns it for the caller to finish with the outcome.
+func (h *AuthHandler) throttleFailures(w http.ResponseWriter, kind, username, ip string) (int, bool) {
+	return h.reserveAttempt(w, kind, username, ip, func(c db.AttemptCounter) (time.Duration, error) {
+		var wait time.Duration
+		if username != "" {
+			a, err := c.FailuresByUsername(kind, username, usernameBackoff.window)
+			if err != nil {
+				return 0, err
+			}
+			wait = usernameBackoff.wait(a)
+		}
+
+		a, err := c.FailuresByIP(kind, ip, ipBackoff.window)
+		if err != nil {
+			return 0, err
+		}
+		return max(wait, ipBackoff.wait(a)), nil
+	})
+}
+
+// throttleQuota refuses with 429 when the address used up its quota of
+// kind, and with 503 when that cannot be checked. Otherwise it records the
+// attempt like throttleFailures.
+func (h *AuthHandler) throttleQuota(w http.ResponseWriter, kind, username, ip string, q quota) (int, bool) {
+	return h.reserveAttempt(w, kind, username, ip, func(c db.AttemptCounter) (time.Duration, error) {
+		a, err := c.AttemptsByIP(kind, ip, q.window)
+		if err != nil {
+			return 0, err
+		}
+		return q.wait(a), nil
+	})
+}
+
+// reserveAttempt refuses or records an attempt, as wait decides from the
+// recent attempts
+func (h *AuthHandler) reserveAttempt(w http.ResponseWriter, kind, username, ip string, wait func(db.AttemptCounter) (time.Duration, error)) (int, bool) {
+	attempt, d, err := h.db.ReserveAttempt(kind, username, ip, wait)
+	if err != nil {
+		log.Printf("Failed to check %s attempts for %q from %s: %v", kind, username, ip, err)
+		http.Error(w, "Service unavailable, try again later", http.StatusServiceUnavailable)
+		return 0, true
+	}
+	return attempt, h.tooMany(w, d)
+}
+
+func (h *AuthHandler) tooMany(w http.ResponseWriter, wait time.Duration) bool {
+	if wait <= 0 {
+		return false
+	}
+
+	seconds := int((wait + time.Second - 1) / time.Second)
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(w, fmt.Sprintf("Too many attempts, try again in %s", humanize(seconds)), http.StatusTooManyRequests)
+	return true
+}
+
+// finishAttempt records the outcome of an attempt. Failing to do so is
+// logged but does not fail the request.
+func (h *AuthHandler) finishAttempt(attempt int, success bool, reason string) {
+	if err := h.db.FinishAttempt(attempt, success, reason); err != nil {
+		log.Printf("Failed to record outcome of attempt %d: %v", attempt, err)
+	}
+}
+
+func humanize(seconds int) string {
+	switch {
+	case seconds < 2:
+		return "a second"
+	case seconds < 120:
+		return fmt.Sprintf("%d seconds", seconds)
+	default:
+		return fmt.Sprintf("%d minutes", (seconds+59)/60)
+	}
+}
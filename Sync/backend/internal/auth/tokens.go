@@ -0,0 +1,268 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"collab-editor/internal/db"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	accessTokenTTL  = 15 * time.Minute
+	refreshTokenTTL = 30 * 24 * time.Hour
+)
+
+// ErrTokenRevoked is returned for access tokens whose login was ended
+var ErrTokenRevoked = errors.New("token has been revoked")
+
+// Claims identify the user behind an access token and the login it was
+// issued for. Each sign-in is a separate login that can be ended on its own.
+// For API keys APIKeyID and Scopes are set as well.
+type Claims struct {
+	UserID   int
+	Username string
+	LoginID  string
+	APIKeyID int
+	Scopes   []string
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// SetLogoutHook sets fn to be called whenever logins end. An empty loginID
+// means every login of the user.
+func (h *AuthHandler) SetLogoutHook(fn func(userID int, loginID string)) {
+	h.onLogout = fn
+}
+
+// ParseToken checks the signature and expiry of an access token and that
+// its login has not been revoked. API keys are accepted as well.
+func (h *AuthHandler) ParseToken(tokenString string) (*Claims, error) {
+	if strings.HasPrefix(tokenString, apiKeyPrefix) {
+		return h.parseAPIKey(tokenString)
+	}
+
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		return h.jwtSecret, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid {
+		return nil, jwt.ErrTokenInvalidClaims
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil, jwt.ErrInvalidKey
+	}
+
+	userID, ok := claims["user_id"].(float64)
+	if !ok {
+		return nil, jwt.ErrInvalidKey
+	}
+	loginID, ok := claims["login"].(string)
+	if !ok || loginID == "" {
+		return nil, jwt.ErrInvalidKey
+	}
+	username, _ := claims["username"].(string)
+
+	active, err := h.db.LoginActive(int(userID), loginID)
+	if err != nil {
+		return nil, err
+	}
+	if !active {
+		return nil, ErrTokenRevoked
+	}
+
+	return &Claims{
+		UserID:   int(userID),
+		Username: username,
+		LoginID:  loginID,
+	}, nil
+}
+
+// startLogin begins a new login for user and issues its first tokens
+func (h *AuthHandler) startLogin(user *db.User) (*AuthResponse, error) {
+	loginID, err := randomToken(16)
+	if err != nil {
+		return nil, err
+	}
+	refresh, err := randomToken(32)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := h.db.CreateRefreshToken(user.ID, loginID, hashToken(refresh), refreshTokenTTL); err != nil {
+		return nil, err
+	}
+
+	return h.issue(user, loginID, refresh)
+}
+
+func (h *AuthHandler) issue(user *db.User, loginID, refresh string) (*AuthResponse, error) {
+	token, err := h.generateToken(user, loginID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AuthResponse{
+		Token:        token,
+		RefreshToken: refresh,
+		ExpiresIn:    int(accessTokenTTL / time.Second),
+		User:         user,
+	}, nil
+}
+
+// Refresh swaps a refresh token for a new access and refresh token. Every
+// refresh token works once; reusing one ends its login.
+func (h *AuthHandler) Refresh(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req RefreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	refresh, err := randomToken(32)
+	if err != nil {
+		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		return
+	}
+
+	userID, loginID, err := h.db.RotateRefreshToken(hashToken(req.RefreshToken), hashToken(refresh), refreshTokenTTL)
+	if errors.Is(err, db.ErrTokenReused) {
+		log.Printf("Refresh token of user %d reused, ending login %s", userID, loginID)
+		h.loggedOut(userID, loginID)
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+	if errors.Is(err, db.ErrTokenInvalid) {
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to refresh token", http.StatusInternalServerError)
+		return
+	}
+
+	user, err := h.db.GetUserByID(userID)
+	if err != nil {
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+
+	response, err := h.issue(user, loginID, refresh)
+	if err != nil {
+		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// Logout ends the login of the refresh token in the body or, failing that,
+// of the bearer token. Its websockets are disconnected.
+func (h *AuthHandler) Logout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req RefreshRequest
+	json.NewDecoder(r.Body).Decode(&req)
+
+	var userID int
+	var loginID string
+	if req.RefreshToken != "" {
+		id, login, err := h.db.RevokeRefreshToken(hashToken(req.RefreshToken))
+		if errors.Is(err, db.ErrTokenInvalid) {
+			http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to log out", http.StatusInternalServerError)
+			return
+		}
+		userID, loginID = id, login
+	} else {
+		claims, err := h.RequestClaims(r)
+		if err != nil || claims == nil || claims.APIKeyID != 0 {
+			http.Error(w, "Invalid token", http.StatusUnauthorized)
+			return
+		}
+		if err := h.db.RevokeLogin(claims.UserID, claims.LoginID); err != nil {
+			http.Error(w, "Failed to log out", http.StatusInternalServerError)
+			return
+		}
+		userID, loginID = claims.UserID, claims.LoginID
+	}
+
+	h.loggedOut(userID, loginID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "logged out"})
+}
+
+// LogoutAll ends every login of the bearer token's user, for when a token
+// may have been stolen
+func (h *AuthHandler) LogoutAll(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, err := h.accountUser(r)
+	if err != nil || userID == 0 {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	if err := h.db.RevokeAllLogins(userID); err != nil {
+		http.Error(w, "Failed to log out", http.StatusInternalServerError)
+		return
+	}
+	h.loggedOut(userID, "")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "logged out everywhere"})
+}
+
+func (h *AuthHandler) loggedOut(userID int, loginID string) {
+	if h.onLogout != nil {
+		h.onLogout(userID, loginID)
+	}
+}
+
+// randomToken returns n random bytes, URL-safe encoded
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashToken is how refresh tokens are stored, so a database leak does not
+// leak usable tokens
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
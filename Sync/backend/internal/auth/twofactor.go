@@ -0,0 +1,413 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"collab-editor/internal/db"
+	"collab-editor/internal/totp"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	// totpIssuer names us in authenticator apps
+	totpIssuer = "Collaborative Editor"
+	// challengeTTL is how long a user has to enter their second factor
+	// after the password was accepted
+	challengeTTL      = 5 * time.Minute
+	recoveryCodeCount = 10
+)
+
+// SecondFactorResponse is what Login returns instead of tokens when the
+// user has two-factor authentication. The challenge is exchanged together
+// with a code at /api/2fa/verify.
+type SecondFactorResponse struct {
+	SecondFactorRequired bool   `json:"second_factor_required"`
+	Challenge            string `json:"challenge"`
+}
+
+type TOTPSetupResponse struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+// TOTPCodeRequest carries a code from an authenticator app or a recovery
+// code, and for Verify the challenge from Login
+type TOTPCodeRequest struct {
+	Challenge string `json:"challenge,omitempty"`
+	Code      string `json:"code"`
+}
+
+type RecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+type TwoFactorStatus struct {
+	Enabled           bool `json:"enabled"`
+	RecoveryCodesLeft int  `json:"recovery_codes_left"`
+}
+
+// secondFactor reports whether user has to pass a second factor and, if
+// so, answers the login with a challenge
+func (h *AuthHandler) secondFactor(w http.ResponseWriter, user *db.User) (bool, error) {
+	challenge, err := h.challenge(user)
+	if err != nil || challenge == "" {
+		return false, err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(SecondFactorResponse{
+		SecondFactorRequired: true,
+		Challenge:            challenge,
+	})
+	return true, nil
+}
+
+// challenge returns the challenge a login of user has to answer with a
+// code, or an empty one if user has no second factor
+func (h *AuthHandler) challenge(user *db.User) (string, error) {
+	state, err := h.db.GetTOTP(user.ID)
+	if err != nil {
+		return "", err
+	}
+	if !state.Enabled {
+		return "", nil
+	}
+
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"challenge": user.ID,
+		"exp":       time.Now().Add(challengeTTL).Unix(),
+	}).SignedString(h.jwtSecret)
+}
+
+// VerifySecondFactor finishes a login that needed a second factor
+func (h *AuthHandler) VerifySecondFactor(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req TOTPCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Challenge == "" || req.Code == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	userID, err := h.parseChallenge(req.Challenge)
+	if err != nil {
+		http.Error(w, "Login expired, please log in again", http.StatusUnauthorized)
+		return
+	}
+
+	user, err := h.db.GetUserByID(userID)
+	if err != nil {
+		http.Error(w, "Login expired, please log in again", http.StatusUnauthorized)
+		return
+	}
+
+	// Six digits are quick to guess without a limit
+	ip := h.clientIP(r)
+	attempt, refused := h.throttleFailures(w, attemptTOTP, user.Username, ip)
+	if refused {
+		return
+	}
+
+	ok, err := h.checkCode(userID, req.Code)
+	if err != nil {
+		h.finishAttempt(attempt, false, "error")
+		http.Error(w, "Failed to verify code", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		h.finishAttempt(attempt, false, "invalid code")
+		http.Error(w, "Invalid code", http.StatusUnauthorized)
+		return
+	}
+	h.finishAttempt(attempt, true, "")
+
+	response, err := h.startLogin(user)
+	if err != nil {
+		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// TwoFactor reports whether the bearer token's user has two-factor
+// authentication and how many recovery codes they have left
+func (h *AuthHandler) TwoFactor(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, err := h.accountUser(r)
+	if err != nil || userID == 0 {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	state, err := h.db.GetTOTP(userID)
+	if err != nil {
+		http.Error(w, "Failed to get two-factor status", http.StatusInternalServerError)
+		return
+	}
+	status := TwoFactorStatus{Enabled: state.Enabled}
+	if state.Enabled {
+		if status.RecoveryCodesLeft, err = h.db.RecoveryCodesLeft(userID); err != nil {
+			http.Error(w, "Failed to get two-factor status", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// SetupTOTP creates a secret for the bearer token's user to add to their
+// authenticator app. It is not used until ConfirmTOTP sees a code from it.
+func (h *AuthHandler) SetupTOTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, err := h.accountUser(r)
+	if err != nil || userID == 0 {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+	user, err := h.db.GetUserByID(userID)
+	if err != nil {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		http.Error(w, "Failed to set up two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+	err = h.db.SetPendingTOTP(userID, secret)
+	if errors.Is(err, db.ErrTOTPEnabled) {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to set up two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(TOTPSetupResponse{
+		Secret: secret,
+		URI:    totp.URI(totpIssuer, user.Username, secret),
+	})
+}
+
+// ConfirmTOTP enables two-factor authentication once the user proves their
+// app has the secret, and returns their recovery codes. They are only
+// shown this once.
+func (h *AuthHandler) ConfirmTOTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, err := h.accountUser(r)
+	if err != nil || userID == 0 {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	var req TOTPCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	state, err := h.db.GetTOTP(userID)
+	if err != nil {
+		http.Error(w, "Failed to enable two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+	if state.Enabled {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+	if state.Secret == "" {
+		http.Error(w, "Set up two-factor authentication first", http.StatusBadRequest)
+		return
+	}
+
+	step, ok := totp.Validate(state.Secret, req.Code, time.Now())
+	if !ok {
+		http.Error(w, "Invalid code", http.StatusBadRequest)
+		return
+	}
+
+	codes, hashes, err := recoveryCodes()
+	if err != nil {
+		http.Error(w, "Failed to enable two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+	err = h.db.EnableTOTP(userID, step, hashes)
+	if errors.Is(err, db.ErrTOTPEnabled) {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to enable two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(RecoveryCodesResponse{RecoveryCodes: codes})
+}
+
+// DisableTOTP turns two-factor authentication off. It takes a current code
+// so a stolen access token alone cannot weaken the account.
+func (h *AuthHandler) DisableTOTP(w http.ResponseWriter, r *http.Request) {
+	userID, ok := h.requireCode(w, r)
+	if !ok {
+		return
+	}
+
+	if err := h.db.DisableTOTP(userID); err != nil {
+		http.Error(w, "Failed to disable two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "two-factor authentication disabled"})
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes, e.g. when they run
+// out. Like DisableTOTP it takes a current code.
+func (h *AuthHandler) RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	userID, ok := h.requireCode(w, r)
+	if !ok {
+		return
+	}
+
+	codes, hashes, err := recoveryCodes()
+	if err == nil {
+		err = h.db.ReplaceRecoveryCodes(userID, hashes)
+	}
+	if err != nil {
+		http.Error(w, "Failed to create recovery codes", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(RecoveryCodesResponse{RecoveryCodes: codes})
+}
+
+// requireCode authenticates a POST by bearer token plus a second factor
+// code in the body and writes the error response if either is missing
+func (h *AuthHandler) requireCode(w http.ResponseWriter, r *http.Request) (int, bool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return 0, false
+	}
+
+	userID, err := h.accountUser(r)
+	if err != nil || userID == 0 {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return 0, false
+	}
+
+	var req TOTPCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return 0, false
+	}
+
+	state, err := h.db.GetTOTP(userID)
+	if err != nil {
+		http.Error(w, "Failed to verify code", http.StatusInternalServerError)
+		return 0, false
+	}
+	if !state.Enabled {
+		http.Error(w, "Two-factor authentication is not enabled", http.StatusBadRequest)
+		return 0, false
+	}
+
+	ok, err := h.checkCode(userID, req.Code)
+	if err != nil {
+		http.Error(w, "Failed to verify code", http.StatusInternalServerError)
+		return 0, false
+	}
+	if !ok {
+		http.Error(w, "Invalid code", http.StatusUnauthorized)
+		return 0, false
+	}
+	return userID, true
+}
+
+// checkCode accepts a current code from the user's authenticator app that
+// was not used before, or an unused recovery code
+func (h *AuthHandler) checkCode(userID int, code string) (bool, error) {
+	state, err := h.db.GetTOTP(userID)
+	if err != nil {
+		return false, err
+	}
+	if !state.Enabled {
+		return false, nil
+	}
+
+	if step, ok := totp.Validate(state.Secret, code, time.Now()); ok {
+		return h.db.UseTOTPStep(userID, step)
+	}
+	return h.db.UseRecoveryCode(userID, hashToken(normalizeRecoveryCode(code)))
+}
+
+func (h *AuthHandler) parseChallenge(challenge string) (int, error) {
+	token, err := jwt.Parse(challenge, func(token *jwt.Token) (interface{}, error) {
+		return h.jwtSecret, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithExpirationRequired())
+	if err != nil {
+		return 0, err
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return 0, jwt.ErrTokenInvalidClaims
+	}
+
+	userID, ok := claims["challenge"].(float64)
+	if !ok {
+		return 0, jwt.ErrInvalidKey
+	}
+	return int(userID), nil
+}
+
+// recoveryCodes returns new recovery codes, formatted for the user, and
+// the hashes to store
+func recoveryCodes() ([]string, []string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		code := base32.StdEncoding.EncodeToString(b)
+		codes[i] = code[:4] + "-" + code[4:]
+		hashes[i] = hashToken(code)
+	}
+	return codes, hashes, nil
+}
+
+// normalizeRecoveryCode undoes the formatting users may or may not type
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToUpper(code)
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
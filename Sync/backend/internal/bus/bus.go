@@ -0,0 +1,99 @@
+package bus
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+
+	"collab-editor/internal/message"
+)
+
+// Event kinds exchanged between nodes
+const (
+	// KindBroadcast relays a message to the clients of every node
+	KindBroadcast = "broadcast"
+	// KindEdit forwards a client edit to the node that owns the session
+	KindEdit = "edit"
+	// KindApplied announces an edit the owner accepted. Target is the
+	// client that sent it, so its node can ack instead of forwarding.
+	KindApplied = "applied"
+	// KindRejected tells the node of Target that the owner refused its edit
+	KindRejected = "rejected"
+	// KindSyncRequest asks the owner for a full copy of the document
+	KindSyncRequest = "sync-request"
+	// KindSync carries the full document from the owner
+	KindSync = "sync"
+	// KindRole tells every node that the role of database user Author
+	// changed. The new role is in the message; an empty one means revoked.
+	KindRole = "role"
+	// KindLogout tells every node that logins of database user Author
+	// ended. The message content is the login, empty for all of them.
+	// Session is empty since the event concerns every session.
+	KindLogout = "logout"
+	// KindDeleted tells every node that the session was deleted and must
+	// be dropped without saving
+	KindDeleted = "deleted"
+	// KindUnpublished tells every node that the publication Target was
+	// deleted, so its live followers must be dropped
+	KindUnpublished = "unpublished"
+)
+
+// Event is what travels between backend instances. Node is the instance that
+// published it; instances never receive their own events. Author is the
+// database user a role change or logout is about. Authors are the database
+// users credited with an edit, such as the authors of accepted suggestions.
+type Event struct {
+	Node    string          `json:"node"`
+	Session string          `json:"session"`
+	Kind    string          `json:"kind"`
+	Target  string          `json:"target,omitempty"`
+	Author  int             `json:"author,omitempty"`
+	Authors []int           `json:"authors,omitempty"`
+	Message message.Message `json:"message"`
+}
+
+// Bus fans events out to every other backend instance and decides which
+// instance owns a session. Only the owner applies edits and persists them.
+type Bus interface {
+	// NodeID identifies this instance
+	NodeID() string
+	// Publish sends ev to every other instance
+	Publish(ev Event) error
+	// Subscribe registers fn to be called for every event from other instances
+	Subscribe(fn func(Event))
+	// Acquire tries to make this instance the owner of a session and
+	// reports whether it is the owner afterwards
+	Acquire(sessionCode string) (bool, error)
+	// Release gives up ownership of a session
+	Release(sessionCode string) error
+	Close() error
+}
+
+// NewNodeID returns an identifier for this instance based on the hostname,
+// with a random suffix so restarted containers never reuse an old id.
+func NewNodeID() string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "node"
+	}
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return host + "-" + hex.EncodeToString(suffix)
+}
+
+// Local is the bus for a single instance: there is nobody to talk to and it
+// owns every session.
+type Local struct {
+	nodeID string
+}
+
+func NewLocal() *Local {
+	return &Local{nodeID: NewNodeID()}
+}
+
+func (l *Local) NodeID() string                           { return l.nodeID }
+func (l *Local) Publish(ev Event) error                   { return nil }
+func (l *Local) Subscribe(fn func(Event))                 {}
+func (l *Local) Acquire(sessionCode string) (bool, error) { return true, nil }
+func (l *Local) Release(sessionCode string) error         { return nil }
+func (l *Local) Close() error                             { return nil }
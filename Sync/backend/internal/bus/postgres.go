@@ -0,0 +1,224 @@
+package bus
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	channel = "collab_hub"
+	// NOTIFY payloads are limited to 8000 bytes. Bigger events are stored
+	// in hub_events and only their id is sent, prefixed with '@'.
+	maxPayload = 7000
+	// Stored events only need to live until every listener has read them
+	eventRetention = time.Minute
+)
+
+// Postgres fans events out with LISTEN/NOTIFY and elects session owners
+// with advisory locks, which PostgreSQL drops automatically when the owning
+// instance's connection goes away.
+type Postgres struct {
+	nodeID   string
+	db       *sql.DB
+	listener *pq.Listener
+
+	lockMutex sync.Mutex
+	lockConn  *sql.Conn
+	owned     map[int64]string // Session code each held lock was taken for
+
+	handlerMutex sync.RWMutex
+	handlers     []func(Event)
+}
+
+func NewPostgres(connString string) (*Postgres, error) {
+	conn, err := sql.Open("postgres", connString)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open bus database: %w", err)
+	}
+	if err := conn.Ping(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to ping bus database: %w", err)
+	}
+
+	listener := pq.NewListener(connString, 10*time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("Bus listener error: %v", err)
+		}
+	})
+	if err := listener.Listen(channel); err != nil {
+		listener.Close()
+		conn.Close()
+		return nil, fmt.Errorf("failed to listen on %s: %w", channel, err)
+	}
+
+	p := &Postgres{
+		nodeID:   NewNodeID(),
+		db:       conn,
+		listener: listener,
+		owned:    make(map[int64]string),
+	}
+	go p.listen()
+
+	log.Printf("Bus connected as node %s", p.nodeID)
+	return p, nil
+}
+
+func (p *Postgres) NodeID() string {
+	return p.nodeID
+}
+
+func (p *Postgres) Publish(ev Event) error {
+	ev.Node = p.nodeID
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+
+	payload := string(data)
+	if len(payload) > maxPayload {
+		var id int64
+		err := p.db.QueryRow(`
+            INSERT INTO hub_events (payload) VALUES ($1) RETURNING id
+        `, payload).Scan(&id)
+		if err != nil {
+			return fmt.Errorf("failed to store bus event: %w", err)
+		}
+		payload = "@" + strconv.FormatInt(id, 10)
+
+		// Opportunistically drop events every listener has had time to read
+		p.db.Exec(`DELETE FROM hub_events WHERE created_at < $1`, time.Now().Add(-eventRetention))
+	}
+
+	_, err = p.db.Exec(`SELECT pg_notify($1, $2)`, channel, payload)
+	return err
+}
+
+func (p *Postgres) Subscribe(fn func(Event)) {
+	p.handlerMutex.Lock()
+	defer p.handlerMutex.Unlock()
+	p.handlers = append(p.handlers, fn)
+}
+
+func (p *Postgres) listen() {
+	for n := range p.listener.Notify {
+		// A nil notification means the listener reconnected and may
+		// have missed events; sessions catch up through sync requests
+		if n == nil {
+			continue
+		}
+
+		payload := n.Extra
+		if strings.HasPrefix(payload, "@") {
+			if err := p.db.QueryRow(`
+                SELECT payload FROM hub_events WHERE id = $1
+            `, strings.TrimPrefix(payload, "@")).Scan(&payload); err != nil {
+				log.Printf("Failed to load bus event %s: %v", n.Extra, err)
+				continue
+			}
+		}
+
+		var ev Event
+		if err := json.Unmarshal([]byte(payload), &ev); err != nil {
+			log.Printf("Failed to decode bus event: %v", err)
+			continue
+		}
+		if ev.Node == p.nodeID {
+			continue
+		}
+
+		p.handlerMutex.RLock()
+		for _, fn := range p.handlers {
+			fn(ev)
+		}
+		p.handlerMutex.RUnlock()
+	}
+}
+
+// lockKey maps a session code to the advisory lock that guards it. The 64
+// bit hash makes collisions between codes unlikely; Acquire still checks
+// for them among the locks it holds.
+func lockKey(sessionCode string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte("collab-session:" + sessionCode))
+	return int64(h.Sum64())
+}
+
+func (p *Postgres) Acquire(sessionCode string) (bool, error) {
+	p.lockMutex.Lock()
+	defer p.lockMutex.Unlock()
+
+	ctx := context.Background()
+
+	// Advisory locks live on one connection. If it died, every lock it held
+	// is gone and ownership has to be won again.
+	if p.lockConn != nil && p.lockConn.PingContext(ctx) != nil {
+		log.Printf("Bus lock connection lost, dropping ownership of %d sessions", len(p.owned))
+		p.lockConn.Close()
+		p.lockConn = nil
+		p.owned = make(map[int64]string)
+	}
+	key := lockKey(sessionCode)
+	if code, ok := p.owned[key]; ok {
+		// Advisory locks are reentrant on one connection, so a session whose
+		// code hashes alike must not be handed the lock too
+		return code == sessionCode, nil
+	}
+	if p.lockConn == nil {
+		conn, err := p.db.Conn(ctx)
+		if err != nil {
+			return false, err
+		}
+		p.lockConn = conn
+	}
+
+	var acquired bool
+	err := p.lockConn.QueryRowContext(ctx, `
+        SELECT pg_try_advisory_lock($1::bigint)
+    `, key).Scan(&acquired)
+	if err != nil {
+		return false, err
+	}
+
+	if acquired {
+		p.owned[key] = sessionCode
+	}
+	return acquired, nil
+}
+
+func (p *Postgres) Release(sessionCode string) error {
+	p.lockMutex.Lock()
+	defer p.lockMutex.Unlock()
+
+	key := lockKey(sessionCode)
+	if p.owned[key] != sessionCode || p.lockConn == nil {
+		return nil
+	}
+	delete(p.owned, key)
+
+	_, err := p.lockConn.ExecContext(context.Background(), `
+        SELECT pg_advisory_unlock($1::bigint)
+    `, key)
+	return err
+}
+
+func (p *Postgres) Close() error {
+	p.lockMutex.Lock()
+	if p.lockConn != nil {
+		p.lockConn.Close()
+		p.lockConn = nil
+	}
+	p.lockMutex.Unlock()
+
+	p.listener.Close()
+	return p.db.Close()
+}
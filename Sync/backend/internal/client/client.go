@@ -3,8 +3,10 @@ package client
 import (
 	"encoding/json"
 	"log"
+	"sync"
 	"time"
 
+	"collab-editor/internal/access"
 	"collab-editor/internal/message"
 
 	"github.com/gorilla/websocket"
@@ -19,15 +21,28 @@ const (
 type Session interface {
 	Register(client *Client)
 	Unregister(client *Client)
-	Broadcast(msg message.Message)
+	Submit(client *Client, msg message.Message)
 }
 
 type Client struct {
-	session Session
-	conn    *websocket.Conn
-	Send    chan message.Message
-	UserID  string
-	Color   string
+	session   Session
+	conn      *websocket.Conn
+	Send      chan message.Message
+	UserID    string
+	Color     string
+	Name      string // Display name of the signed-in user, empty for guests
+	AvatarURL string
+	DBUserID  int    // Database user ID, zero for guests
+	LoginID   string // Login of the token the client connected with
+	GuestPass string // Pass a guest reconnects with after redeeming an invite
+	TabToken  string // Token a guest reconnects with to keep its UserID
+	done      chan struct{}
+	closeCode int
+	closeText string
+
+	roleMutex sync.RWMutex
+	role      access.Role
+	maxRole   access.Role
 }
 
 func New(session Session, conn *websocket.Conn, userID, color string) *Client {
@@ -37,9 +52,46 @@ func New(session Session, conn *websocket.Conn, userID, color string) *Client {
 		Send:    make(chan message.Message, 256),
 		UserID:  userID,
 		Color:   color,
+		done:    make(chan struct{}),
+		maxRole: access.Owner,
 	}
 }
 
+// SetCloseReason sets the close frame sent once Send is closed. It must be
+// called before closing Send.
+func (c *Client) SetCloseReason(code int, text string) {
+	c.closeCode = code
+	c.closeText = text
+}
+
+// SetRole changes what the client is allowed to do. It may be called while
+// the pumps are running.
+func (c *Client) SetRole(role access.Role) {
+	c.roleMutex.Lock()
+	defer c.roleMutex.Unlock()
+	c.role = role.Limit(c.maxRole)
+}
+
+// LimitRole caps the roles the client can be given, for credentials such as
+// API keys that only grant part of what their user may do
+func (c *Client) LimitRole(max access.Role) {
+	c.roleMutex.Lock()
+	defer c.roleMutex.Unlock()
+	c.maxRole = max
+	c.role = c.role.Limit(max)
+}
+
+func (c *Client) Role() access.Role {
+	c.roleMutex.RLock()
+	defer c.roleMutex.RUnlock()
+	return c.role
+}
+
+// Done is closed once the connection has been written to for the last time
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
 func (c *Client) ReadPump() {
 	defer func() {
 		c.session.Unregister(c)
@@ -66,9 +118,22 @@ func (c *Client) ReadPump() {
 			continue
 		}
 
+		// Viewers and commenters only get to watch the text change
+		if msg.IsEdit() && !c.Role().CanEdit() {
+			log.Printf("Dropping %s from %s: role %q cannot edit", msg.Type, c.UserID, c.Role())
+			continue
+		}
+
+		if (msg.IsComment() || msg.IsSuggestion() || msg.Type == "chat") && !c.Role().CanComment() {
+			log.Printf("Dropping %s from %s: role %q cannot comment", msg.Type, c.UserID, c.Role())
+			continue
+		}
+
 		msg.UserID = c.UserID
 		msg.Color = c.Color
-		c.session.Broadcast(msg)
+		msg.Name = c.Name
+		msg.AvatarURL = c.AvatarURL
+		c.session.Submit(c, msg)
 	}
 }
 
@@ -77,6 +142,7 @@ func (c *Client) WritePump() {
 	defer func() {
 		ticker.Stop()
 		c.conn.Close()
+		close(c.done)
 	}()
 
 	for {
@@ -84,7 +150,11 @@ func (c *Client) WritePump() {
 		case msg, ok := <-c.Send:
 			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if !ok {
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				closeMsg := []byte{}
+				if c.closeCode != 0 {
+					closeMsg = websocket.FormatCloseMessage(c.closeCode, c.closeText)
+				}
+				c.conn.WriteMessage(websocket.CloseMessage, closeMsg)
 				return
 			}
 
@@ -0,0 +1,331 @@
+package crdt
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"collab-editor/internal/ot"
+)
+
+const (
+	OpInsert = "insert"
+	OpDelete = "delete"
+)
+
+// maxPending bounds how many ops a document holds back while their
+// dependencies are missing, which a replica could otherwise grow forever
+const maxPending = 1000
+
+var (
+	ErrInvalidOp  = errors.New("invalid crdt operation")
+	ErrTooPending = errors.New("too many crdt operations waiting for their dependencies")
+)
+
+// ID identifies an element for its whole lifetime. Clock is a Lamport clock,
+// so an element always has a higher clock than the element it was inserted
+// after. Site breaks ties between replicas that picked the same clock.
+type ID struct {
+	Site  string `json:"site"`
+	Clock int    `json:"clock"`
+}
+
+// IsZero reports whether id refers to the start of the document.
+func (id ID) IsZero() bool {
+	return id.Site == "" && id.Clock == 0
+}
+
+func (id ID) less(other ID) bool {
+	if id.Clock != other.Clock {
+		return id.Clock < other.Clock
+	}
+	return id.Site < other.Site
+}
+
+// Op is a single replicated change. Inserts place Value right after the
+// element After (zero for the start of the document); deletes tombstone the
+// element ID.
+type Op struct {
+	Kind  string `json:"kind"`
+	ID    ID     `json:"id"`
+	After ID     `json:"after"`
+	Value string `json:"value,omitempty"`
+}
+
+type element struct {
+	id      ID
+	after   ID
+	value   string
+	deleted bool
+}
+
+// Document is a replicated growable array (RGA). Applying the same set of ops
+// in any order, any number of times, yields the same text, which lets clients
+// keep editing offline and merge their ops when they reconnect.
+type Document struct {
+	elements []element
+	index    map[ID]int
+	pending  []Op
+	clock    int
+	applied  int
+}
+
+func NewDocument() *Document {
+	return &Document{index: make(map[ID]int)}
+}
+
+// FromText seeds a document with text attributed to site, one element per
+// character. It is used when a session has content but no stored state.
+func FromText(site, text string) *Document {
+	d := NewDocument()
+	var after ID
+	for _, r := range text {
+		id := ID{Site: site, Clock: d.clock + 1}
+		d.Apply(Op{Kind: OpInsert, ID: id, After: after, Value: string(r)})
+		after = id
+	}
+	return d
+}
+
+// Content returns the visible text.
+func (d *Document) Content() string {
+	var b strings.Builder
+	for _, e := range d.elements {
+		if !e.deleted {
+			b.WriteString(e.value)
+		}
+	}
+	return b.String()
+}
+
+// Applied returns how many ops have been integrated so far.
+func (d *Document) Applied() int {
+	return d.applied
+}
+
+// Clock returns the highest Lamport clock seen by this replica.
+func (d *Document) Clock() int {
+	return d.clock
+}
+
+// Apply integrates op. Ops whose dependencies have not arrived yet are held
+// back and retried after every successful integration, up to maxPending of
+// them, and ops that were already applied are ignored.
+func (d *Document) Apply(op Op) error {
+	if err := op.Validate(); err != nil {
+		return err
+	}
+
+	if !d.integrate(op) {
+		if len(d.pending) >= maxPending {
+			return ErrTooPending
+		}
+		d.pending = append(d.pending, op)
+		return nil
+	}
+
+	for progress := true; progress; {
+		progress = false
+		remaining := d.pending[:0]
+		for _, p := range d.pending {
+			if d.integrate(p) {
+				progress = true
+			} else {
+				remaining = append(remaining, p)
+			}
+		}
+		d.pending = remaining
+	}
+	return nil
+}
+
+// Validate checks that op is well formed without applying it. Inserts must
+// have a higher clock than the element they follow, which integrate relies
+// on to order concurrent inserts.
+func (op Op) Validate() error {
+	if op.ID.IsZero() || op.ID.Clock < 0 {
+		return ErrInvalidOp
+	}
+	switch op.Kind {
+	case OpInsert:
+		if op.Value == "" || op.ID.Clock <= op.After.Clock {
+			return ErrInvalidOp
+		}
+	case OpDelete:
+	default:
+		return ErrInvalidOp
+	}
+	return nil
+}
+
+// integrate applies op if everything it depends on is present and reports
+// whether it could be handled.
+func (d *Document) integrate(op Op) bool {
+	switch op.Kind {
+	case OpDelete:
+		i, ok := d.index[op.ID]
+		if !ok {
+			return false
+		}
+		if !d.elements[i].deleted {
+			d.elements[i].deleted = true
+			d.applied++
+		}
+		return true
+
+	case OpInsert:
+		if _, exists := d.index[op.ID]; exists {
+			return true
+		}
+
+		pos := 0
+		if !op.After.IsZero() {
+			i, ok := d.index[op.After]
+			if !ok {
+				return false
+			}
+			pos = i + 1
+		}
+
+		// Skip over concurrent inserts at the same spot that win the tie,
+		// along with everything inserted after them
+		for pos < len(d.elements) && op.ID.less(d.elements[pos].id) {
+			pos++
+		}
+
+		d.elements = append(d.elements, element{})
+		copy(d.elements[pos+1:], d.elements[pos:])
+		d.elements[pos] = element{id: op.ID, after: op.After, value: op.Value}
+		for i := pos; i < len(d.elements); i++ {
+			d.index[d.elements[i].id] = i
+		}
+
+		if op.ID.Clock > d.clock {
+			d.clock = op.ID.Clock
+		}
+		d.applied++
+		return true
+	}
+	return false
+}
+
+// Diff returns the ops that turn the visible text into text, attributed to
+// site. The ops are not applied. Only the changed middle part is replaced
+// so elements in the common prefix and suffix keep their identity.
+func (d *Document) Diff(site, text string) []Op {
+	var visible []element
+	for _, e := range d.elements {
+		if !e.deleted {
+			visible = append(visible, e)
+		}
+	}
+	target := []rune(text)
+
+	start := 0
+	for start < len(visible) && start < len(target) && visible[start].value == string(target[start]) {
+		start++
+	}
+	endOld, endNew := len(visible), len(target)
+	for endOld > start && endNew > start && visible[endOld-1].value == string(target[endNew-1]) {
+		endOld--
+		endNew--
+	}
+
+	var ops []Op
+	for _, e := range visible[start:endOld] {
+		ops = append(ops, Op{Kind: OpDelete, ID: e.id})
+	}
+
+	var after ID
+	if start > 0 {
+		after = visible[start-1].id
+	}
+	clock := d.clock
+	for _, r := range target[start:endNew] {
+		clock++
+		id := ID{Site: site, Clock: clock}
+		ops = append(ops, Op{Kind: OpInsert, ID: id, After: after, Value: string(r)})
+		after = id
+	}
+	return ops
+}
+
+// FromOperation returns the ops that carry out op, an edit of the visible
+// text counted in UTF-16 code units, attributed to site. The ops are not
+// applied. Unlike Diff, untouched text between the changes keeps its
+// identity too.
+func (d *Document) FromOperation(site string, op ot.Operation) ([]Op, error) {
+	var visible []element
+	length := 0
+	for _, e := range d.elements {
+		if !e.deleted {
+			visible = append(visible, e)
+			length += ot.Length(e.value)
+		}
+	}
+	if length != op.BaseLength {
+		return nil, ot.ErrBaseLength
+	}
+
+	var ops []Op
+	var after ID
+	clock := d.clock
+	i := 0
+	for _, c := range op.Components {
+		switch {
+		case c.Retain > 0:
+			for n := c.Retain; n > 0 && i < len(visible); i++ {
+				after = visible[i].id
+				n -= ot.Length(visible[i].value)
+			}
+		case c.Delete > 0:
+			for n := c.Delete; n > 0 && i < len(visible); i++ {
+				ops = append(ops, Op{Kind: OpDelete, ID: visible[i].id})
+				n -= ot.Length(visible[i].value)
+			}
+		case c.Insert != "":
+			for _, r := range c.Insert {
+				clock++
+				id := ID{Site: site, Clock: clock}
+				ops = append(ops, Op{Kind: OpInsert, ID: id, After: after, Value: string(r)})
+				after = id
+			}
+		}
+	}
+	return ops, nil
+}
+
+// Ops returns the ops needed to rebuild the document from scratch, including
+// tombstones so late or offline replicas can still resolve their references.
+func (d *Document) Ops() []Op {
+	ops := make([]Op, 0, len(d.elements)+len(d.pending))
+	var deletes []Op
+	for _, e := range d.elements {
+		ops = append(ops, Op{Kind: OpInsert, ID: e.id, After: e.after, Value: e.value})
+		if e.deleted {
+			deletes = append(deletes, Op{Kind: OpDelete, ID: e.id})
+		}
+	}
+	ops = append(ops, deletes...)
+	return append(ops, d.pending...)
+}
+
+// MarshalJSON stores the document as its list of ops.
+func (d *Document) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.Ops())
+}
+
+func (d *Document) UnmarshalJSON(data []byte) error {
+	var ops []Op
+	if err := json.Unmarshal(data, &ops); err != nil {
+		return err
+	}
+
+	*d = *NewDocument()
+	for _, op := range ops {
+		if err := d.Apply(op); err != nil {
+			return err
+		}
+	}
+	return nil
+}
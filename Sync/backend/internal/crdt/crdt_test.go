@@ -0,0 +1,236 @@
+package crdt
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"collab-editor/internal/ot"
+)
+
+func insert(site string, clock int, after ID, value string) Op {
+	return Op{Kind: OpInsert, ID: ID{Site: site, Clock: clock}, After: after, Value: value}
+}
+
+func remove(site string, clock int) Op {
+	return Op{Kind: OpDelete, ID: ID{Site: site, Clock: clock}}
+}
+
+func apply(t *testing.T, d *Document, ops ...Op) {
+	t.Helper()
+	for _, op := range ops {
+		if err := d.Apply(op); err != nil {
+			t.Fatalf("apply %+v: %v", op, err)
+		}
+	}
+}
+
+// permutations returns every order of ops
+func permutations(ops []Op) [][]Op {
+	if len(ops) <= 1 {
+		return [][]Op{ops}
+	}
+	var all [][]Op
+	for i := range ops {
+		rest := append(append([]Op(nil), ops[:i]...), ops[i+1:]...)
+		for _, p := range permutations(rest) {
+			all = append(all, append([]Op{ops[i]}, p...))
+		}
+	}
+	return all
+}
+
+func TestConvergesInAnyOrder(t *testing.T) {
+	a1 := ID{Site: "a", Clock: 1}
+	b2 := ID{Site: "b", Clock: 2}
+
+	tests := []struct {
+		name string
+		ops  []Op
+		want string
+	}{
+		// The higher clock goes first, then the higher site on a tie
+		{"concurrent inserts at the start", []Op{
+			insert("a", 1, ID{}, "x"),
+			insert("b", 1, ID{}, "y"),
+			insert("c", 2, ID{}, "z"),
+		}, "zyx"},
+		{"concurrent inserts after the same element", []Op{
+			insert("a", 1, ID{}, "h"),
+			insert("a", 2, a1, "1"),
+			insert("b", 2, a1, "2"),
+			insert("c", 2, a1, "3"),
+		}, "h321"},
+		{"concurrent runs stay together", []Op{
+			insert("a", 1, ID{}, "h"),
+			insert("b", 2, a1, "x"),
+			insert("b", 3, b2, "y"),
+			insert("c", 2, a1, "p"),
+			insert("c", 3, ID{Site: "c", Clock: 2}, "q"),
+		}, "hpqxy"},
+		{"delete before insert", []Op{
+			insert("a", 1, ID{}, "h"),
+			insert("b", 2, a1, "i"),
+			remove("b", 2),
+		}, "h"},
+		{"delete against concurrent insert after it", []Op{
+			insert("a", 1, ID{}, "h"),
+			remove("a", 1),
+			insert("b", 2, a1, "i"),
+		}, "i"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, order := range permutations(tt.ops) {
+				d := NewDocument()
+				apply(t, d, order...)
+				if got := d.Content(); got != tt.want {
+					t.Fatalf("order %+v gives %q, want %q", order, got, tt.want)
+				}
+				if len(d.pending) != 0 {
+					t.Fatalf("order %+v left %d ops pending", order, len(d.pending))
+				}
+			}
+		})
+	}
+}
+
+func TestOutOfOrderDelivery(t *testing.T) {
+	d := NewDocument()
+	h := insert("a", 1, ID{}, "h")
+	i := insert("a", 2, h.ID, "i")
+	bang := insert("a", 3, i.ID, "!")
+
+	apply(t, d, bang, i)
+	if d.Content() != "" || len(d.pending) != 2 || d.Applied() != 0 {
+		t.Fatalf("content %q with %d pending, want both held back", d.Content(), len(d.pending))
+	}
+	apply(t, d, h)
+	if d.Content() != "hi!" || len(d.pending) != 0 || d.Applied() != 3 {
+		t.Errorf("content %q with %d pending after the first insert arrived", d.Content(), len(d.pending))
+	}
+}
+
+func TestDeleteBeforeInsert(t *testing.T) {
+	d := NewDocument()
+	apply(t, d, remove("a", 1))
+	if len(d.pending) != 1 {
+		t.Fatalf("delete of a missing element was not held back")
+	}
+
+	apply(t, d, insert("a", 1, ID{}, "x"), insert("b", 2, ID{}, "y"))
+	if d.Content() != "y" {
+		t.Errorf("content %q, want the held back delete applied", d.Content())
+	}
+
+	// Ops are idempotent, replaying them changes nothing
+	apply(t, d, remove("a", 1), insert("a", 1, ID{}, "x"))
+	if d.Content() != "y" || d.Applied() != 3 {
+		t.Errorf("replay changed the document to %q after %d ops", d.Content(), d.Applied())
+	}
+}
+
+func TestValidate(t *testing.T) {
+	a3 := ID{Site: "a", Clock: 3}
+	tests := []struct {
+		name string
+		op   Op
+		ok   bool
+	}{
+		{"insert at start", insert("a", 1, ID{}, "x"), true},
+		{"insert after lower clock", insert("b", 4, a3, "x"), true},
+		{"insert with zero id", insert("", 0, ID{}, "x"), false},
+		{"insert with negative clock", insert("a", -1, ID{}, "x"), false},
+		{"insert at start with zero clock", insert("a", 0, ID{}, "x"), false},
+		{"insert after same clock", insert("b", 3, a3, "x"), false},
+		{"insert after higher clock", insert("b", 2, a3, "x"), false},
+		{"empty insert", insert("a", 1, ID{}, ""), false},
+		{"delete", remove("a", 3), true},
+		{"delete of start", remove("", 0), false},
+		{"unknown kind", Op{Kind: "move", ID: a3}, false},
+	}
+	for _, tt := range tests {
+		err := tt.op.Validate()
+		if tt.ok && err != nil {
+			t.Errorf("%s: rejected: %v", tt.name, err)
+		}
+		if !tt.ok && !errors.Is(err, ErrInvalidOp) {
+			t.Errorf("%s: err = %v, want ErrInvalidOp", tt.name, err)
+		}
+	}
+}
+
+func TestPendingLimit(t *testing.T) {
+	d := NewDocument()
+	missing := ID{Site: "gone", Clock: 1}
+	for i := 0; i < maxPending; i++ {
+		apply(t, d, insert("a", i+2, missing, "x"))
+	}
+	if err := d.Apply(insert("a", maxPending+2, missing, "x")); !errors.Is(err, ErrTooPending) {
+		t.Fatalf("err = %v, want ErrTooPending", err)
+	}
+
+	// Ops that can be integrated are still accepted
+	apply(t, d, insert("b", 1, ID{}, "y"))
+	if d.Content() != "y" {
+		t.Errorf("content %q, want \"y\"", d.Content())
+	}
+}
+
+func TestDiff(t *testing.T) {
+	tests := []struct{ from, to string }{
+		{"", "hello"},
+		{"hello", ""},
+		{"hello", "help"},
+		{"hello", "hello world"},
+		{"a😀b", "a👍b"},
+	}
+	for _, tt := range tests {
+		d := FromText("server", tt.from)
+		ops := d.Diff("client", tt.to)
+		apply(t, d, ops...)
+		if d.Content() != tt.to {
+			t.Errorf("diff from %q gives %q, want %q", tt.from, d.Content(), tt.to)
+		}
+	}
+}
+
+func TestFromOperation(t *testing.T) {
+	d := FromText("server", "a😀bc")
+	var op ot.Operation
+	// Lengths are UTF-16 code units, so the emoji takes two
+	op.Retain(3).Insert("X").Delete(1).Retain(1)
+
+	ops, err := d.FromOperation("client", op)
+	if err != nil {
+		t.Fatal(err)
+	}
+	apply(t, d, ops...)
+	if d.Content() != "a😀Xc" {
+		t.Errorf("content %q, want \"a😀Xc\"", d.Content())
+	}
+
+	var wrong ot.Operation
+	wrong.Retain(2)
+	if _, err := d.FromOperation("client", wrong); !errors.Is(err, ot.ErrBaseLength) {
+		t.Errorf("err = %v, want ErrBaseLength", err)
+	}
+}
+
+func TestJSON(t *testing.T) {
+	d := FromText("server", "hey")
+	apply(t, d, remove("server", 2), insert("b", 9, ID{Site: "gone", Clock: 8}, "z"))
+
+	data, err := json.Marshal(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var back Document
+	if err := json.Unmarshal(data, &back); err != nil {
+		t.Fatal(err)
+	}
+	if back.Content() != "hy" || len(back.pending) != 1 || back.Clock() != d.Clock() {
+		t.Errorf("restored %q with %d pending at clock %d", back.Content(), len(back.pending), back.Clock())
+	}
+}
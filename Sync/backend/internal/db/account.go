@@ -0,0 +1,170 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/lib/pq"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ErrUsernameTaken is returned when renaming a user to a name another user
+// has
+var ErrUsernameTaken = errors.New("username is already taken")
+
+// CheckPassword reports whether the user has a password at all, which
+// users from single sign-on may not, and whether password is it
+func (db *Database) CheckPassword(userID int, password string) (bool, bool, error) {
+	var passwordHash string
+	err := db.conn.QueryRow(`
+        SELECT password_hash FROM users WHERE id = $1
+    `, userID).Scan(&passwordHash)
+	if err != nil {
+		return false, false, err
+	}
+	if passwordHash == noPassword {
+		return false, false, nil
+	}
+	return true, bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(password)) == nil, nil
+}
+
+// HasPassword reports whether the user can sign in with a password
+func (db *Database) HasPassword(userID int) (bool, error) {
+	var has bool
+	err := db.conn.QueryRow(`
+        SELECT password_hash <> $2 FROM users WHERE id = $1
+    `, userID, noPassword).Scan(&has)
+	return has, err
+}
+
+// UpdateProfile changes a user's username, email, and the name and avatar
+// others see. A new email has to be verified again.
+func (db *Database) UpdateProfile(userID int, username, email, displayName, avatarURL string) (*User, error) {
+	var user User
+	err := db.conn.QueryRow(`
+        UPDATE users SET username = $2, email = $3,
+            email_verified = email_verified AND LOWER(email) = LOWER($3),
+            display_name = $4, avatar_url = $5
+        WHERE id = $1
+        RETURNING id, username, email, email_verified, display_name, avatar_url, created_at
+    `, userID, username, email, displayName, avatarURL).Scan(&user.ID, &user.Username, &user.Email, &user.EmailVerified, &user.DisplayName, &user.AvatarURL, &user.CreatedAt)
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		if pqErr.Constraint == "users_email_key" {
+			return nil, ErrEmailTaken
+		}
+		return nil, ErrUsernameTaken
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// RevokeOtherLogins ends every login of a user but keepLogin and returns
+// the ones it ended
+func (db *Database) RevokeOtherLogins(userID int, keepLogin string) ([]string, error) {
+	rows, err := db.conn.Query(`
+        UPDATE refresh_tokens SET revoked_at = CURRENT_TIMESTAMP
+        WHERE user_id = $1 AND login_id <> $2 AND revoked_at IS NULL
+        RETURNING login_id
+    `, userID, keepLogin)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	seen := make(map[string]bool)
+	var logins []string
+	for rows.Next() {
+		var login string
+		if err := rows.Scan(&login); err != nil {
+			return nil, err
+		}
+		if !seen[login] {
+			seen[login] = true
+			logins = append(logins, login)
+		}
+	}
+	return logins, rows.Err()
+}
+
+// OwnedSessions returns the codes of the sessions a user owns
+func (db *Database) OwnedSessions(userID int) ([]string, error) {
+	rows, err := db.conn.Query(`
+        SELECT session_code FROM editing_sessions WHERE owner_id = $1
+    `, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var codes []string
+	for rows.Next() {
+		var code string
+		if err := rows.Scan(&code); err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+	return codes, rows.Err()
+}
+
+// DeleteUser deletes a user and everything that is only theirs. The
+// sessions they own are given to transferTo or, if it is zero, deleted
+// along with their documents. It returns the codes of those sessions.
+func (db *Database) DeleteUser(userID, transferTo int) ([]string, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var rows *sql.Rows
+	if transferTo > 0 {
+		rows, err = tx.Query(`
+            UPDATE editing_sessions SET owner_id = $2
+            WHERE owner_id = $1
+            RETURNING session_code
+        `, userID, transferTo)
+	} else {
+		rows, err = tx.Query(`
+            DELETE FROM editing_sessions WHERE owner_id = $1
+            RETURNING session_code
+        `, userID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var codes []string
+	for rows.Next() {
+		var code string
+		if err := rows.Scan(&code); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Owners are members with the owner role, as ClaimSession makes them
+	if transferTo > 0 {
+		if _, err := tx.Exec(`
+            INSERT INTO session_members (session_id, user_id, role)
+            SELECT id, $1, 'owner' FROM editing_sessions WHERE owner_id = $1
+            ON CONFLICT (session_id, user_id)
+            DO UPDATE SET role = 'owner', granted_at = CURRENT_TIMESTAMP
+        `, transferTo); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := tx.Exec(`DELETE FROM users WHERE id = $1`, userID); err != nil {
+		return nil, err
+	}
+	return codes, tx.Commit()
+}
@@ -0,0 +1,122 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// ErrAPIKeyInvalid is returned for API keys that are unknown, expired or
+// revoked
+var ErrAPIKeyInvalid = errors.New("API key is invalid")
+
+// APIKey is a personal key a user created for scripted access. The key
+// itself is only known when it is created.
+type APIKey struct {
+	ID         int        `json:"id"`
+	UserID     int        `json:"-"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// CreateAPIKey stores a new key. A zero ttl never expires.
+func (db *Database) CreateAPIKey(userID int, name, prefix, keyHash string, scopes []string, ttl time.Duration) (*APIKey, error) {
+	var expires interface{}
+	if ttl > 0 {
+		expires = int64(ttl / time.Second)
+	}
+
+	key := APIKey{UserID: userID, Name: name, Prefix: prefix, Scopes: scopes}
+	var expiresAt sql.NullTime
+	err := db.conn.QueryRow(`
+        INSERT INTO api_keys (user_id, name, prefix, key_hash, scopes, expires_at)
+        VALUES ($1, $2, $3, $4, $5, CURRENT_TIMESTAMP + $6 * INTERVAL '1 second')
+        RETURNING id, expires_at, created_at
+    `, userID, name, prefix, keyHash, pq.Array(scopes), expires).Scan(&key.ID, &expiresAt, &key.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if expiresAt.Valid {
+		key.ExpiresAt = &expiresAt.Time
+	}
+	return &key, nil
+}
+
+// ListAPIKeys returns a user's usable keys, newest first
+func (db *Database) ListAPIKeys(userID int) ([]APIKey, error) {
+	rows, err := db.conn.Query(`
+        SELECT id, name, prefix, scopes, expires_at, last_used_at, created_at
+        FROM api_keys
+        WHERE user_id = $1 AND revoked_at IS NULL
+          AND (expires_at IS NULL OR expires_at > CURRENT_TIMESTAMP)
+        ORDER BY created_at DESC
+    `, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		key := APIKey{UserID: userID}
+		var expiresAt, lastUsedAt sql.NullTime
+		if err := rows.Scan(&key.ID, &key.Name, &key.Prefix, pq.Array(&key.Scopes), &expiresAt, &lastUsedAt, &key.CreatedAt); err != nil {
+			return nil, err
+		}
+		if expiresAt.Valid {
+			key.ExpiresAt = &expiresAt.Time
+		}
+		if lastUsedAt.Valid {
+			key.LastUsedAt = &lastUsedAt.Time
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// UseAPIKey looks up a usable key by its hash and records that it was used.
+// The last use is only written once a minute to spare busy scripts a write
+// per request.
+func (db *Database) UseAPIKey(keyHash string) (*APIKey, error) {
+	var key APIKey
+	err := db.conn.QueryRow(`
+        SELECT id, user_id, name, prefix, scopes, created_at
+        FROM api_keys
+        WHERE key_hash = $1 AND revoked_at IS NULL
+          AND (expires_at IS NULL OR expires_at > CURRENT_TIMESTAMP)
+    `, keyHash).Scan(&key.ID, &key.UserID, &key.Name, &key.Prefix, pq.Array(&key.Scopes), &key.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrAPIKeyInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := db.conn.Exec(`
+        UPDATE api_keys SET last_used_at = CURRENT_TIMESTAMP
+        WHERE id = $1 AND (last_used_at IS NULL OR last_used_at < CURRENT_TIMESTAMP - INTERVAL '1 minute')
+    `, key.ID); err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+// RevokeAPIKey stops one of a user's keys from working and reports whether
+// there was such a key
+func (db *Database) RevokeAPIKey(userID, keyID int) (bool, error) {
+	result, err := db.conn.Exec(`
+        UPDATE api_keys SET revoked_at = CURRENT_TIMESTAMP
+        WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL
+    `, keyID, userID)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
@@ -0,0 +1,129 @@
+package db
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Attempts summarizes recent attempts: how many there were and how long
+// ago the latest and the earliest of them happened
+type Attempts struct {
+	Count       int
+	SinceLatest time.Duration
+	SinceOldest time.Duration
+}
+
+// AttemptCounter counts recent attempts within the transaction of
+// ReserveAttempt
+type AttemptCounter struct {
+	tx *sql.Tx
+}
+
+// attemptLockClass keeps the locks of ReserveAttempt apart from other
+// advisory locks
+const attemptLockClass = 17
+
+// ReserveAttempt checks and records an attempt of kind in one transaction.
+// It locks the address and the username first, so concurrent attempts are
+// checked one after another and each counts the ones before it. wait
+// decides from the counts how long the caller has to wait; if that is
+// positive nothing is recorded. Otherwise the attempt is recorded as failed
+// until FinishAttempt sets its outcome, and its ID is returned.
+func (db *Database) ReserveAttempt(kind, username, ip string, wait func(AttemptCounter) (time.Duration, error)) (int, time.Duration, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	// Always in the same order, so two attempts cannot wait on each other
+	keys := []string{kind + "/ip/" + ip}
+	if username != "" {
+		keys = append(keys, kind+"/user/"+username)
+	}
+	for _, key := range keys {
+		if _, err := tx.Exec(`SELECT pg_advisory_xact_lock($1, hashtext($2))`, attemptLockClass, key); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	d, err := wait(AttemptCounter{tx: tx})
+	if err != nil || d > 0 {
+		return 0, d, err
+	}
+
+	var id int
+	err = tx.QueryRow(`
+        INSERT INTO auth_attempts (kind, username, ip, success, reason)
+        VALUES ($1, NULLIF($2, ''), $3, FALSE, 'pending')
+        RETURNING id
+    `, kind, username, ip).Scan(&id)
+	if err != nil {
+		return 0, 0, err
+	}
+	return id, 0, tx.Commit()
+}
+
+// FinishAttempt records the outcome of an attempt reserved with
+// ReserveAttempt
+func (db *Database) FinishAttempt(id int, success bool, reason string) error {
+	_, err := db.conn.Exec(`
+        UPDATE auth_attempts SET success = $2, reason = NULLIF($3, '')
+        WHERE id = $1
+    `, id, success, reason)
+	return err
+}
+
+// FailuresByUsername counts failed attempts of kind for a username within
+// window, since its last successful one
+func (c AttemptCounter) FailuresByUsername(kind, username string, window time.Duration) (*Attempts, error) {
+	return c.attempts(`
+        SELECT COUNT(*),
+               EXTRACT(EPOCH FROM CURRENT_TIMESTAMP - MAX(created_at)),
+               EXTRACT(EPOCH FROM CURRENT_TIMESTAMP - MIN(created_at))
+        FROM auth_attempts
+        WHERE kind = $1 AND username = $2 AND NOT success
+          AND created_at > CURRENT_TIMESTAMP - $3 * INTERVAL '1 second'
+          AND created_at > COALESCE((
+              SELECT MAX(created_at) FROM auth_attempts
+              WHERE kind = $1 AND username = $2 AND success
+          ), '-infinity')
+    `, kind, username, int64(window/time.Second))
+}
+
+// FailuresByIP counts failed attempts of kind from an address within
+// window. Unlike for usernames, success does not reset the count, or one
+// valid account would unlock guessing at all the others.
+func (c AttemptCounter) FailuresByIP(kind, ip string, window time.Duration) (*Attempts, error) {
+	return c.attempts(`
+        SELECT COUNT(*),
+               EXTRACT(EPOCH FROM CURRENT_TIMESTAMP - MAX(created_at)),
+               EXTRACT(EPOCH FROM CURRENT_TIMESTAMP - MIN(created_at))
+        FROM auth_attempts
+        WHERE kind = $1 AND ip = $2 AND NOT success
+          AND created_at > CURRENT_TIMESTAMP - $3 * INTERVAL '1 second'
+    `, kind, ip, int64(window/time.Second))
+}
+
+// AttemptsByIP counts all attempts of kind from an address within window
+func (c AttemptCounter) AttemptsByIP(kind, ip string, window time.Duration) (*Attempts, error) {
+	return c.attempts(`
+        SELECT COUNT(*),
+               EXTRACT(EPOCH FROM CURRENT_TIMESTAMP - MAX(created_at)),
+               EXTRACT(EPOCH FROM CURRENT_TIMESTAMP - MIN(created_at))
+        FROM auth_attempts
+        WHERE kind = $1 AND ip = $2
+          AND created_at > CURRENT_TIMESTAMP - $3 * INTERVAL '1 second'
+    `, kind, ip, int64(window/time.Second))
+}
+
+func (c AttemptCounter) attempts(query string, args ...interface{}) (*Attempts, error) {
+	var a Attempts
+	var latest, oldest sql.NullFloat64
+	if err := c.tx.QueryRow(query, args...).Scan(&a.Count, &latest, &oldest); err != nil {
+		return nil, err
+	}
+	a.SinceLatest = time.Duration(latest.Float64 * float64(time.Second))
+	a.SinceOldest = time.Duration(oldest.Float64 * float64(time.Second))
+	return &a, nil
+}
@@ -0,0 +1,85 @@
+package db
+
+import (
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// ChatMessage is something said in a session's chat. Mentions lists the
+// members it @mentions by user ID. UserID is zero and Author empty once the
+// author's account is deleted.
+type ChatMessage struct {
+	ID        int       `json:"id"`
+	UserID    int       `json:"user_id"`
+	Author    string    `json:"author"`
+	Body      string    `json:"body"`
+	Mentions  []int     `json:"mentions"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// CreateChatMessage records a message by userID in a session's chat
+func (db *Database) CreateChatMessage(sessionCode string, userID int, body string, mentions []int) (*ChatMessage, error) {
+	ids := make([]int64, len(mentions))
+	for i, id := range mentions {
+		ids[i] = int64(id)
+	}
+
+	m := ChatMessage{UserID: userID, Body: body, Mentions: mentions}
+	err := db.conn.QueryRow(`
+        WITH inserted AS (
+            INSERT INTO chat_messages (session_id, user_id, body, mentions)
+            SELECT id, $2, $3, $4 FROM editing_sessions WHERE session_code = $1
+            RETURNING id, user_id, created_at
+        )
+        SELECT i.id, i.created_at, `+authorName+`
+        FROM inserted i
+        LEFT JOIN users u ON u.id = i.user_id
+    `, sessionCode, userID, body, pq.Array(ids)).Scan(&m.ID, &m.CreatedAt, &m.Author)
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// ChatHistory returns up to limit of the latest messages of a session's
+// chat with an ID below before, oldest first. A before of zero starts from
+// the latest message.
+func (db *Database) ChatHistory(sessionCode string, before, limit int) ([]ChatMessage, error) {
+	rows, err := db.conn.Query(`
+        SELECT c.id, COALESCE(c.user_id, 0), `+authorName+`, c.body, c.mentions, c.created_at
+        FROM chat_messages c
+        JOIN editing_sessions es ON es.id = c.session_id
+        LEFT JOIN users u ON u.id = c.user_id
+        WHERE es.session_code = $1 AND ($2 = 0 OR c.id < $2)
+        ORDER BY c.id DESC
+        LIMIT $3
+    `, sessionCode, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := []ChatMessage{}
+	for rows.Next() {
+		var m ChatMessage
+		var mentions []int64
+		if err := rows.Scan(&m.ID, &m.UserID, &m.Author, &m.Body, pq.Array(&mentions), &m.CreatedAt); err != nil {
+			return nil, err
+		}
+		m.Mentions = make([]int, len(mentions))
+		for i, id := range mentions {
+			m.Mentions[i] = int(id)
+		}
+		messages = append(messages, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Fetched newest first to apply the limit
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages, nil
+}
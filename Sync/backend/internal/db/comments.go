@@ -0,0 +1,230 @@
+package db
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Comment is one message in a comment thread. UserID is zero and Author
+// empty once the author's account is deleted.
+type Comment struct {
+	ID        int       `json:"id"`
+	ThreadID  int       `json:"thread_id"`
+	UserID    int       `json:"user_id"`
+	Author    string    `json:"author"`
+	Body      string    `json:"body"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// CommentThread is a discussion anchored to the text between Start and End,
+// counted in UTF-16 code units like ot positions. Quote is the text the
+// thread was started on, kept for when that text is gone.
+type CommentThread struct {
+	ID         int        `json:"id"`
+	Start      int        `json:"start"`
+	End        int        `json:"end"`
+	Quote      string     `json:"quote"`
+	ResolvedAt *time.Time `json:"resolved_at,omitempty"`
+	ResolvedBy string     `json:"resolved_by,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	Comments   []Comment  `json:"comments"`
+}
+
+// authorName is the name shown for the author of a comment or suggestion
+const authorName = `COALESCE(NULLIF(u.display_name, ''), u.username, '')`
+
+// CommentThreads returns every thread of a session with its comments,
+// oldest first
+func (db *Database) CommentThreads(sessionCode string) ([]CommentThread, error) {
+	rows, err := db.conn.Query(`
+        SELECT t.id, t.anchor_start, t.anchor_end, t.quote, t.resolved_at,
+            `+authorName+`, t.created_at
+        FROM comment_threads t
+        JOIN editing_sessions es ON es.id = t.session_id
+        LEFT JOIN users u ON u.id = t.resolved_by
+        WHERE es.session_code = $1
+        ORDER BY t.id
+    `, sessionCode)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	threads := []CommentThread{}
+	index := make(map[int]int)
+	for rows.Next() {
+		var t CommentThread
+		var resolvedAt sql.NullTime
+		if err := rows.Scan(&t.ID, &t.Start, &t.End, &t.Quote, &resolvedAt, &t.ResolvedBy, &t.CreatedAt); err != nil {
+			return nil, err
+		}
+		if resolvedAt.Valid {
+			t.ResolvedAt = &resolvedAt.Time
+		} else {
+			t.ResolvedBy = ""
+		}
+		t.Comments = []Comment{}
+		index[t.ID] = len(threads)
+		threads = append(threads, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(threads) == 0 {
+		return threads, nil
+	}
+
+	rows, err = db.conn.Query(`
+        SELECT c.id, c.thread_id, COALESCE(c.user_id, 0), `+authorName+`, c.body, c.created_at
+        FROM comments c
+        JOIN comment_threads t ON t.id = c.thread_id
+        JOIN editing_sessions es ON es.id = t.session_id
+        LEFT JOIN users u ON u.id = c.user_id
+        WHERE es.session_code = $1
+        ORDER BY c.id
+    `, sessionCode)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var c Comment
+		if err := rows.Scan(&c.ID, &c.ThreadID, &c.UserID, &c.Author, &c.Body, &c.CreatedAt); err != nil {
+			return nil, err
+		}
+		if i, ok := index[c.ThreadID]; ok {
+			threads[i].Comments = append(threads[i].Comments, c)
+		}
+	}
+	return threads, rows.Err()
+}
+
+// CreateCommentThread starts a thread on a range of a session's text with
+// its first comment
+func (db *Database) CreateCommentThread(sessionCode string, userID, start, end int, quote, body string) (*CommentThread, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	thread := CommentThread{Start: start, End: end, Quote: quote}
+	err = tx.QueryRow(`
+        INSERT INTO comment_threads (session_id, anchor_start, anchor_end, quote, created_by)
+        SELECT id, $2, $3, $4, $5 FROM editing_sessions WHERE session_code = $1
+        RETURNING id, created_at
+    `, sessionCode, start, end, quote, userID).Scan(&thread.ID, &thread.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	comment, err := addComment(tx, thread.ID, userID, body)
+	if err != nil {
+		return nil, err
+	}
+	thread.Comments = []Comment{*comment}
+	return &thread, tx.Commit()
+}
+
+// AddComment replies to a thread of a session, or returns sql.ErrNoRows if
+// the session has no such thread
+func (db *Database) AddComment(sessionCode string, threadID, userID int, body string) (*Comment, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	err = tx.QueryRow(`
+        SELECT TRUE FROM comment_threads t
+        JOIN editing_sessions es ON es.id = t.session_id
+        WHERE t.id = $1 AND es.session_code = $2
+    `, threadID, sessionCode).Scan(&exists)
+	if err != nil {
+		return nil, err
+	}
+
+	comment, err := addComment(tx, threadID, userID, body)
+	if err != nil {
+		return nil, err
+	}
+	return comment, tx.Commit()
+}
+
+func addComment(tx *sql.Tx, threadID, userID int, body string) (*Comment, error) {
+	c := Comment{ThreadID: threadID, UserID: userID, Body: body}
+	err := tx.QueryRow(`
+        WITH inserted AS (
+            INSERT INTO comments (thread_id, user_id, body)
+            VALUES ($1, $2, $3)
+            RETURNING id, user_id, created_at
+        )
+        SELECT i.id, i.created_at, `+authorName+`
+        FROM inserted i
+        LEFT JOIN users u ON u.id = i.user_id
+    `, threadID, userID, body).Scan(&c.ID, &c.CreatedAt, &c.Author)
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// ResolveThread marks a thread of a session resolved by userID, or reopens
+// it, and returns when it was resolved. It returns sql.ErrNoRows if the
+// session has no such thread.
+func (db *Database) ResolveThread(sessionCode string, threadID, userID int, resolved bool) (*time.Time, error) {
+	var resolvedAt sql.NullTime
+	err := db.conn.QueryRow(`
+        UPDATE comment_threads t
+        SET resolved_at = CASE WHEN $3 THEN CURRENT_TIMESTAMP END,
+            resolved_by = CASE WHEN $3 THEN $4::INTEGER END
+        FROM editing_sessions es
+        WHERE t.id = $1 AND es.id = t.session_id AND es.session_code = $2
+        RETURNING t.resolved_at
+    `, threadID, sessionCode, resolved, userID).Scan(&resolvedAt)
+	if err != nil {
+		return nil, err
+	}
+	if !resolvedAt.Valid {
+		return nil, nil
+	}
+	return &resolvedAt.Time, nil
+}
+
+// Anchor is where a comment thread or suggestion currently sits in the text
+type Anchor struct {
+	ID    int
+	Start int
+	End   int
+}
+
+// SaveThreadAnchors stores where threads have moved to as the text was
+// edited
+func (db *Database) SaveThreadAnchors(anchors []Anchor) error {
+	return db.saveAnchors("comment_threads", anchors)
+}
+
+// saveAnchors updates the anchors in table, which is never user input
+func (db *Database) saveAnchors(table string, anchors []Anchor) error {
+	if len(anchors) == 0 {
+		return nil
+	}
+	ids := make([]int64, len(anchors))
+	starts := make([]int64, len(anchors))
+	ends := make([]int64, len(anchors))
+	for i, a := range anchors {
+		ids[i], starts[i], ends[i] = int64(a.ID), int64(a.Start), int64(a.End)
+	}
+
+	_, err := db.conn.Exec(`
+        UPDATE `+table+` t
+        SET anchor_start = a.anchor_start, anchor_end = a.anchor_end
+        FROM UNNEST($1::INTEGER[], $2::INTEGER[], $3::INTEGER[]) AS a(id, anchor_start, anchor_end)
+        WHERE t.id = a.id
+    `, pq.Array(ids), pq.Array(starts), pq.Array(ends))
+	return err
+}
@@ -0,0 +1,115 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// noPassword is stored for users provisioned by single sign-on. It is not a
+// bcrypt hash, so no password ever matches it.
+const noPassword = "!"
+
+// ErrEmailTaken is returned when provisioning a user whose email already
+// belongs to another user
+var ErrEmailTaken = errors.New("email is already registered")
+
+// UserByIdentity finds the user linked to an account at an identity
+// provider, or returns sql.ErrNoRows
+func (db *Database) UserByIdentity(issuer, subject string) (*User, error) {
+	var user User
+	err := db.conn.QueryRow(`
+        SELECT u.id, u.username, u.email, u.email_verified, u.display_name, u.avatar_url, u.created_at
+        FROM user_identities i
+        JOIN users u ON u.id = i.user_id
+        WHERE i.issuer = $1 AND i.subject = $2
+    `, issuer, subject).Scan(&user.ID, &user.Username, &user.Email, &user.EmailVerified, &user.DisplayName, &user.AvatarURL, &user.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// UserByEmail finds a user by email address, or returns sql.ErrNoRows
+func (db *Database) UserByEmail(email string) (*User, error) {
+	var user User
+	err := db.conn.QueryRow(`
+        SELECT id, username, email, email_verified, display_name, avatar_url, created_at
+        FROM users WHERE LOWER(email) = LOWER($1)
+    `, email).Scan(&user.ID, &user.Username, &user.Email, &user.EmailVerified, &user.DisplayName, &user.AvatarURL, &user.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// LinkIdentity links an account at an identity provider to a user
+func (db *Database) LinkIdentity(userID int, issuer, subject, email string) error {
+	_, err := db.conn.Exec(`
+        INSERT INTO user_identities (user_id, issuer, subject, email)
+        VALUES ($1, $2, $3, $4)
+    `, userID, issuer, subject, email)
+	return err
+}
+
+// CreateExternalUser provisions a user who signs in through an identity
+// provider and links the account. The username is made unique by adding a
+// number, and the user gets no usable password. emailVerified says whether
+// the provider vouches for the email.
+func (db *Database) CreateExternalUser(username, email string, emailVerified bool, issuer, subject string) (*User, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	base := username
+	for attempt := 1; ; attempt++ {
+		var user User
+		err = tx.QueryRow(`
+            INSERT INTO users (username, email, password_hash, email_verified)
+            VALUES ($1, $2, $3, $4)
+            ON CONFLICT (username) DO NOTHING
+            RETURNING id, username, email, email_verified, display_name, avatar_url, created_at
+        `, username, email, noPassword, emailVerified).Scan(&user.ID, &user.Username, &user.Email, &user.EmailVerified, &user.DisplayName, &user.AvatarURL, &user.CreatedAt)
+		if err == nil {
+			if _, err := tx.Exec(`
+                INSERT INTO user_identities (user_id, issuer, subject, email)
+                VALUES ($1, $2, $3, $4)
+            `, user.ID, issuer, subject, email); err != nil {
+				return nil, err
+			}
+			return &user, tx.Commit()
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			var pqErr *pq.Error
+			if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+				return nil, ErrEmailTaken
+			}
+			return nil, err
+		}
+		if attempt >= 100 {
+			return nil, fmt.Errorf("no free username like %s", base)
+		}
+		suffix := fmt.Sprint(attempt + 1)
+		username = strings.TrimSpace(truncate(base, 50-len(suffix))) + suffix
+	}
+}
+
+// truncate cuts s to at most n bytes without splitting a character
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !isRuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+func isRuneStart(b byte) bool {
+	return b&0xC0 != 0x80
+}
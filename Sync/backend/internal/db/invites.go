@@ -0,0 +1,140 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"collab-editor/internal/access"
+)
+
+// ErrInviteInvalid is returned when an invite was revoked, has expired or
+// has been used up
+var ErrInviteInvalid = errors.New("invite is no longer valid")
+
+// Invite is a link the owner of a session handed out. MaxUses is nil for
+// invites that can be used any number of times until they expire.
+type Invite struct {
+	ID        int         `json:"id"`
+	Role      access.Role `json:"role"`
+	CreatedBy string      `json:"created_by"`
+	ExpiresAt time.Time   `json:"expires_at"`
+	MaxUses   *int        `json:"max_uses,omitempty"`
+	Uses      int         `json:"uses"`
+	Revoked   bool        `json:"revoked"`
+	CreatedAt time.Time   `json:"created_at"`
+}
+
+// CreateInvite records a new invite to a session that expires after ttl.
+// maxUses of zero means unlimited.
+func (db *Database) CreateInvite(sessionCode string, createdBy int, role access.Role, ttl time.Duration, maxUses int) (*Invite, error) {
+	var limit sql.NullInt64
+	if maxUses > 0 {
+		limit = sql.NullInt64{Int64: int64(maxUses), Valid: true}
+	}
+
+	var invite Invite
+	var storedLimit sql.NullInt64
+	err := db.conn.QueryRow(`
+        INSERT INTO session_invites (session_id, role, created_by, expires_at, max_uses)
+        SELECT id, $2, $3, CURRENT_TIMESTAMP + $4 * INTERVAL '1 second', $5
+        FROM editing_sessions WHERE session_code = $1
+        RETURNING id, role, expires_at, max_uses, uses, created_at
+    `, sessionCode, string(role), createdBy, int64(ttl/time.Second), limit).Scan(
+		&invite.ID, &invite.Role, &invite.ExpiresAt, &storedLimit, &invite.Uses, &invite.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if storedLimit.Valid {
+		n := int(storedLimit.Int64)
+		invite.MaxUses = &n
+	}
+	return &invite, nil
+}
+
+// ListInvites returns every invite to a session, newest first
+func (db *Database) ListInvites(sessionCode string) ([]Invite, error) {
+	rows, err := db.conn.Query(`
+        SELECT si.id, si.role, COALESCE(u.username, ''), si.expires_at, si.max_uses,
+               si.uses, si.revoked_at IS NOT NULL, si.created_at
+        FROM session_invites si
+        JOIN editing_sessions es ON es.id = si.session_id
+        LEFT JOIN users u ON u.id = si.created_by
+        WHERE es.session_code = $1
+        ORDER BY si.created_at DESC
+    `, sessionCode)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invites := []Invite{}
+	for rows.Next() {
+		var invite Invite
+		var limit sql.NullInt64
+		if err := rows.Scan(&invite.ID, &invite.Role, &invite.CreatedBy, &invite.ExpiresAt, &limit,
+			&invite.Uses, &invite.Revoked, &invite.CreatedAt); err != nil {
+			return nil, err
+		}
+		if limit.Valid {
+			n := int(limit.Int64)
+			invite.MaxUses = &n
+		}
+		invites = append(invites, invite)
+	}
+	return invites, rows.Err()
+}
+
+// UseInvite counts one use of an invite and returns the role it grants. It
+// returns ErrInviteInvalid if the invite cannot be used any more.
+func (db *Database) UseInvite(sessionCode string, inviteID int) (access.Role, error) {
+	var role access.Role
+	err := db.conn.QueryRow(`
+        UPDATE session_invites si SET uses = si.uses + 1
+        FROM editing_sessions es
+        WHERE si.id = $2 AND si.session_id = es.id AND es.session_code = $1
+          AND si.revoked_at IS NULL
+          AND si.expires_at > CURRENT_TIMESTAMP
+          AND (si.max_uses IS NULL OR si.uses < si.max_uses)
+        RETURNING si.role
+    `, sessionCode, inviteID).Scan(&role)
+	if err == sql.ErrNoRows {
+		return access.None, ErrInviteInvalid
+	}
+	return role, err
+}
+
+// InviteActive reports whether an invite to a session is neither revoked nor
+// expired. Unlike UseInvite it does not count a use, so whoever already
+// redeemed the invite can keep using it once it is used up.
+func (db *Database) InviteActive(sessionCode string, inviteID int) (bool, error) {
+	var active bool
+	err := db.conn.QueryRow(`
+        SELECT EXISTS (
+            SELECT 1 FROM session_invites si
+            JOIN editing_sessions es ON es.id = si.session_id
+            WHERE si.id = $2 AND es.session_code = $1
+              AND si.revoked_at IS NULL
+              AND si.expires_at > CURRENT_TIMESTAMP
+        )
+    `, sessionCode, inviteID).Scan(&active)
+	return active, err
+}
+
+// RevokeInvite stops an invite from being used again. It reports whether
+// the session had such an invite.
+func (db *Database) RevokeInvite(sessionCode string, inviteID int) (bool, error) {
+	result, err := db.conn.Exec(`
+        UPDATE session_invites si SET revoked_at = COALESCE(si.revoked_at, CURRENT_TIMESTAMP)
+        FROM editing_sessions es
+        WHERE si.id = $2 AND si.session_id = es.id AND es.session_code = $1
+    `, sessionCode, inviteID)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
@@ -0,0 +1,176 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"collab-editor/internal/access"
+
+	"github.com/lib/pq"
+)
+
+// Member is a user who holds a role in a session
+type Member struct {
+	UserID    int         `json:"user_id"`
+	Username  string      `json:"username"`
+	Role      access.Role `json:"role"`
+	GrantedAt time.Time   `json:"granted_at"`
+}
+
+// SessionAccess returns the role userID holds in a session and whether the
+// session has an owner at all. Sessions that do not exist yet are reported
+// as unowned.
+func (db *Database) SessionAccess(sessionCode string, userID int) (access.Role, bool, error) {
+	var ownerID sql.NullInt64
+	var role sql.NullString
+	err := db.conn.QueryRow(`
+        SELECT es.owner_id, sm.role
+        FROM editing_sessions es
+        LEFT JOIN session_members sm ON sm.session_id = es.id AND sm.user_id = $2
+        WHERE es.session_code = $1
+    `, sessionCode, userID).Scan(&ownerID, &role)
+	if err == sql.ErrNoRows {
+		return access.None, false, nil
+	}
+	if err != nil {
+		return access.None, false, err
+	}
+
+	if !ownerID.Valid {
+		return access.None, false, nil
+	}
+	if userID > 0 && int(ownerID.Int64) == userID {
+		return access.Owner, true, nil
+	}
+	return access.Role(role.String), true, nil
+}
+
+// ClaimSession makes userID the owner of a session nobody owns yet. It
+// reports whether the claim succeeded.
+func (db *Database) ClaimSession(sessionCode string, userID int) (bool, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var sessionID int
+	err = tx.QueryRow(`
+        UPDATE editing_sessions SET owner_id = $2
+        WHERE session_code = $1 AND owner_id IS NULL
+        RETURNING id
+    `, sessionCode, userID).Scan(&sessionID)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	_, err = tx.Exec(`
+        INSERT INTO session_members (session_id, user_id, role)
+        VALUES ($1, $2, 'owner')
+        ON CONFLICT (session_id, user_id)
+        DO UPDATE SET role = 'owner', granted_at = CURRENT_TIMESTAMP
+    `, sessionID, userID)
+	if err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+// ListMembers returns everyone holding a role in a session, owner first
+func (db *Database) ListMembers(sessionCode string) ([]Member, error) {
+	rows, err := db.conn.Query(`
+        SELECT u.id, u.username, sm.role, sm.granted_at
+        FROM session_members sm
+        JOIN editing_sessions es ON es.id = sm.session_id
+        JOIN users u ON u.id = sm.user_id
+        WHERE es.session_code = $1
+        ORDER BY sm.role = 'owner' DESC, u.username
+    `, sessionCode)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []Member{}
+	for rows.Next() {
+		var m Member
+		if err := rows.Scan(&m.UserID, &m.Username, &m.Role, &m.GrantedAt); err != nil {
+			return nil, err
+		}
+		members = append(members, m)
+	}
+	return members, rows.Err()
+}
+
+// MembersNamed returns the IDs of the members of a session with the given
+// usernames, keyed by username
+func (db *Database) MembersNamed(sessionCode string, usernames []string) (map[string]int, error) {
+	members := make(map[string]int)
+	if len(usernames) == 0 {
+		return members, nil
+	}
+
+	rows, err := db.conn.Query(`
+        SELECT u.id, u.username
+        FROM session_members sm
+        JOIN editing_sessions es ON es.id = sm.session_id
+        JOIN users u ON u.id = sm.user_id
+        WHERE es.session_code = $1 AND u.username = ANY($2)
+    `, sessionCode, pq.Array(usernames))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int
+		var username string
+		if err := rows.Scan(&id, &username); err != nil {
+			return nil, err
+		}
+		members[username] = id
+	}
+	return members, rows.Err()
+}
+
+// SetMemberRole grants role to userID, replacing any role they held before.
+// The owner's own role cannot be changed this way.
+func (db *Database) SetMemberRole(sessionCode string, userID int, role access.Role) error {
+	result, err := db.conn.Exec(`
+        INSERT INTO session_members (session_id, user_id, role)
+        SELECT id, $2, $3 FROM editing_sessions WHERE session_code = $1
+        ON CONFLICT (session_id, user_id)
+        DO UPDATE SET role = EXCLUDED.role, granted_at = CURRENT_TIMESTAMP
+        WHERE session_members.role <> 'owner'
+    `, sessionCode, userID, string(role))
+	if err != nil {
+		return err
+	}
+
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("cannot grant %s in session %s to user %d", role, sessionCode, userID)
+	}
+	return nil
+}
+
+// RemoveMember revokes whatever role userID held in a session. It reports
+// whether there was one to revoke. The owner cannot be removed.
+func (db *Database) RemoveMember(sessionCode string, userID int) (bool, error) {
+	result, err := db.conn.Exec(`
+        DELETE FROM session_members sm
+        USING editing_sessions es
+        WHERE sm.session_id = es.id AND es.session_code = $1
+          AND sm.user_id = $2 AND sm.role <> 'owner'
+    `, sessionCode, userID)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
@@ -0,0 +1,101 @@
+package db
+
+import "time"
+
+// Publication is a public snapshot of a session. Its content never changes
+// after publishing. Live publications also let readers follow the session
+// as it is edited.
+type Publication struct {
+	Slug        string    `json:"slug"`
+	SessionCode string    `json:"session_code"`
+	Content     string    `json:"content,omitempty"`
+	Live        bool      `json:"live"`
+	PublishedBy string    `json:"published_by"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+func (db *Database) CreatePublication(sessionCode, slug, content string, live bool, userID int) (*Publication, error) {
+	p := Publication{
+		Slug:        slug,
+		SessionCode: sessionCode,
+		Content:     content,
+		Live:        live,
+	}
+	err := db.conn.QueryRow(`
+        INSERT INTO publications (slug, session_id, content, live, published_by)
+        SELECT $1, id, $3, $4, $5 FROM editing_sessions WHERE session_code = $2
+        RETURNING created_at
+    `, slug, sessionCode, content, live, userID).Scan(&p.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	p.PublishedBy, err = db.username(userID)
+	return &p, err
+}
+
+// GetPublication returns a publication with its content. It returns
+// sql.ErrNoRows if there is none with that slug.
+func (db *Database) GetPublication(slug string) (*Publication, error) {
+	var p Publication
+	err := db.conn.QueryRow(`
+        SELECT p.slug, es.session_code, p.content, p.live, COALESCE(u.username, ''), p.created_at
+        FROM publications p
+        JOIN editing_sessions es ON es.id = p.session_id
+        LEFT JOIN users u ON u.id = p.published_by
+        WHERE p.slug = $1
+    `, slug).Scan(&p.Slug, &p.SessionCode, &p.Content, &p.Live, &p.PublishedBy, &p.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// ListPublications returns the publications of a session without their
+// content, newest first
+func (db *Database) ListPublications(sessionCode string) ([]Publication, error) {
+	rows, err := db.conn.Query(`
+        SELECT p.slug, es.session_code, p.live, COALESCE(u.username, ''), p.created_at
+        FROM publications p
+        JOIN editing_sessions es ON es.id = p.session_id
+        LEFT JOIN users u ON u.id = p.published_by
+        WHERE es.session_code = $1
+        ORDER BY p.created_at DESC
+    `, sessionCode)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	publications := []Publication{}
+	for rows.Next() {
+		var p Publication
+		if err := rows.Scan(&p.Slug, &p.SessionCode, &p.Live, &p.PublishedBy, &p.CreatedAt); err != nil {
+			return nil, err
+		}
+		publications = append(publications, p)
+	}
+	return publications, rows.Err()
+}
+
+// DeletePublication takes a publication down. It reports whether the
+// session had one with that slug.
+func (db *Database) DeletePublication(sessionCode, slug string) (bool, error) {
+	result, err := db.conn.Exec(`
+        DELETE FROM publications p
+        USING editing_sessions es
+        WHERE p.session_id = es.id AND es.session_code = $1 AND p.slug = $2
+    `, sessionCode, slug)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+func (db *Database) username(userID int) (string, error) {
+	var username string
+	err := db.conn.QueryRow(`SELECT username FROM users WHERE id = $1`, userID).Scan(&username)
+	return username, err
+}
@@ -0,0 +1,181 @@
+package db
+
+import (
+	"database/sql"
+	"sort"
+	"time"
+
+	"collab-editor/internal/ot"
+
+	"github.com/lib/pq"
+)
+
+// Suggestion states
+const (
+	SuggestionPending  = "pending"
+	SuggestionAccepted = "accepted"
+	SuggestionRejected = "rejected"
+)
+
+// Suggestion proposes replacing the text between Start and End, counted in
+// UTF-16 code units, with Text. An insertion has Start equal to End and a
+// deletion has no Text. UserID is zero once the author's account is deleted.
+type Suggestion struct {
+	ID         int       `json:"id"`
+	UserID     int       `json:"user_id"`
+	Author     string    `json:"author"`
+	Start      int       `json:"start"`
+	End        int       `json:"end"`
+	Text       string    `json:"text"`
+	Status     string    `json:"status"`
+	ResolvedBy string    `json:"resolved_by,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// PendingSuggestions returns the suggestions of a session nobody has
+// accepted or rejected yet, oldest first
+func (db *Database) PendingSuggestions(sessionCode string) ([]Suggestion, error) {
+	rows, err := db.conn.Query(`
+        SELECT s.id, COALESCE(s.user_id, 0), `+authorName+`, s.anchor_start, s.anchor_end,
+            s.text, s.status, s.created_at
+        FROM suggestions s
+        JOIN editing_sessions es ON es.id = s.session_id
+        LEFT JOIN users u ON u.id = s.user_id
+        WHERE es.session_code = $1 AND s.status = 'pending'
+        ORDER BY s.id
+    `, sessionCode)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	suggestions := []Suggestion{}
+	for rows.Next() {
+		var s Suggestion
+		if err := rows.Scan(&s.ID, &s.UserID, &s.Author, &s.Start, &s.End, &s.Text, &s.Status, &s.CreatedAt); err != nil {
+			return nil, err
+		}
+		suggestions = append(suggestions, s)
+	}
+	return suggestions, rows.Err()
+}
+
+// CreateSuggestion records a pending suggestion by userID
+func (db *Database) CreateSuggestion(sessionCode string, userID, start, end int, text string) (*Suggestion, error) {
+	s := Suggestion{UserID: userID, Start: start, End: end, Text: text, Status: SuggestionPending}
+	err := db.conn.QueryRow(`
+        WITH inserted AS (
+            INSERT INTO suggestions (session_id, user_id, anchor_start, anchor_end, text)
+            SELECT id, $2, $3, $4, $5 FROM editing_sessions WHERE session_code = $1
+            RETURNING id, user_id, created_at
+        )
+        SELECT i.id, i.created_at, `+authorName+`
+        FROM inserted i
+        LEFT JOIN users u ON u.id = i.user_id
+    `, sessionCode, userID, start, end, text).Scan(&s.ID, &s.CreatedAt, &s.Author)
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// UpdateSuggestion changes the range and text of a pending suggestion, as
+// when its author keeps typing. It returns sql.ErrNoRows if the suggestion
+// is no longer pending.
+func (db *Database) UpdateSuggestion(id, start, end int, text string) error {
+	result, err := db.conn.Exec(`
+        UPDATE suggestions SET anchor_start = $2, anchor_end = $3, text = $4
+        WHERE id = $1 AND status = 'pending'
+    `, id, start, end, text)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// ResolveSuggestions accepts or rejects pending suggestions of a session on
+// behalf of userID and returns the IDs it changed. Suggestions someone else
+// resolved first are left alone, so each is applied at most once.
+func (db *Database) ResolveSuggestions(sessionCode string, ids []int, status string, userID int) ([]int, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	list := make([]int64, len(ids))
+	for i, id := range ids {
+		list[i] = int64(id)
+	}
+
+	rows, err := db.conn.Query(`
+        UPDATE suggestions s
+        SET status = $3, resolved_by = $4, resolved_at = CURRENT_TIMESTAMP
+        FROM editing_sessions es
+        WHERE s.id = ANY($2) AND s.status = 'pending'
+            AND es.id = s.session_id AND es.session_code = $1
+        RETURNING s.id
+    `, sessionCode, pq.Array(list), status, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var resolved []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		resolved = append(resolved, id)
+	}
+	return resolved, rows.Err()
+}
+
+// SaveSuggestionAnchors stores where suggestions have moved to as the text
+// was edited
+func (db *Database) SaveSuggestionAnchors(anchors []Anchor) error {
+	return db.saveAnchors("suggestions", anchors)
+}
+
+// ApplySuggestions returns content with the suggestions carried out, and
+// the ones it applied. See SuggestionsOperation for which are skipped.
+func ApplySuggestions(content string, suggestions []Suggestion) (string, []Suggestion) {
+	op, applied := SuggestionsOperation(content, suggestions)
+	text, err := op.Apply(content)
+	if err != nil {
+		return content, nil
+	}
+	return text, applied
+}
+
+// SuggestionsOperation returns the operation that carries out the
+// suggestions on content, and the ones it covers. Suggestions overlapping
+// one taken before them are skipped; several insertions at one place end up
+// oldest first.
+func SuggestionsOperation(content string, suggestions []Suggestion) (ot.Operation, []Suggestion) {
+	list := append([]Suggestion(nil), suggestions...)
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Start != list[j].Start {
+			return list[i].Start < list[j].Start
+		}
+		return list[i].ID < list[j].ID
+	})
+
+	length := ot.Length(content)
+	var op ot.Operation
+	var applied []Suggestion
+	pos := 0
+	for _, s := range list {
+		if s.Start < pos || s.End < s.Start || s.End > length {
+			continue
+		}
+		op.Retain(s.Start - pos)
+		op.Insert(s.Text)
+		op.Delete(s.End - s.Start)
+		pos = s.End
+		applied = append(applied, s)
+	}
+	op.Retain(length - pos)
+	return op, applied
+}
@@ -0,0 +1,131 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+var (
+	// ErrTokenInvalid is returned for refresh tokens that are unknown or
+	// have expired
+	ErrTokenInvalid = errors.New("refresh token is invalid")
+	// ErrTokenReused is returned when a refresh token that was already
+	// rotated or revoked is presented again. The whole login is revoked,
+	// since either the client or a thief holds a copy it should not have.
+	ErrTokenReused = errors.New("refresh token was already used")
+)
+
+// CreateRefreshToken stores the hash of the first refresh token of a login
+func (db *Database) CreateRefreshToken(userID int, loginID, tokenHash string, ttl time.Duration) error {
+	_, err := db.conn.Exec(`
+        INSERT INTO refresh_tokens (user_id, login_id, token_hash, expires_at)
+        VALUES ($1, $2, $3, CURRENT_TIMESTAMP + $4 * INTERVAL '1 second')
+    `, userID, loginID, tokenHash, int64(ttl/time.Second))
+	return err
+}
+
+// RotateRefreshToken swaps a refresh token for a new one in the same login
+// and returns whose login it is. Presenting a token that was already
+// swapped revokes the login and returns ErrTokenReused.
+func (db *Database) RotateRefreshToken(oldHash, newHash string, ttl time.Duration) (int, string, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return 0, "", err
+	}
+	defer tx.Rollback()
+
+	var id, userID int
+	var loginID string
+	var expired, revoked bool
+	err = tx.QueryRow(`
+        SELECT id, user_id, login_id, expires_at <= CURRENT_TIMESTAMP, revoked_at IS NOT NULL
+        FROM refresh_tokens WHERE token_hash = $1
+        FOR UPDATE
+    `, oldHash).Scan(&id, &userID, &loginID, &expired, &revoked)
+	if err == sql.ErrNoRows {
+		return 0, "", ErrTokenInvalid
+	}
+	if err != nil {
+		return 0, "", err
+	}
+
+	if revoked {
+		if _, err := tx.Exec(`
+            UPDATE refresh_tokens SET revoked_at = CURRENT_TIMESTAMP
+            WHERE login_id = $1 AND revoked_at IS NULL
+        `, loginID); err != nil {
+			return 0, "", err
+		}
+		if err := tx.Commit(); err != nil {
+			return 0, "", err
+		}
+		return userID, loginID, ErrTokenReused
+	}
+	if expired {
+		return 0, "", ErrTokenInvalid
+	}
+
+	if _, err := tx.Exec(`
+        UPDATE refresh_tokens SET revoked_at = CURRENT_TIMESTAMP WHERE id = $1
+    `, id); err != nil {
+		return 0, "", err
+	}
+	if _, err := tx.Exec(`
+        INSERT INTO refresh_tokens (user_id, login_id, token_hash, expires_at)
+        VALUES ($1, $2, $3, CURRENT_TIMESTAMP + $4 * INTERVAL '1 second')
+    `, userID, loginID, newHash, int64(ttl/time.Second)); err != nil {
+		return 0, "", err
+	}
+
+	return userID, loginID, tx.Commit()
+}
+
+// RevokeRefreshToken ends the login a refresh token belongs to and returns
+// whose login it was
+func (db *Database) RevokeRefreshToken(tokenHash string) (int, string, error) {
+	var userID int
+	var loginID string
+	err := db.conn.QueryRow(`
+        SELECT user_id, login_id FROM refresh_tokens WHERE token_hash = $1
+    `, tokenHash).Scan(&userID, &loginID)
+	if err == sql.ErrNoRows {
+		return 0, "", ErrTokenInvalid
+	}
+	if err != nil {
+		return 0, "", err
+	}
+
+	return userID, loginID, db.RevokeLogin(userID, loginID)
+}
+
+// RevokeLogin ends one login of a user
+func (db *Database) RevokeLogin(userID int, loginID string) error {
+	_, err := db.conn.Exec(`
+        UPDATE refresh_tokens SET revoked_at = CURRENT_TIMESTAMP
+        WHERE user_id = $1 AND login_id = $2 AND revoked_at IS NULL
+    `, userID, loginID)
+	return err
+}
+
+// RevokeAllLogins ends every login of a user
+func (db *Database) RevokeAllLogins(userID int) error {
+	_, err := db.conn.Exec(`
+        UPDATE refresh_tokens SET revoked_at = CURRENT_TIMESTAMP
+        WHERE user_id = $1 AND revoked_at IS NULL
+    `, userID)
+	return err
+}
+
+// LoginActive reports whether a login still holds a usable refresh token
+func (db *Database) LoginActive(userID int, loginID string) (bool, error) {
+	var active bool
+	err := db.conn.QueryRow(`
+        SELECT EXISTS (
+            SELECT 1 FROM refresh_tokens
+            WHERE user_id = $1 AND login_id = $2
+              AND revoked_at IS NULL AND expires_at > CURRENT_TIMESTAMP
+        )
+    `, userID, loginID).Scan(&active)
+	return active, err
+}
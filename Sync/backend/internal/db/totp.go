@@ -0,0 +1,159 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+)
+
+// ErrTOTPEnabled is returned when setting up two-factor authentication for
+// a user who already has it
+var ErrTOTPEnabled = errors.New("two-factor authentication is already enabled")
+
+// TOTP is a user's two-factor state. A secret without Enabled is waiting
+// for its first code to be confirmed.
+type TOTP struct {
+	Secret   string
+	Enabled  bool
+	LastStep int64
+}
+
+// GetTOTP returns a user's two-factor state
+func (db *Database) GetTOTP(userID int) (*TOTP, error) {
+	var t TOTP
+	err := db.conn.QueryRow(`
+        SELECT COALESCE(totp_secret, ''), totp_enabled, totp_last_step
+        FROM users WHERE id = $1
+    `, userID).Scan(&t.Secret, &t.Enabled, &t.LastStep)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// SetPendingTOTP stores a new secret to be confirmed, replacing any earlier
+// unconfirmed one
+func (db *Database) SetPendingTOTP(userID int, secret string) error {
+	result, err := db.conn.Exec(`
+        UPDATE users SET totp_secret = $2, totp_last_step = 0
+        WHERE id = $1 AND NOT totp_enabled
+    `, userID, secret)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrTOTPEnabled
+	}
+	return nil
+}
+
+// EnableTOTP turns on two-factor authentication once the first code was
+// confirmed at step, replacing the user's recovery codes
+func (db *Database) EnableTOTP(userID int, step int64, codeHashes []string) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+        UPDATE users SET totp_enabled = TRUE, totp_last_step = $2
+        WHERE id = $1 AND totp_secret IS NOT NULL AND NOT totp_enabled
+    `, userID, step)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrTOTPEnabled
+	}
+
+	if err := replaceRecoveryCodes(tx, userID, codeHashes); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DisableTOTP turns off two-factor authentication and drops the secret and
+// recovery codes
+func (db *Database) DisableTOTP(userID int) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`
+        UPDATE users SET totp_secret = NULL, totp_enabled = FALSE, totp_last_step = 0
+        WHERE id = $1
+    `, userID); err != nil {
+		return err
+	}
+	if err := replaceRecoveryCodes(tx, userID, nil); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UseTOTPStep records that a code of step was used and reports false if
+// that step or a later one was used before, so codes cannot be replayed
+func (db *Database) UseTOTPStep(userID int, step int64) (bool, error) {
+	result, err := db.conn.Exec(`
+        UPDATE users SET totp_last_step = $2
+        WHERE id = $1 AND totp_last_step < $2
+    `, userID, step)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// UseRecoveryCode spends one of the user's recovery codes and reports
+// whether it was valid
+func (db *Database) UseRecoveryCode(userID int, codeHash string) (bool, error) {
+	result, err := db.conn.Exec(`
+        UPDATE recovery_codes SET used_at = CURRENT_TIMESTAMP
+        WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL
+    `, userID, codeHash)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// RecoveryCodesLeft counts a user's unused recovery codes
+func (db *Database) RecoveryCodesLeft(userID int) (int, error) {
+	var n int
+	err := db.conn.QueryRow(`
+        SELECT COUNT(*) FROM recovery_codes WHERE user_id = $1 AND used_at IS NULL
+    `, userID).Scan(&n)
+	return n, err
+}
+
+// ReplaceRecoveryCodes invalidates a user's recovery codes and stores new ones
+func (db *Database) ReplaceRecoveryCodes(userID int, codeHashes []string) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := replaceRecoveryCodes(tx, userID, codeHashes); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func replaceRecoveryCodes(tx *sql.Tx, userID int, codeHashes []string) error {
+	if _, err := tx.Exec(`DELETE FROM recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return err
+	}
+	for _, hash := range codeHashes {
+		if _, err := tx.Exec(`
+            INSERT INTO recovery_codes (user_id, code_hash) VALUES ($1, $2)
+        `, userID, hash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Purposes of the single-use links sent to users by email
+const (
+	TokenPasswordReset = "reset"
+	TokenVerifyEmail   = "verify"
+)
+
+// ErrLinkInvalid is returned for emailed links that are unknown, expired,
+// already used or no longer match the user's email
+var ErrLinkInvalid = errors.New("link is invalid or has expired")
+
+// CreateUserToken stores the hash of a single-use link for the user's
+// current email. Earlier unused links for the same purpose stop working.
+func (db *Database) CreateUserToken(userID int, purpose, tokenHash string, ttl time.Duration) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`
+        UPDATE user_tokens SET used_at = CURRENT_TIMESTAMP
+        WHERE user_id = $1 AND purpose = $2 AND used_at IS NULL
+    `, userID, purpose); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`
+        INSERT INTO user_tokens (user_id, purpose, token_hash, email, expires_at)
+        SELECT id, $2, $3, email, CURRENT_TIMESTAMP + $4 * INTERVAL '1 second'
+        FROM users WHERE id = $1
+    `, userID, purpose, tokenHash, int64(ttl/time.Second)); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// UseUserToken spends a single-use link and returns whose it was. The link
+// only works while the user's email is the one it was sent to.
+func (db *Database) UseUserToken(purpose, tokenHash string) (int, error) {
+	var userID int
+	err := db.conn.QueryRow(`
+        UPDATE user_tokens t SET used_at = CURRENT_TIMESTAMP
+        FROM users u
+        WHERE t.token_hash = $1 AND t.purpose = $2 AND t.user_id = u.id
+          AND t.used_at IS NULL AND t.expires_at > CURRENT_TIMESTAMP
+          AND t.email = u.email
+        RETURNING t.user_id
+    `, tokenHash, purpose).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return 0, ErrLinkInvalid
+	}
+	return userID, err
+}
+
+// SetPassword replaces a user's password
+func (db *Database) SetPassword(userID int, password string) error {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.conn.Exec(`
+        UPDATE users SET password_hash = $2 WHERE id = $1
+    `, userID, string(hashedPassword))
+	return err
+}
+
+// MarkEmailVerified records that the user controls their email
+func (db *Database) MarkEmailVerified(userID int) error {
+	_, err := db.conn.Exec(`
+        UPDATE users SET email_verified = TRUE WHERE id = $1
+    `, userID)
+	return err
+}
@@ -0,0 +1,243 @@
+package diff
+
+import "strings"
+
+// Kinds of Edit
+const (
+	Equal  = "equal"
+	Insert = "insert"
+	Delete = "delete"
+)
+
+// Edit is one run of text that is unchanged, added or removed between two
+// versions.
+type Edit struct {
+	Kind string `json:"kind"`
+	Text string `json:"text"`
+}
+
+// Lines diffs a and b line by line. Each line keeps its trailing newline so
+// joining the Equal and Insert edits gives back b.
+func Lines(a, b string) []Edit {
+	return build(splitLines(a), splitLines(b))
+}
+
+// Runes diffs a and b character by character.
+func Runes(a, b string) []Edit {
+	return build(splitRunes(a), splitRunes(b))
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+func splitRunes(s string) []string {
+	parts := make([]string, 0, len(s))
+	for _, r := range s {
+		parts = append(parts, string(r))
+	}
+	return parts
+}
+
+// build runs the diff and merges consecutive tokens of the same kind. The
+// common prefix and suffix are stripped first since edits are usually small
+// compared to the document.
+func build(a, b []string) []Edit {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	var edits []Edit
+	add := func(kind, text string) {
+		if n := len(edits); n > 0 && edits[n-1].Kind == kind {
+			edits[n-1].Text += text
+		} else {
+			edits = append(edits, Edit{Kind: kind, Text: text})
+		}
+	}
+
+	for _, t := range a[:prefix] {
+		add(Equal, t)
+	}
+
+	middleA, middleB := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	for _, step := range myers(middleA, middleB) {
+		var kind, text string
+		switch {
+		case step.ai >= 0 && step.bi >= 0:
+			kind, text = Equal, middleA[step.ai]
+		case step.ai >= 0:
+			kind, text = Delete, middleA[step.ai]
+		default:
+			kind, text = Insert, middleB[step.bi]
+		}
+		add(kind, text)
+	}
+
+	for _, t := range a[len(a)-suffix:] {
+		add(Equal, t)
+	}
+	return edits
+}
+
+// step is one token of the edit script. ai and bi index into a and b, and
+// -1 marks the side the token is missing from.
+type step struct {
+	ai, bi int
+}
+
+// myers computes a shortest edit script with the linear space variant of
+// Myers' O(ND) algorithm: it finds where the forward and backward searches
+// meet, the middle snake, and recurses on either side of it. Keeping every
+// step of a single search instead would take O(ND) memory, gigabytes for a
+// rewritten document.
+func myers(a, b []string) []step {
+	d := differ{a: a, b: b}
+	d.compare(0, len(a), 0, len(b))
+	return d.steps
+}
+
+type differ struct {
+	a, b  []string
+	steps []step
+}
+
+// compare appends the edit script turning a[a0:a1] into b[b0:b1]
+func (d *differ) compare(a0, a1, b0, b1 int) {
+	for a0 < a1 && b0 < b1 && d.a[a0] == d.b[b0] {
+		d.steps = append(d.steps, step{a0, b0})
+		a0++
+		b0++
+	}
+	suffix := 0
+	for a1 > a0 && b1 > b0 && d.a[a1-1] == d.b[b1-1] {
+		a1--
+		b1--
+		suffix++
+	}
+
+	switch {
+	case a0 == a1:
+		for y := b0; y < b1; y++ {
+			d.steps = append(d.steps, step{-1, y})
+		}
+	case b0 == b1:
+		for x := a0; x < a1; x++ {
+			d.steps = append(d.steps, step{x, -1})
+		}
+	default:
+		x, y, ok := d.middle(a0, a1, b0, b1)
+		if !ok {
+			// Nothing in common
+			for i := a0; i < a1; i++ {
+				d.steps = append(d.steps, step{i, -1})
+			}
+			for i := b0; i < b1; i++ {
+				d.steps = append(d.steps, step{-1, i})
+			}
+			break
+		}
+		d.compare(a0, x, b0, y)
+		d.compare(x, a1, y, b1)
+	}
+
+	for i := 0; i < suffix; i++ {
+		d.steps = append(d.steps, step{a1 + i, b1 + i})
+	}
+}
+
+// middle searches a[a0:a1] and b[b0:b1] from both ends at once and returns
+// where the paths meet, which splits the problem in two smaller ones. It
+// reports false if the ranges have nothing in common.
+func (d *differ) middle(a0, a1, b0, b1 int) (int, int, bool) {
+	n, m := a1-a0, b1-b0
+	maxD := (n + m + 1) / 2
+	offset := maxD
+	size := 2*maxD + 2
+	// forward[k] is the furthest x reached on diagonal k from the start,
+	// backward[k] the furthest distance from the end on diagonal k there
+	forward := make([]int, size)
+	backward := make([]int, size)
+	for i := range forward {
+		forward[i], backward[i] = -1, -1
+	}
+	forward[offset+1], backward[offset+1] = 0, 0
+
+	delta := n - m
+	// With an odd delta the paths meet while searching forward
+	odd := delta%2 != 0
+	k1start, k1end, k2start, k2end := 0, 0, 0, 0
+
+	for D := 0; D < maxD; D++ {
+		for k1 := -D + k1start; k1 <= D-k1end; k1 += 2 {
+			i := offset + k1
+			var x int
+			if k1 == -D || (k1 != D && forward[i-1] < forward[i+1]) {
+				x = forward[i+1]
+			} else {
+				x = forward[i-1] + 1
+			}
+			y := x - k1
+			for x < n && y < m && d.a[a0+x] == d.b[b0+y] {
+				x++
+				y++
+			}
+			forward[i] = x
+			switch {
+			case x > n:
+				k1end += 2
+			case y > m:
+				k1start += 2
+			case odd:
+				j := offset + delta - k1
+				if j >= 0 && j < size && backward[j] != -1 && x >= n-backward[j] {
+					return a0 + x, b0 + y, true
+				}
+			}
+		}
+
+		for k2 := -D + k2start; k2 <= D-k2end; k2 += 2 {
+			i := offset + k2
+			var x int
+			if k2 == -D || (k2 != D && backward[i-1] < backward[i+1]) {
+				x = backward[i+1]
+			} else {
+				x = backward[i-1] + 1
+			}
+			y := x - k2
+			for x < n && y < m && d.a[a1-1-x] == d.b[b1-1-y] {
+				x++
+				y++
+			}
+			backward[i] = x
+			switch {
+			case x > n:
+				k2end += 2
+			case y > m:
+				k2start += 2
+			case !odd:
+				j := offset + delta - k2
+				if j >= 0 && j < size && forward[j] != -1 {
+					fx := forward[j]
+					fy := offset + fx - j
+					if fx >= n-x {
+						return a0 + fx, b0 + fy, true
+					}
+				}
+			}
+		}
+	}
+	return 0, 0, false
+}
@@ -0,0 +1,164 @@
+package diff
+
+import (
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// rebuild joins the edits of kind and Equal, which gives back b for Insert
+// and a for Delete
+func rebuild(edits []Edit, kind string) string {
+	var b strings.Builder
+	for _, e := range edits {
+		if e.Kind == Equal || e.Kind == kind {
+			b.WriteString(e.Text)
+		}
+	}
+	return b.String()
+}
+
+// changed counts the characters the edits insert or delete
+func changed(edits []Edit) int {
+	n := 0
+	for _, e := range edits {
+		if e.Kind != Equal {
+			n += utf8.RuneCountInString(e.Text)
+		}
+	}
+	return n
+}
+
+// lcs returns the length of the longest common subsequence of the runes of
+// a and b, the slow and obvious way
+func lcs(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	row := make([]int, len(rb)+1)
+	for i := range ra {
+		prev := 0
+		for j := range rb {
+			cur := row[j+1]
+			if ra[i] == rb[j] {
+				row[j+1] = prev + 1
+			} else {
+				row[j+1] = max(row[j+1], row[j])
+			}
+			prev = cur
+		}
+	}
+	return row[len(rb)]
+}
+
+func TestRunes(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		want []Edit
+	}{
+		{"both empty", "", "", nil},
+		{"from empty", "", "abc", []Edit{{Insert, "abc"}}},
+		{"to empty", "abc", "", []Edit{{Delete, "abc"}}},
+		{"identical", "abc", "abc", []Edit{{Equal, "abc"}}},
+		{"disjoint", "abc", "xyz", []Edit{{Delete, "abc"}, {Insert, "xyz"}}},
+		{"disjoint of different lengths", "ab", "wxyz", []Edit{{Delete, "ab"}, {Insert, "wxyz"}}},
+		{"insert in the middle", "ac", "abc", []Edit{{Equal, "a"}, {Insert, "b"}, {Equal, "c"}}},
+		{"delete in the middle", "abc", "ac", []Edit{{Equal, "a"}, {Delete, "b"}, {Equal, "c"}}},
+		{"multibyte", "héllo", "hallo", []Edit{{Equal, "h"}, {Delete, "é"}, {Insert, "a"}, {Equal, "llo"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Runes(tt.a, tt.b); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Runes(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLines(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		want []Edit
+	}{
+		{"both empty", "", "", nil},
+		{"identical", "a\nb\n", "a\nb\n", []Edit{{Equal, "a\nb\n"}}},
+		{"changed line", "a\nb\nc\n", "a\nx\nc\n", []Edit{{Equal, "a\n"}, {Delete, "b\n"}, {Insert, "x\n"}, {Equal, "c\n"}}},
+		{"no trailing newline", "a\nb", "a\nb\nc", []Edit{{Equal, "a\n"}, {Delete, "b"}, {Insert, "b\nc"}}},
+		{"disjoint", "a\nb\n", "c\nd\n", []Edit{{Delete, "a\nb\n"}, {Insert, "c\nd\n"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Lines(tt.a, tt.b); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Lines(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+			}
+		})
+	}
+}
+
+// The middle snake is found differently depending on whether the lengths
+// differ by an odd or an even number, so both must give shortest scripts
+func TestDelta(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+	}{
+		{"delta 0", "abcabba", "cbabacb"},
+		{"delta 1", "abcabba", "cbabac"},
+		{"delta 2", "abcabba", "cbaba"},
+		{"delta 3", "abcabba", "cbab"},
+		{"delta -1", "cbaba", "abcabb"},
+		{"delta -2", "cbaba", "abcabba"},
+		{"delta -3", "xaxbx", "aybyczyd"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			edits := Runes(tt.a, tt.b)
+			if got := rebuild(edits, Insert); got != tt.b {
+				t.Errorf("Equal and Insert give %q, want %q", got, tt.b)
+			}
+			if got := rebuild(edits, Delete); got != tt.a {
+				t.Errorf("Equal and Delete give %q, want %q", got, tt.a)
+			}
+			want := len([]rune(tt.a)) + len([]rune(tt.b)) - 2*lcs(tt.a, tt.b)
+			if got := changed(edits); got != want {
+				t.Errorf("changes %d characters, the shortest script changes %d", got, want)
+			}
+		})
+	}
+}
+
+func TestRebuildsBothSides(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	random := func() string {
+		alphabet := []rune("abcé\n")
+		s := make([]rune, r.Intn(40))
+		for i := range s {
+			s[i] = alphabet[r.Intn(len(alphabet))]
+		}
+		return string(s)
+	}
+
+	for i := 0; i < 1000; i++ {
+		a, b := random(), random()
+		for _, edits := range [][]Edit{Runes(a, b), Lines(a, b)} {
+			if got := rebuild(edits, Insert); got != b {
+				t.Fatalf("diff of %q and %q: Equal and Insert give %q", a, b, got)
+			}
+			if got := rebuild(edits, Delete); got != a {
+				t.Fatalf("diff of %q and %q: Equal and Delete give %q", a, b, got)
+			}
+			for j := 1; j < len(edits); j++ {
+				if edits[j].Kind == edits[j-1].Kind {
+					t.Fatalf("diff of %q and %q has two %s edits in a row", a, b, edits[j].Kind)
+				}
+			}
+		}
+
+		want := len([]rune(a)) + len([]rune(b)) - 2*lcs(a, b)
+		if got := changed(Runes(a, b)); got != want {
+			t.Fatalf("diff of %q and %q changes %d characters, the shortest script changes %d", a, b, got, want)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package document
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"collab-editor/internal/access"
+	"collab-editor/internal/db"
+	"collab-editor/internal/diff"
+)
+
+// BlameSpan is a run of the current text that was last changed in the same
+// version. Start and Length count characters. Unsaved spans were changed
+// after the latest saved version and have no version number yet.
+type BlameSpan struct {
+	Text      string      `json:"text"`
+	Start     int         `json:"start"`
+	Length    int         `json:"length"`
+	Version   int         `json:"version"`
+	Unsaved   bool        `json:"unsaved,omitempty"`
+	Authors   []db.Author `json:"authors"`
+	ChangedAt time.Time   `json:"changed_at"`
+}
+
+// Blame returns, for each span of the live text, who last changed it and
+// when. Changes not saved yet are credited to everyone who edited since the
+// latest saved version.
+func (h *DocumentHandler) Blame(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sessionCode := r.URL.Query().Get("session")
+	if sessionCode == "" {
+		http.Error(w, "Session code required", http.StatusBadRequest)
+		return
+	}
+
+	if _, _, ok := h.auth.Authorize(w, r, sessionCode, access.Role.CanView); !ok {
+		return
+	}
+
+	versions, err := h.db.GetVersionHistory(sessionCode)
+	if err != nil {
+		http.Error(w, "Failed to load versions", http.StatusInternalServerError)
+		return
+	}
+
+	content, editors := h.hub.Unsaved(sessionCode)
+	if len(versions) == 0 || versions[len(versions)-1].Content != content {
+		authors, err := h.db.AuthorsByID(editors)
+		if err != nil {
+			http.Error(w, "Failed to load authors", http.StatusInternalServerError)
+			return
+		}
+		// Saved versions always have an ID, which tells this one apart
+		versions = append(versions, db.Version{
+			Content:   content,
+			Authors:   authors,
+			CreatedAt: time.Now(),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(blame(versions))
+}
+
+// blame replays versions oldest first. Text kept by a diff keeps its
+// attribution and inserted text is attributed to the version adding it.
+func blame(versions []db.Version) []BlameSpan {
+	// origin[i] is the index into versions that last changed character i
+	var origin []int
+	previous := ""
+	for i, v := range versions {
+		next := make([]int, 0, v.Size)
+		pos := 0
+		for _, edit := range diff.Runes(previous, v.Content) {
+			n := len([]rune(edit.Text))
+			switch edit.Kind {
+			case diff.Equal:
+				next = append(next, origin[pos:pos+n]...)
+				pos += n
+			case diff.Delete:
+				pos += n
+			case diff.Insert:
+				for j := 0; j < n; j++ {
+					next = append(next, i)
+				}
+			}
+		}
+		origin = next
+		previous = v.Content
+	}
+
+	spans := []BlameSpan{}
+	text := []rune(previous)
+	for start := 0; start < len(text); {
+		end := start + 1
+		for end < len(text) && origin[end] == origin[start] {
+			end++
+		}
+
+		v := versions[origin[start]]
+		spans = append(spans, BlameSpan{
+			Text:      string(text[start:end]),
+			Start:     start,
+			Length:    end - start,
+			Version:   v.Version,
+			Unsaved:   v.ID == 0,
+			Authors:   v.Authors,
+			ChangedAt: v.CreatedAt,
+		})
+		start = end
+	}
+	return spans
+}
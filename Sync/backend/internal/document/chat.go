@@ -0,0 +1,76 @@
+package document
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"collab-editor/internal/access"
+	"collab-editor/internal/db"
+)
+
+const (
+	defaultChatPage = 50
+	maxChatPage     = 200
+)
+
+type ChatHistoryResponse struct {
+	Messages []db.ChatMessage `json:"messages"`
+	HasMore  bool             `json:"has_more"`
+}
+
+// ChatHistory pages back through a session's chat, oldest message of the
+// page first. Anyone with access can read it. before is the ID of the
+// oldest message the client already has, omitted for the latest page, and
+// limit the page size.
+func (h *DocumentHandler) ChatHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	sessionCode := query.Get("session")
+	if sessionCode == "" {
+		http.Error(w, "Session code required", http.StatusBadRequest)
+		return
+	}
+
+	before := 0
+	if s := query.Get("before"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			http.Error(w, "Invalid before", http.StatusBadRequest)
+			return
+		}
+		before = n
+	}
+	limit := defaultChatPage
+	if s := query.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 || n > maxChatPage {
+			http.Error(w, "Limit must be 1 to 200", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	if _, _, ok := h.auth.Authorize(w, r, sessionCode, access.Role.CanView); !ok {
+		return
+	}
+
+	// One extra tells whether there is another page
+	messages, err := h.db.ChatHistory(sessionCode, before, limit+1)
+	if err != nil {
+		http.Error(w, "Failed to load chat", http.StatusInternalServerError)
+		return
+	}
+	response := ChatHistoryResponse{Messages: messages}
+	if len(messages) > limit {
+		response.Messages = messages[1:]
+		response.HasMore = true
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -1,17 +1,23 @@
 package document
 
 import (
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"net/http"
-	"strings"
+	"strconv"
 
+	"collab-editor/internal/access"
 	"collab-editor/internal/auth"
 	"collab-editor/internal/db"
+	"collab-editor/internal/diff"
+	"collab-editor/internal/hub"
 )
 
 type DocumentHandler struct {
 	db   *db.Database
 	auth *auth.AuthHandler
+	hub  *hub.Hub
 }
 
 type SaveDocumentRequest struct {
@@ -19,10 +25,22 @@ type SaveDocumentRequest struct {
 	Content     string `json:"content"`
 }
 
-func NewDocumentHandler(database *db.Database, authHandler *auth.AuthHandler) *DocumentHandler {
+type RestoreVersionRequest struct {
+	SessionCode string `json:"session_code"`
+	Version     int    `json:"version"`
+}
+
+type DiffResponse struct {
+	From  int         `json:"from"`
+	To    int         `json:"to"`
+	Edits []diff.Edit `json:"edits"`
+}
+
+func NewDocumentHandler(database *db.Database, authHandler *auth.AuthHandler, h *hub.Hub) *DocumentHandler {
 	return &DocumentHandler{
 		db:   database,
 		auth: authHandler,
+		hub:  h,
 	}
 }
 
@@ -38,45 +56,168 @@ func (h *DocumentHandler) SaveDocument(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get token from Authorization header
-	authHeader := r.Header.Get("Authorization")
-	
 	var req SaveDocumentRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
 
-	if authHeader == "" {
-		// Allow anonymous saves
-		if err := h.db.SaveDocument(req.SessionCode, req.Content, nil); err != nil {
-			http.Error(w, "Failed to save document", http.StatusInternalServerError)
-			return
-		}
+	userID, _, ok := h.auth.Authorize(w, r, req.SessionCode, access.Role.CanEdit)
+	if !ok {
+		return
+	}
+	if userID == 0 {
+		http.Error(w, "Login required", http.StatusUnauthorized)
+		return
+	}
 
-		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(map[string]string{"status": "saved", "type": "anonymous"})
+	// Edit through the hub like a client would, so connected clients get
+	// the change and the live text does not overwrite it on the next save
+	h.hub.ReplaceContent(req.SessionCode, req.Content, userID)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "saved", 
+		"user_id": userID,
+		"type": "authenticated",
+	})
+}
+
+// ListVersions returns the saved versions of a session without their content
+func (h *DocumentHandler) ListVersions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sessionCode := r.URL.Query().Get("session")
+	if sessionCode == "" {
+		http.Error(w, "Session code required", http.StatusBadRequest)
+		return
+	}
+
+	if _, _, ok := h.auth.Authorize(w, r, sessionCode, access.Role.CanView); !ok {
 		return
 	}
 
-	// Authenticated save
-	tokenString := strings.TrimPrefix(authHeader, "Bearer ")
-	userID, err := h.auth.ValidateToken(tokenString)
+	versions, err := h.db.ListVersions(sessionCode)
 	if err != nil {
-		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		http.Error(w, "Failed to list versions", http.StatusInternalServerError)
 		return
 	}
 
-	// Save with user ID
-	if err := h.db.SaveDocument(req.SessionCode, req.Content, &userID); err != nil {
-		http.Error(w, "Failed to save document", http.StatusInternalServerError)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(versions)
+}
+
+// GetVersion returns a single version including its content
+func (h *DocumentHandler) GetVersion(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
+	sessionCode := r.URL.Query().Get("session")
+	number, err := strconv.Atoi(r.URL.Query().Get("version"))
+	if sessionCode == "" || err != nil {
+		http.Error(w, "Session code and version required", http.StatusBadRequest)
+		return
+	}
+
+	if _, _, ok := h.auth.Authorize(w, r, sessionCode, access.Role.CanView); !ok {
+		return
+	}
+
+	version, ok := h.loadVersion(w, sessionCode, number)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(version)
+}
+
+// DiffVersions compares two versions line by line
+func (h *DocumentHandler) DiffVersions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sessionCode := r.URL.Query().Get("session")
+	from, fromErr := strconv.Atoi(r.URL.Query().Get("from"))
+	to, toErr := strconv.Atoi(r.URL.Query().Get("to"))
+	if sessionCode == "" || fromErr != nil || toErr != nil {
+		http.Error(w, "Session code, from and to versions required", http.StatusBadRequest)
+		return
+	}
+
+	if _, _, ok := h.auth.Authorize(w, r, sessionCode, access.Role.CanView); !ok {
+		return
+	}
+
+	fromVersion, ok := h.loadVersion(w, sessionCode, from)
+	if !ok {
+		return
+	}
+	toVersion, ok := h.loadVersion(w, sessionCode, to)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(DiffResponse{
+		From:  from,
+		To:    to,
+		Edits: diff.Lines(fromVersion.Content, toVersion.Content),
+	})
+}
+
+// RestoreVersion makes an old version the current content. Connected
+// clients receive the change like any other edit and the hub saves it as a
+// new version.
+func (h *DocumentHandler) RestoreVersion(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req RestoreVersionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.SessionCode == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	// Credit the restore to the caller if they are logged in
+	userID, _, ok := h.auth.Authorize(w, r, req.SessionCode, access.Role.CanEdit)
+	if !ok {
+		return
+	}
+
+	version, ok := h.loadVersion(w, req.SessionCode, req.Version)
+	if !ok {
+		return
+	}
+
+	h.hub.ReplaceContent(req.SessionCode, version.Content, userID)
+
+	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"status": "saved", 
-		"user_id": userID,
-		"type": "authenticated",
+		"status":  "restored",
+		"version": req.Version,
 	})
-}
\ No newline at end of file
+}
+
+// loadVersion fetches a version and writes the error response if it fails
+func (h *DocumentHandler) loadVersion(w http.ResponseWriter, sessionCode string, number int) (*db.Version, bool) {
+	version, err := h.db.GetVersion(sessionCode, number)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Version not found", http.StatusNotFound)
+		return nil, false
+	}
+	if err != nil {
+		http.Error(w, "Failed to get version", http.StatusInternalServerError)
+		return nil, false
+	}
+	return version, true
+}
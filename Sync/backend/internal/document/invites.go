@@ -0,0 +1,148 @@
+package document
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"collab-editor/internal/access"
+	"collab-editor/internal/db"
+)
+
+const (
+	defaultInviteTTL = 7 * 24 * time.Hour
+	maxInviteTTL     = 30 * 24 * time.Hour
+)
+
+// CreateInviteRequest asks for a new invite link. ExpiresIn is in seconds
+// and MaxUses of zero means unlimited.
+type CreateInviteRequest struct {
+	SessionCode string `json:"session_code"`
+	Role        string `json:"role"`
+	ExpiresIn   int    `json:"expires_in"`
+	MaxUses     int    `json:"max_uses"`
+}
+
+type InviteResponse struct {
+	Invite *db.Invite `json:"invite"`
+	Token  string     `json:"token"`
+}
+
+// Invites lets the owner of a session list (GET), create (POST) and revoke
+// (DELETE) invite links. A link is the editor URL with the token in its
+// invite parameter.
+func (h *DocumentHandler) Invites(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		h.listInvites(w, r)
+	case http.MethodPost:
+		h.createInvite(w, r)
+	case http.MethodDelete:
+		h.revokeInvite(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *DocumentHandler) listInvites(w http.ResponseWriter, r *http.Request) {
+	sessionCode := r.URL.Query().Get("session")
+	if sessionCode == "" {
+		http.Error(w, "Session code required", http.StatusBadRequest)
+		return
+	}
+
+	if _, _, ok := h.auth.Authorize(w, r, sessionCode, access.Role.CanManage); !ok {
+		return
+	}
+
+	invites, err := h.db.ListInvites(sessionCode)
+	if err != nil {
+		http.Error(w, "Failed to list invites", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(invites)
+}
+
+func (h *DocumentHandler) createInvite(w http.ResponseWriter, r *http.Request) {
+	var req CreateInviteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.SessionCode == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	role, valid := access.Parse(req.Role)
+	if !valid {
+		http.Error(w, "Role must be editor, commenter or viewer", http.StatusBadRequest)
+		return
+	}
+	if req.ExpiresIn < 0 || req.MaxUses < 0 {
+		http.Error(w, "Expiry and max uses cannot be negative", http.StatusBadRequest)
+		return
+	}
+
+	ttl := time.Duration(req.ExpiresIn) * time.Second
+	if ttl == 0 {
+		ttl = defaultInviteTTL
+	}
+	if ttl > maxInviteTTL {
+		http.Error(w, "Invites expire after at most 30 days", http.StatusBadRequest)
+		return
+	}
+
+	ownerID, _, ok := h.auth.Authorize(w, r, req.SessionCode, access.Role.CanManage)
+	if !ok {
+		return
+	}
+
+	invite, err := h.db.CreateInvite(req.SessionCode, ownerID, role, ttl, req.MaxUses)
+	if err != nil {
+		log.Printf("Failed to create invite to session %s: %v", req.SessionCode, err)
+		http.Error(w, "Failed to create invite", http.StatusInternalServerError)
+		return
+	}
+
+	token, err := h.auth.InviteToken(invite, req.SessionCode)
+	if err != nil {
+		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(InviteResponse{
+		Invite: invite,
+		Token:  token,
+	})
+}
+
+func (h *DocumentHandler) revokeInvite(w http.ResponseWriter, r *http.Request) {
+	sessionCode := r.URL.Query().Get("session")
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if sessionCode == "" || err != nil {
+		http.Error(w, "Session code and invite id required", http.StatusBadRequest)
+		return
+	}
+
+	if _, _, ok := h.auth.Authorize(w, r, sessionCode, access.Role.CanManage); !ok {
+		return
+	}
+
+	revoked, err := h.db.RevokeInvite(sessionCode, id)
+	if err != nil {
+		http.Error(w, "Failed to revoke invite", http.StatusInternalServerError)
+		return
+	}
+	if !revoked {
+		http.Error(w, "Invite not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "revoked",
+		"id":     id,
+	})
+}
@@ -0,0 +1,131 @@
+package document
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"collab-editor/internal/access"
+)
+
+type MemberRequest struct {
+	SessionCode string `json:"session_code"`
+	Username    string `json:"username"`
+	Role        string `json:"role"`
+}
+
+// Members manages who has access to a session. Anyone with access can list
+// the members; only the owner can grant, change (POST) or revoke (DELETE)
+// roles. Revoked users are disconnected right away.
+func (h *DocumentHandler) Members(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		h.listMembers(w, r)
+	case http.MethodPost:
+		h.grantMember(w, r)
+	case http.MethodDelete:
+		h.revokeMember(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *DocumentHandler) listMembers(w http.ResponseWriter, r *http.Request) {
+	sessionCode := r.URL.Query().Get("session")
+	if sessionCode == "" {
+		http.Error(w, "Session code required", http.StatusBadRequest)
+		return
+	}
+
+	if _, _, ok := h.auth.Authorize(w, r, sessionCode, access.Role.CanView); !ok {
+		return
+	}
+
+	members, err := h.db.ListMembers(sessionCode)
+	if err != nil {
+		http.Error(w, "Failed to list members", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(members)
+}
+
+func (h *DocumentHandler) grantMember(w http.ResponseWriter, r *http.Request) {
+	var req MemberRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.SessionCode == "" || req.Username == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	role, valid := access.Parse(req.Role)
+	if !valid {
+		http.Error(w, "Role must be editor, commenter or viewer", http.StatusBadRequest)
+		return
+	}
+
+	ownerID, _, ok := h.auth.Authorize(w, r, req.SessionCode, access.Role.CanManage)
+	if !ok {
+		return
+	}
+
+	user, err := h.db.GetUserByUsername(req.Username)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if user.ID == ownerID {
+		http.Error(w, "The owner's role cannot be changed", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.db.SetMemberRole(req.SessionCode, user.ID, role); err != nil {
+		log.Printf("Failed to grant %s to %s: %v", role, req.Username, err)
+		http.Error(w, "Failed to grant role", http.StatusInternalServerError)
+		return
+	}
+	h.hub.SetRole(req.SessionCode, user.ID, role)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":   "granted",
+		"username": user.Username,
+		"role":     role,
+	})
+}
+
+func (h *DocumentHandler) revokeMember(w http.ResponseWriter, r *http.Request) {
+	sessionCode := r.URL.Query().Get("session")
+	username := r.URL.Query().Get("username")
+	if sessionCode == "" || username == "" {
+		http.Error(w, "Session code and username required", http.StatusBadRequest)
+		return
+	}
+
+	if _, _, ok := h.auth.Authorize(w, r, sessionCode, access.Role.CanManage); !ok {
+		return
+	}
+
+	user, err := h.db.GetUserByUsername(username)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	removed, err := h.db.RemoveMember(sessionCode, user.ID)
+	if err != nil {
+		http.Error(w, "Failed to revoke role", http.StatusInternalServerError)
+		return
+	}
+	if !removed {
+		http.Error(w, "User is not a member of this session", http.StatusNotFound)
+		return
+	}
+	h.hub.SetRole(sessionCode, user.ID, access.None)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"status":   "revoked",
+		"username": user.Username,
+	})
+}
@@ -5,21 +5,29 @@ import (
 	"bytes"
 	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
+	"collab-editor/internal/access"
+	"collab-editor/internal/auth"
 	"collab-editor/internal/db"
+	"collab-editor/internal/hub"
 
 	"github.com/jung-kurt/gofpdf"
 )
 
 type ExportHandler struct {
-	db *db.Database
+	db   *db.Database
+	auth *auth.AuthHandler
+	hub  *hub.Hub
 }
 
-func NewExportHandler(database *db.Database) *ExportHandler {
+func NewExportHandler(database *db.Database, authHandler *auth.AuthHandler, h *hub.Hub) *ExportHandler {
 	return &ExportHandler{
-		db: database,
+		db:   database,
+		auth: authHandler,
+		hub:  h,
 	}
 }
 
@@ -38,23 +46,34 @@ func (h *ExportHandler) ExportDocument(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get session content from database
-	session, err := h.db.GetOrCreateSession(sessionCode)
-	if err != nil {
-		http.Error(w, "Failed to get session", http.StatusInternalServerError)
+	// Downloads are plain links, so the token may come in the query string
+	if _, _, ok := h.auth.Authorize(w, r, sessionCode, access.Role.CanView); !ok {
 		return
 	}
 
+	// Export what users see right now, which may not be saved yet. Pending
+	// suggestions are left out unless asked for.
+	var content string
+	if r.URL.Query().Get("suggestions") == "include" {
+		var skipped int
+		content, skipped = h.hub.ContentWithSuggestions(sessionCode)
+		if skipped > 0 {
+			w.Header().Set("X-Skipped-Suggestions", strconv.Itoa(skipped))
+		}
+	} else {
+		content = h.hub.Content(sessionCode)
+	}
+
 	// Generate filename
 	filename := fmt.Sprintf("document-%s-%s", sessionCode, time.Now().Format("20060102-150405"))
 
 	switch format {
 	case "txt":
-		h.exportTXT(w, session.Content, filename)
+		h.exportTXT(w, content, filename)
 	case "pdf":
-		h.exportPDF(w, session.Content, filename)
+		h.exportPDF(w, content, filename)
 	case "docx":
-		h.exportDOCX(w, session.Content, filename)
+		h.exportDOCX(w, content, filename)
 	default:
 		http.Error(w, "Invalid format. Supported formats: txt, pdf, docx", http.StatusBadRequest)
 	}
@@ -0,0 +1,170 @@
+package hub
+
+import (
+	"errors"
+	"log"
+
+	"collab-editor/internal/access"
+	"collab-editor/internal/bus"
+	"collab-editor/internal/message"
+
+	"github.com/gorilla/websocket"
+)
+
+// Close code for connections whose login ended. Clients should not
+// reconnect with the same token.
+const closeLoggedOut = 4001
+
+// Close code for connections to a session or publication that was deleted
+const closeDeleted = 4004
+
+var errInviteSession = errors.New("invite is for another session")
+
+// acceptInvite checks an invite link to sessionCode and returns the role the
+// user ends up with. Signed-in users become members so they keep access
+// without the link; guests get a pass to reconnect with instead. Users who
+// already hold the invited role or better do not use the invite up.
+func (h *Hub) acceptInvite(sessionCode, token string, dbUserID int, current access.Role) (access.Role, string, error) {
+	claims, err := h.auth.ValidateInvite(token)
+	if err != nil {
+		return current, "", err
+	}
+	if claims.SessionCode != sessionCode {
+		return current, "", errInviteSession
+	}
+	if current.AtLeast(claims.Role) {
+		return current, "", nil
+	}
+
+	role, err := h.db.UseInvite(sessionCode, claims.InviteID)
+	if err != nil {
+		return current, "", err
+	}
+
+	var pass string
+	if dbUserID > 0 {
+		if err := h.db.SetMemberRole(sessionCode, dbUserID, role); err != nil {
+			log.Printf("Failed to add invited user %d to session %s: %v", dbUserID, sessionCode, err)
+		}
+	} else {
+		claims.Role = role
+		if pass, err = h.auth.GuestPass(claims); err != nil {
+			log.Printf("Failed to issue guest pass for invite %d: %v", claims.InviteID, err)
+		}
+	}
+	log.Printf("Invite %d to session %s accepted as %s", claims.InviteID, sessionCode, role)
+	return role, pass, nil
+}
+
+// acceptGuestPass returns the role a guest pass grants in sessionCode, or
+// current if the pass is not valid there or its invite was revoked or has
+// expired. It does not use the invite up, the guest did that the first time.
+func (h *Hub) acceptGuestPass(sessionCode, token string, current access.Role) access.Role {
+	claims, err := h.auth.ValidateGuestPass(token)
+	if err != nil || claims.SessionCode != sessionCode || current.AtLeast(claims.Role) {
+		return current
+	}
+
+	active, err := h.db.InviteActive(sessionCode, claims.InviteID)
+	if err != nil {
+		log.Printf("Failed to check invite %d to session %s: %v", claims.InviteID, sessionCode, err)
+		return current
+	}
+	if !active {
+		return current
+	}
+	return claims.Role
+}
+
+// SetRole applies a changed role to the connections a user already has open
+// in a session, on this node and every other. A role of access.None
+// disconnects them.
+func (h *Hub) SetRole(sessionCode string, dbUserID int, role access.Role) {
+	err := h.bus.Publish(bus.Event{
+		Session: sessionCode,
+		Kind:    bus.KindRole,
+		Author:  dbUserID,
+		Message: message.Message{Type: "role", Role: string(role)},
+	})
+	if err != nil {
+		log.Printf("Failed to publish role change for session %s: %v", sessionCode, err)
+	}
+
+	h.mutex.RLock()
+	session, ok := h.sessions[sessionCode]
+	h.mutex.RUnlock()
+	if ok {
+		session.do(func() { session.applyRole(dbUserID, role) })
+	}
+}
+
+// applyRole updates or disconnects the local clients of a database user
+func (s *Session) applyRole(dbUserID int, role access.Role) {
+	for c := range s.clients {
+		if c.DBUserID != dbUserID {
+			continue
+		}
+
+		if !role.CanView() {
+			log.Printf("Access of user %d to session %s revoked, disconnecting %s", dbUserID, s.sessionCode, c.UserID)
+			select {
+			case c.Send <- message.Message{Type: "role", UserID: c.UserID}:
+			default:
+			}
+			c.SetCloseReason(websocket.ClosePolicyViolation, "access revoked")
+			s.remove(c)
+			continue
+		}
+
+		c.SetRole(role)
+		s.deliver(c, message.Message{
+			Type:   "role",
+			UserID: c.UserID,
+			Role:   string(c.Role()),
+		})
+	}
+}
+
+// Disconnect closes the websockets opened with a login of a database user,
+// on this node and every other. An empty loginID closes all of the user's
+// websockets.
+func (h *Hub) Disconnect(dbUserID int, loginID string) {
+	err := h.bus.Publish(bus.Event{
+		Kind:    bus.KindLogout,
+		Author:  dbUserID,
+		Message: message.Message{Type: "logout", Content: loginID},
+	})
+	if err != nil {
+		log.Printf("Failed to publish logout of user %d: %v", dbUserID, err)
+	}
+	h.disconnect(dbUserID, loginID)
+}
+
+func (h *Hub) disconnect(dbUserID int, loginID string) {
+	h.mutex.RLock()
+	sessions := make([]*Session, 0, len(h.sessions))
+	for _, s := range h.sessions {
+		sessions = append(sessions, s)
+	}
+	h.mutex.RUnlock()
+
+	for _, s := range sessions {
+		s.do(func() { s.disconnectLogin(dbUserID, loginID) })
+	}
+}
+
+func (s *Session) disconnectLogin(dbUserID int, loginID string) {
+	for c := range s.clients {
+		if c.DBUserID != dbUserID || (loginID != "" && c.LoginID != loginID) {
+			continue
+		}
+
+		log.Printf("Login of user %d ended, disconnecting %s from session %s", dbUserID, c.UserID, s.sessionCode)
+		select {
+		case c.Send <- message.Message{Type: "loggedOut", UserID: c.UserID}:
+		default:
+		}
+		c.SetCloseReason(closeLoggedOut, "logged out")
+		s.remove(c)
+	}
+}
@@ -0,0 +1,151 @@
+package hub
+
+import (
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"collab-editor/internal/db"
+	"collab-editor/internal/message"
+	"collab-editor/internal/ot"
+)
+
+// Comment threads, suggestions and presence are anchored to ranges of the
+// text. Every node moves the anchors through each edit it applies or
+// replays, and the owner saves those of threads and suggestions along with
+// the document.
+
+// rangeAt moves a range a client selected at revision onto the current
+// text. Clients also send the text they selected; if it is not where the
+// positions say, because the client still had edits in flight, the nearest
+// copy of it is used instead. Callers hold s.mutex.
+func (s *Session) rangeAt(revision, start, end int, selected string) (int, int) {
+	text := s.engine.Content()
+	length := ot.Length(text)
+	start = clamp(s.engine.Rebase(revision, start, true), 0, length)
+	end = clamp(s.engine.Rebase(revision, end, false), start, length)
+
+	if selected != "" && slice(text, start, end) != selected {
+		if i, ok := nearest(text, selected, start); ok {
+			start, end = i, i+ot.Length(selected)
+		}
+	}
+	return start, end
+}
+
+// slice returns the text between two UTF-16 positions
+func slice(text string, start, end int) string {
+	units := utf16.Encode([]rune(text))
+	return string(utf16.Decode(units[start:end]))
+}
+
+// nearest finds the copy of quote in text that starts closest to near.
+// Positions are in UTF-16 code units.
+func nearest(text, quote string, near int) (int, bool) {
+	best, found := 0, false
+	from, pos := 0, 0 // byte offset searched from and its UTF-16 position
+	for {
+		i := strings.Index(text[from:], quote)
+		if i < 0 {
+			break
+		}
+		pos += ot.Length(text[from : from+i])
+		from += i
+		if !found || abs(pos-near) < abs(best-near) {
+			best, found = pos, true
+		} else {
+			// Copies only get further away from here on
+			break
+		}
+
+		_, size := utf8.DecodeRuneInString(text[from:])
+		pos += ot.Length(text[from : from+size])
+		from += size
+	}
+	return best, found
+}
+
+// textBefore returns the text an edit is about to change, for moving the
+// anchors along afterwards. It is only needed when there are anchors.
+// Callers hold s.mutex.
+func (s *Session) textBefore() string {
+	if len(s.threads) == 0 && len(s.suggestions) == 0 && len(s.presence) == 0 {
+		return ""
+	}
+	return s.engine.Content()
+}
+
+// shiftAnchors moves the anchors through an edit the engine has just
+// applied. Edits that are not ot operations are turned into one by diffing
+// before, the text from before the edit. Callers hold s.mutex.
+func (s *Session) shiftAnchors(before string, change message.Message) {
+	if len(s.threads) == 0 && len(s.suggestions) == 0 && len(s.presence) == 0 {
+		return
+	}
+
+	op := change.Operation
+	if op == nil {
+		diff := ot.FromDiff(before, s.engine.Content())
+		op = &diff
+	}
+	for _, t := range s.threads {
+		t.Start, t.End = shiftRange(op, t.Start, t.End)
+	}
+	for _, sg := range s.suggestions {
+		sg.Start, sg.End = shiftRange(op, sg.Start, sg.End)
+	}
+	// Carets are pushed along by text typed at them, as in the editor
+	for id, p := range s.presence {
+		for i, r := range p.Ranges {
+			p.Ranges[i] = message.Range{
+				Anchor: op.TransformIndex(r.Anchor, true),
+				Head:   op.TransformIndex(r.Head, true),
+			}
+		}
+		if p.Viewport != nil {
+			top := op.TransformIndex(*p.Viewport, true)
+			p.Viewport = &top
+			s.presence[id] = p
+		}
+	}
+}
+
+// shiftRange moves a range through op. Text inserted at either edge stays
+// outside of it.
+func shiftRange(op *ot.Operation, start, end int) (int, int) {
+	start = op.TransformIndex(start, true)
+	return start, max(op.TransformIndex(end, false), start)
+}
+
+// threadAnchors and suggestionAnchors return where everything is now, for
+// saving
+func (s *Session) threadAnchors() []db.Anchor {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	anchors := make([]db.Anchor, 0, len(s.threads))
+	for _, t := range s.threads {
+		anchors = append(anchors, db.Anchor{ID: t.ID, Start: t.Start, End: t.End})
+	}
+	return anchors
+}
+
+func (s *Session) suggestionAnchors() []db.Anchor {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	anchors := make([]db.Anchor, 0, len(s.suggestions))
+	for _, sg := range s.suggestions {
+		anchors = append(anchors, db.Anchor{ID: sg.ID, Start: sg.Start, End: sg.End})
+	}
+	return anchors
+}
+
+func clamp(v, lo, hi int) int {
+	return max(lo, min(v, hi))
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
@@ -0,0 +1,105 @@
+package hub
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"collab-editor/internal/bus"
+	"collab-editor/internal/client"
+	"collab-editor/internal/db"
+	"collab-editor/internal/message"
+)
+
+const (
+	maxChatLength = 2000
+	// chatBacklog is how many of the latest chat messages clients get
+	// with init
+	chatBacklog = 50
+	// maxMentions bounds the @mentions looked up per message
+	maxMentions = 20
+)
+
+// loadChat reads the latest chat messages of a session being opened
+func loadChat(database *db.Database, sessionCode string) []db.ChatMessage {
+	chat, err := database.ChatHistory(sessionCode, 0, chatBacklog)
+	if err != nil {
+		log.Printf("Failed to load chat of session %s: %v", sessionCode, err)
+		return nil
+	}
+	return chat
+}
+
+// handleChat saves a chat message from a signed-in client and announces it
+// to everyone, along with the members it mentions
+func (s *Session) handleChat(sender *client.Client, msg message.Message) {
+	author := sender.DBUserID
+	if author == 0 {
+		s.refuse(sender, "Sign in to chat")
+		return
+	}
+
+	body := strings.TrimSpace(msg.Content)
+	if body == "" || utf8.RuneCountInString(body) > maxChatLength {
+		s.refuse(sender, "Chat messages must be 1 to 2000 characters")
+		return
+	}
+
+	members, err := s.db.MembersNamed(s.sessionCode, mentioned(body))
+	if err != nil {
+		// Still worth saying, just without notifying anyone
+		log.Printf("Failed to look up mentions in session %s: %v", s.sessionCode, err)
+	}
+	mentions := make([]int, 0, len(members))
+	for _, id := range members {
+		mentions = append(mentions, id)
+	}
+	sort.Ints(mentions)
+
+	saved, err := s.db.CreateChatMessage(s.sessionCode, author, body, mentions)
+	if err != nil {
+		log.Printf("Failed to save chat message in session %s: %v", s.sessionCode, err)
+		s.refuse(sender, "Failed to send message")
+		return
+	}
+	s.addChat(*saved)
+
+	announce := message.Message{Type: "chat", Chat: saved}
+	s.publish(bus.KindBroadcast, "", announce)
+	for c := range s.clients {
+		s.deliver(c, announce)
+	}
+}
+
+// mentioned returns the usernames @mentioned in body, without duplicates.
+// Punctuation after a name, as in "thanks @ana!", is not part of it.
+func mentioned(body string) []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, word := range strings.Fields(body) {
+		if !strings.HasPrefix(word, "@") {
+			continue
+		}
+		name := strings.TrimRight(word[1:], ".,;:!?)'\"")
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+		if len(names) == maxMentions {
+			break
+		}
+	}
+	return names
+}
+
+// addChat keeps a chat message among the latest ones sent with init
+func (s *Session) addChat(m db.ChatMessage) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.chat = append(s.chat, m)
+	if len(s.chat) > chatBacklog {
+		s.chat = append([]db.ChatMessage(nil), s.chat[len(s.chat)-chatBacklog:]...)
+	}
+}
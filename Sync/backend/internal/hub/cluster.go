@@ -0,0 +1,228 @@
+package hub
+
+import (
+	"log"
+	"time"
+
+	"collab-editor/internal/access"
+	"collab-editor/internal/bus"
+	"collab-editor/internal/db"
+	"collab-editor/internal/message"
+)
+
+// How often a session checks that it still owns, or can take over, its
+// document on the bus
+const ownershipInterval = 5 * time.Second
+
+func (h *Hub) SetBus(b bus.Bus) {
+	h.bus = b
+	b.Subscribe(h.handleEvent)
+}
+
+// handleEvent passes an event from another node to the local session it is
+// about. Sessions nobody on this node has open are ignored.
+func (h *Hub) handleEvent(ev bus.Event) {
+	if ev.Kind == bus.KindLogout {
+		h.disconnect(ev.Author, ev.Message.Content)
+		return
+	}
+	if ev.Kind == bus.KindDeleted {
+		h.closeSession(ev.Session)
+		return
+	}
+
+	h.mutex.RLock()
+	session, ok := h.sessions[ev.Session]
+	h.mutex.RUnlock()
+
+	if ok {
+		select {
+		case session.remote <- ev:
+		case <-session.done:
+		}
+	}
+}
+
+func (s *Session) publish(kind, target string, msg message.Message) {
+	err := s.bus.Publish(bus.Event{
+		Session: s.sessionCode,
+		Kind:    kind,
+		Target:  target,
+		Message: msg,
+	})
+	if err != nil {
+		log.Printf("Failed to publish %s event for session %s: %v", kind, s.sessionCode, err)
+	}
+}
+
+// checkOwnership confirms this node still owns the session, or takes it over
+// when the previous owner has gone away.
+func (s *Session) checkOwnership() {
+	owned, err := s.bus.Acquire(s.sessionCode)
+	if err != nil {
+		log.Printf("Failed to check ownership of session %s: %v", s.sessionCode, err)
+		return
+	}
+
+	switch {
+	case owned && !s.owner:
+		log.Printf("Took over ownership of session %s at revision %d", s.sessionCode, s.engine.Revision())
+		s.owner = true
+	case !owned && s.owner:
+		log.Printf("Lost ownership of session %s", s.sessionCode)
+		s.owner = false
+		s.publish(bus.KindSyncRequest, "", message.Message{})
+	}
+}
+
+// initMessage builds the full document state as sent to new clients
+func (s *Session) initMessage(msgType string) message.Message {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	msg := message.Message{
+		Type:     msgType,
+		Content:  s.engine.Content(),
+		Revision: s.engine.Revision(),
+	}
+	s.engine.Init(&msg)
+	msg.Threads = s.threadList()
+	msg.Suggestions = s.suggestionList()
+	msg.ChatHistory = append([]db.ChatMessage(nil), s.chat...)
+	msg.Presences = s.presenceList()
+	msg.Follows = s.trackingList()
+	return msg
+}
+
+// handleRemote processes an event published by another node
+func (s *Session) handleRemote(ev bus.Event) {
+	switch ev.Kind {
+	case bus.KindBroadcast:
+		switch ev.Message.Type {
+		case "userJoined":
+			s.remoteUsers[ev.Message.UserID] = ev.Message
+		case "userLeft":
+			delete(s.remoteUsers, ev.Message.UserID)
+			s.forgetPresence(ev.Message.UserID)
+		case "presence":
+			if ev.Message.Presence == nil {
+				return
+			}
+			ev.Message = s.setPresence(ev.Message)
+		case "follow":
+			s.setTracking(ev.Message.UserID, ev.Message.Target)
+		case "thread":
+			if ev.Message.Thread == nil {
+				return
+			}
+			ev.Message.Thread = s.mergeThread(*ev.Message.Thread, ev.Message.Revision)
+		case "suggestions":
+			ev.Message.Suggestions = s.mergeSuggestions(ev.Message.Suggestions, ev.Message.Revision)
+		case "chat":
+			if ev.Message.Chat == nil {
+				return
+			}
+			s.addChat(*ev.Message.Chat)
+		}
+		for c := range s.clients {
+			s.deliver(c, ev.Message)
+		}
+
+	case bus.KindEdit:
+		if s.owner {
+			s.applyEdit(nil, ev.Message, ev.Authors...)
+		}
+
+	case bus.KindApplied:
+		if ev.Message.Type != "ack" {
+			s.mutex.Lock()
+			before := s.textBefore()
+			err := s.engine.Replay(ev.Message)
+			if err == nil {
+				s.shiftAnchors(before, ev.Message)
+			}
+			s.mutex.Unlock()
+			if err != nil {
+				log.Printf("Replica of session %s is out of date, requesting sync: %v", s.sessionCode, err)
+				s.publish(bus.KindSyncRequest, "", message.Message{})
+				return
+			}
+			s.updateFollowers(ev.Message)
+		}
+		if ev.Message.Seq > 0 {
+			s.lastSeq[ev.Target] = ev.Message.Seq
+		}
+
+		forward := ev.Message
+		forward.Seq = 0
+		for c := range s.clients {
+			if c.UserID == ev.Target {
+				s.deliver(c, message.Message{
+					Type:     "ack",
+					UserID:   c.UserID,
+					Revision: ev.Message.Revision,
+					Seq:      ev.Message.Seq,
+				})
+			} else if ev.Message.Type != "ack" {
+				s.deliver(c, forward)
+			}
+		}
+
+	case bus.KindRejected:
+		for c := range s.clients {
+			if c.UserID == ev.Target {
+				resync := ev.Message
+				resync.UserID = c.UserID
+				s.deliver(c, resync)
+			}
+		}
+
+	case bus.KindSyncRequest:
+		if s.owner {
+			s.publish(bus.KindSync, "", s.initMessage("sync"))
+		}
+
+	case bus.KindRole:
+		s.applyRole(ev.Author, access.Role(ev.Message.Role))
+
+	case bus.KindUnpublished:
+		s.dropFollowers(ev.Target)
+
+	case bus.KindSync:
+		if s.owner {
+			return
+		}
+		engine, err := engineFromSync(ev.Message)
+		if err != nil {
+			log.Printf("Failed to sync session %s: %v", s.sessionCode, err)
+			return
+		}
+		s.mutex.Lock()
+		before := s.textBefore()
+		s.engine = engine
+		s.shiftAnchors(before, message.Message{})
+		if ev.Message.Threads != nil {
+			s.setThreads(ev.Message.Threads)
+		}
+		if ev.Message.Suggestions != nil {
+			s.setSuggestions(ev.Message.Suggestions)
+		}
+		if ev.Message.ChatHistory != nil {
+			s.chat = ev.Message.ChatHistory
+		}
+		if ev.Message.Presences != nil {
+			s.presence = ev.Message.Presences
+		}
+		if ev.Message.Follows != nil {
+			s.tracking = ev.Message.Follows
+		}
+		s.mutex.Unlock()
+
+		// Clients may have been served an outdated copy, bring them up to date
+		for c := range s.clients {
+			resync := s.initMessage("resync")
+			resync.UserID = c.UserID
+			s.deliver(c, resync)
+		}
+		s.updateFollowers(message.Message{Type: "sync"})
+	}
+}
@@ -0,0 +1,201 @@
+package hub
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"collab-editor/internal/bus"
+	"collab-editor/internal/client"
+	"collab-editor/internal/db"
+	"collab-editor/internal/message"
+	"collab-editor/internal/ot"
+)
+
+const (
+	maxCommentLength = 5000
+	// maxQuoteLength bounds the text kept with a thread, in characters
+	maxQuoteLength = 500
+)
+
+// loadThreads reads the comment threads of a session being opened
+func loadThreads(database *db.Database, sessionCode string) map[int]*db.CommentThread {
+	threads := make(map[int]*db.CommentThread)
+	list, err := database.CommentThreads(sessionCode)
+	if err != nil {
+		log.Printf("Failed to load comments of session %s: %v", sessionCode, err)
+		return threads
+	}
+	for i := range list {
+		threads[list[i].ID] = &list[i]
+	}
+	return threads
+}
+
+// handleComment starts, answers, resolves or reopens a thread for a
+// signed-in client and announces the result. The change is stored before
+// it is announced, so nobody sees a comment that was not saved.
+func (s *Session) handleComment(sender *client.Client, msg message.Message) {
+	author := sender.DBUserID
+	if author == 0 {
+		s.refuse(sender, "Sign in to comment")
+		return
+	}
+
+	body := strings.TrimSpace(msg.Content)
+	if msg.Type == "comment" || msg.Type == "reply" {
+		if body == "" || utf8.RuneCountInString(body) > maxCommentLength {
+			s.refuse(sender, "Comments must be 1 to 5000 characters")
+			return
+		}
+	}
+
+	var thread db.CommentThread
+	switch msg.Type {
+	case "comment":
+		if msg.Thread == nil {
+			s.refuse(sender, "Select the text to comment on")
+			return
+		}
+		start, end, quote := s.anchorAt(msg.Revision, *msg.Thread)
+		created, err := s.db.CreateCommentThread(s.sessionCode, author, start, end, quote, body)
+		if err != nil {
+			log.Printf("Failed to save comment in session %s: %v", s.sessionCode, err)
+			s.refuse(sender, "Failed to save comment")
+			return
+		}
+		s.mutex.Lock()
+		s.threads[created.ID] = created
+		thread = *created
+		s.mutex.Unlock()
+
+	case "reply":
+		comment, err := s.db.AddComment(s.sessionCode, msg.ThreadID, author, body)
+		if errors.Is(err, sql.ErrNoRows) {
+			s.refuse(sender, "Comment thread not found")
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to save reply in session %s: %v", s.sessionCode, err)
+			s.refuse(sender, "Failed to save comment")
+			return
+		}
+		s.mutex.Lock()
+		t, ok := s.threads[msg.ThreadID]
+		if ok {
+			t.Comments = append(t.Comments, *comment)
+			thread = *t
+		}
+		s.mutex.Unlock()
+		if !ok {
+			// Started on another node that has not told us yet
+			return
+		}
+
+	case "resolve", "reopen":
+		resolvedAt, err := s.db.ResolveThread(s.sessionCode, msg.ThreadID, author, msg.Type == "resolve")
+		if errors.Is(err, sql.ErrNoRows) {
+			s.refuse(sender, "Comment thread not found")
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to %s thread in session %s: %v", msg.Type, s.sessionCode, err)
+			s.refuse(sender, "Failed to update comment thread")
+			return
+		}
+		s.mutex.Lock()
+		t, ok := s.threads[msg.ThreadID]
+		if ok {
+			t.ResolvedAt = resolvedAt
+			t.ResolvedBy = ""
+			if resolvedAt != nil {
+				t.ResolvedBy = sender.Name
+			}
+			thread = *t
+		}
+		s.mutex.Unlock()
+		if !ok {
+			return
+		}
+	}
+
+	s.mutex.RLock()
+	announce := message.Message{
+		Type:     "thread",
+		Revision: s.engine.Revision(),
+		Thread:   &thread,
+	}
+	s.mutex.RUnlock()
+
+	s.publish(bus.KindBroadcast, "", announce)
+	for c := range s.clients {
+		s.deliver(c, announce)
+	}
+}
+
+// refuse tells a client why its request was not carried out
+func (s *Session) refuse(c *client.Client, reason string) {
+	s.deliver(c, message.Message{Type: "error", UserID: c.UserID, Error: reason})
+}
+
+// anchorAt moves the range a client wants to comment on onto the current
+// text and returns it with the text it covers. The client sends the text
+// it selected as the quote.
+func (s *Session) anchorAt(revision int, t db.CommentThread) (int, int, string) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	start, end := s.rangeAt(revision, t.Start, t.End, t.Quote)
+	quote := []rune(slice(s.engine.Content(), start, end))
+	if len(quote) > maxQuoteLength {
+		quote = quote[:maxQuoteLength]
+	}
+	return start, end, string(quote)
+}
+
+// mergeThread takes in a thread announced by another node. Known threads
+// keep the anchor this node has been moving along; new ones are moved from
+// the revision they were announced at. It returns the thread as this node
+// sees it.
+func (s *Session) mergeThread(t db.CommentThread, revision int) *db.CommentThread {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if known, ok := s.threads[t.ID]; ok {
+		t.Start, t.End = known.Start, known.End
+	} else {
+		length := ot.Length(s.engine.Content())
+		t.Start = clamp(s.engine.Rebase(revision, t.Start, true), 0, length)
+		t.End = clamp(s.engine.Rebase(revision, t.End, false), t.Start, length)
+		// The owner saves where the new thread has moved to
+		s.scheduleSave()
+	}
+	s.threads[t.ID] = &t
+
+	announced := t
+	return &announced
+}
+
+// setThreads replaces the threads with those of the session owner. Callers
+// hold s.mutex.
+func (s *Session) setThreads(list []db.CommentThread) {
+	s.threads = make(map[int]*db.CommentThread, len(list))
+	for i := range list {
+		t := list[i]
+		s.threads[t.ID] = &t
+	}
+}
+
+// threadList returns copies of the threads, oldest first. Callers hold
+// s.mutex.
+func (s *Session) threadList() []db.CommentThread {
+	list := make([]db.CommentThread, 0, len(s.threads))
+	for _, t := range s.threads {
+		list = append(list, *t)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
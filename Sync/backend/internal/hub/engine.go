@@ -0,0 +1,252 @@
+package hub
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"collab-editor/internal/crdt"
+	"collab-editor/internal/message"
+	"collab-editor/internal/ot"
+)
+
+// Session modes, stored per session in editing_sessions.engine
+const (
+	ModeOT   = "ot"
+	ModeCRDT = "crdt"
+)
+
+// ValidMode reports whether mode names an engine. An empty mode picks the
+// default.
+func ValidMode(mode string) bool {
+	switch mode {
+	case ModeOT, ModeCRDT, "":
+		return true
+	}
+	return false
+}
+
+var (
+	errWrongMode  = errors.New("message does not match the session mode")
+	errOutOfOrder = errors.New("replayed edit does not follow the current revision")
+)
+
+// Engine owns the document of a session and decides how concurrent edits
+// are merged. Sessions guard their engine with their own mutex, so
+// implementations do not need any locking.
+type Engine interface {
+	// Mode returns the mode the engine implements
+	Mode() string
+	// Content returns the current document text
+	Content() string
+	// Revision counts the edits accepted so far
+	Revision() int
+	// Apply integrates an edit from a client and returns the message that
+	// should be forwarded to the other clients
+	Apply(msg message.Message) (message.Message, error)
+	// Replay applies an edit that the session owner on another node has
+	// already accepted, as returned by its Apply
+	Replay(msg message.Message) error
+	// Diff returns an edit message, as a client would send it, that turns
+	// the current content into content
+	Diff(content string) message.Message
+	// Edit returns an edit message, as a client would send it, that
+	// carries out op on the current content
+	Edit(op ot.Operation) (message.Message, error)
+	// Rebase moves a position a client took from the text at revision to
+	// the current text, as far as the engine can tell. See
+	// ot.Operation.TransformIndex for pushed.
+	Rebase(revision, pos int, pushed bool) int
+	// Init fills in the engine specific parts of an init or resync message
+	Init(msg *message.Message)
+	// State returns the state to persist next to the content, or nil when
+	// the content alone is enough to restore the engine
+	State() ([]byte, error)
+}
+
+func newEngine(mode, content string, state []byte) (Engine, error) {
+	switch mode {
+	case ModeOT, "":
+		return &otEngine{doc: ot.NewDocument(content)}, nil
+	case ModeCRDT:
+		if state == nil {
+			return &crdtEngine{doc: crdt.FromText("server", content)}, nil
+		}
+		doc := crdt.NewDocument()
+		if err := json.Unmarshal(state, doc); err != nil {
+			return nil, fmt.Errorf("failed to restore crdt state: %w", err)
+		}
+		return &crdtEngine{doc: doc}, nil
+	default:
+		return nil, fmt.Errorf("unknown session mode %q", mode)
+	}
+}
+
+// engineFromSync rebuilds an engine from the init message of another node
+func engineFromSync(msg message.Message) (Engine, error) {
+	switch msg.Mode {
+	case ModeOT, "":
+		return &otEngine{doc: ot.NewDocumentAt(msg.Content, msg.Revision)}, nil
+	case ModeCRDT:
+		doc := crdt.NewDocument()
+		for _, op := range msg.Changes {
+			if err := doc.Apply(op); err != nil {
+				return nil, err
+			}
+		}
+		return &crdtEngine{doc: doc}, nil
+	default:
+		return nil, fmt.Errorf("unknown session mode %q", msg.Mode)
+	}
+}
+
+// otEngine transforms client operations against the history they missed
+type otEngine struct {
+	doc *ot.Document
+}
+
+func (e *otEngine) Mode() string    { return ModeOT }
+func (e *otEngine) Content() string { return e.doc.Content() }
+func (e *otEngine) Revision() int   { return e.doc.Revision() }
+
+func (e *otEngine) Apply(msg message.Message) (message.Message, error) {
+	if msg.Type != "operation" || msg.Operation == nil {
+		return message.Message{}, errWrongMode
+	}
+
+	op, err := e.doc.Receive(msg.Revision, *msg.Operation)
+	if err != nil {
+		return message.Message{}, err
+	}
+
+	return message.Message{
+		Type:      "operation",
+		UserID:    msg.UserID,
+		Color:     msg.Color,
+		Revision:  e.doc.Revision(),
+		Operation: &op,
+	}, nil
+}
+
+func (e *otEngine) Replay(msg message.Message) error {
+	if msg.Operation == nil {
+		return errWrongMode
+	}
+	if msg.Revision != e.doc.Revision()+1 {
+		return errOutOfOrder
+	}
+	_, err := e.doc.Receive(e.doc.Revision(), *msg.Operation)
+	return err
+}
+
+func (e *otEngine) Diff(content string) message.Message {
+	op := ot.FromDiff(e.doc.Content(), content)
+	return message.Message{
+		Type:      "operation",
+		Revision:  e.doc.Revision(),
+		Operation: &op,
+	}
+}
+
+func (e *otEngine) Edit(op ot.Operation) (message.Message, error) {
+	return message.Message{
+		Type:      "operation",
+		Revision:  e.doc.Revision(),
+		Operation: &op,
+	}, nil
+}
+
+func (e *otEngine) Rebase(revision, pos int, pushed bool) int {
+	rebased, err := e.doc.TransformIndex(revision, pos, pushed)
+	if err != nil {
+		// Too far behind to tell, the position is the best guess left
+		return pos
+	}
+	return rebased
+}
+
+func (e *otEngine) Init(msg *message.Message) {
+	msg.Mode = ModeOT
+}
+
+func (e *otEngine) State() ([]byte, error) {
+	return nil, nil
+}
+
+// crdtEngine merges commutative sequence ops, so clients may send changes
+// made while offline in one batch when they reconnect
+type crdtEngine struct {
+	doc *crdt.Document
+}
+
+func (e *crdtEngine) Mode() string    { return ModeCRDT }
+func (e *crdtEngine) Content() string { return e.doc.Content() }
+func (e *crdtEngine) Revision() int   { return e.doc.Applied() }
+
+func (e *crdtEngine) Apply(msg message.Message) (message.Message, error) {
+	if msg.Type != "crdt" || len(msg.Changes) == 0 {
+		return message.Message{}, errWrongMode
+	}
+
+	// Check the whole batch first so a bad op cannot leave it half applied
+	for _, op := range msg.Changes {
+		if err := op.Validate(); err != nil {
+			return message.Message{}, err
+		}
+	}
+	for _, op := range msg.Changes {
+		if err := e.doc.Apply(op); err != nil {
+			return message.Message{}, err
+		}
+	}
+
+	return message.Message{
+		Type:     "crdt",
+		UserID:   msg.UserID,
+		Color:    msg.Color,
+		Revision: e.doc.Applied(),
+		Changes:  msg.Changes,
+	}, nil
+}
+
+func (e *crdtEngine) Replay(msg message.Message) error {
+	for _, op := range msg.Changes {
+		if err := e.doc.Apply(op); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *crdtEngine) Diff(content string) message.Message {
+	return message.Message{
+		Type:    "crdt",
+		Changes: e.doc.Diff("server", content),
+	}
+}
+
+func (e *crdtEngine) Edit(op ot.Operation) (message.Message, error) {
+	changes, err := e.doc.FromOperation("server", op)
+	if err != nil {
+		return message.Message{}, err
+	}
+	return message.Message{
+		Type:    "crdt",
+		Changes: changes,
+	}, nil
+}
+
+// Rebase returns pos unchanged: crdt clients do not base their edits on a
+// revision of the whole text, so there is no history to move it through
+func (e *crdtEngine) Rebase(revision, pos int, pushed bool) int {
+	return pos
+}
+
+func (e *crdtEngine) Init(msg *message.Message) {
+	msg.Mode = ModeCRDT
+	msg.Changes = e.doc.Ops()
+}
+
+func (e *crdtEngine) State() ([]byte, error) {
+	return json.Marshal(e.doc)
+}
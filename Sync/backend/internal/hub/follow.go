@@ -0,0 +1,144 @@
+package hub
+
+import (
+	"log"
+	"net/http"
+
+	"collab-editor/internal/access"
+	"collab-editor/internal/bus"
+	"collab-editor/internal/client"
+	"collab-editor/internal/message"
+)
+
+// follower is what a read-only follower's client talks to instead of the
+// session. Anything the follower sends is dropped.
+type follower struct {
+	session *Session
+}
+
+func (f *follower) Register(c *client.Client) {}
+
+func (f *follower) Unregister(c *client.Client) {
+	f.session.do(func() { f.session.unfollow(c) })
+}
+
+func (f *follower) Submit(c *client.Client, msg message.Message) {}
+
+// ServeFollower upgrades r to a websocket that receives the text of a
+// session and every later change to it, for as long as the publication slug
+// exists. Followers are not announced to the session's users and can never
+// send anything. The caller decides who may follow which session.
+func ServeFollower(hub *Hub, w http.ResponseWriter, r *http.Request, sessionCode, slug string) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	// Retry if the session is evicted between looking it up and joining it
+	for {
+		session := hub.GetOrCreateSession(sessionCode, "")
+		c := client.New(&follower{session: session}, conn, "", "")
+		c.SetRole(access.Viewer)
+		if session.do(func() { session.follow(c, slug) }) {
+			go c.WritePump()
+			go c.ReadPump()
+			return
+		}
+	}
+}
+
+// follow adds a read-only follower of publication slug and sends it the
+// current text
+func (s *Session) follow(c *client.Client, slug string) {
+	s.followers[c] = slug
+	s.checkIdle()
+
+	s.mutex.RLock()
+	msg := message.Message{
+		Type:     "init",
+		Content:  s.engine.Content(),
+		Revision: s.engine.Revision(),
+		Mode:     s.engine.Mode(),
+	}
+	s.mutex.RUnlock()
+
+	select {
+	case c.Send <- msg:
+	default:
+	}
+}
+
+func (s *Session) unfollow(c *client.Client) {
+	if _, ok := s.followers[c]; ok {
+		delete(s.followers, c)
+		close(c.Send)
+	}
+}
+
+// Unpublish disconnects the followers of a deleted publication of a
+// session, on this node and every other
+func (h *Hub) Unpublish(sessionCode, slug string) {
+	err := h.bus.Publish(bus.Event{
+		Session: sessionCode,
+		Kind:    bus.KindUnpublished,
+		Target:  slug,
+	})
+	if err != nil {
+		log.Printf("Failed to publish removal of publication %s: %v", slug, err)
+	}
+
+	h.mutex.RLock()
+	session, ok := h.sessions[sessionCode]
+	h.mutex.RUnlock()
+	if ok {
+		session.do(func() { session.dropFollowers(slug) })
+	}
+}
+
+// dropFollowers closes the followers of publication slug
+func (s *Session) dropFollowers(slug string) {
+	for c, followed := range s.followers {
+		if followed != slug {
+			continue
+		}
+		c.SetCloseReason(closeDeleted, "publication deleted")
+		close(c.Send)
+		delete(s.followers, c)
+	}
+	s.checkIdle()
+}
+
+// updateFollowers passes an applied change on to followers. OT operations
+// are sent as they are; anything else is sent as the full text, so followers
+// need no CRDT implementation. Who made the change is not passed on.
+func (s *Session) updateFollowers(change message.Message) {
+	if len(s.followers) == 0 {
+		return
+	}
+
+	msg := message.Message{
+		Type:      "operation",
+		Revision:  change.Revision,
+		Operation: change.Operation,
+	}
+	if change.Type != "operation" {
+		s.mutex.RLock()
+		msg = message.Message{
+			Type:     "content",
+			Content:  s.engine.Content(),
+			Revision: s.engine.Revision(),
+		}
+		s.mutex.RUnlock()
+	}
+
+	for c := range s.followers {
+		select {
+		case c.Send <- msg:
+		default:
+			// Too far behind, the follower reconnects and starts over
+			delete(s.followers, c)
+			close(c.Send)
+		}
+	}
+}
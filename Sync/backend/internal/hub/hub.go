@@ -3,11 +3,12 @@ package hub
 import (
 	"log"
 	"net/http"
-	"strings"
 	"sync"
 	"time"
 
+	"collab-editor/internal/access"
 	"collab-editor/internal/auth"
+	"collab-editor/internal/bus"
 	"collab-editor/internal/client"
 	"collab-editor/internal/db"
 	"collab-editor/internal/message"
@@ -23,21 +24,45 @@ var upgrader = websocket.Upgrader{
 
 var colors = []string{"#FF6B6B", "#4ECDC4", "#45B7D1", "#96CEB4", "#DDA0DD", "#F4A460"}
 
+// envelope carries a message together with the client that sent it. Sender
+// is nil for messages that originate on the server.
+type envelope struct {
+	sender *client.Client
+	msg    message.Message
+}
+
 type Session struct {
 	clients     map[*client.Client]bool
-	broadcast   chan message.Message
+	followers   map[*client.Client]string // Read-only public viewers by the publication they follow
+	broadcast   chan envelope
 	register    chan *client.Client
 	unregister  chan *client.Client
-	document    string
+	engine      Engine
 	sessionCode string
 	mutex       sync.RWMutex
 	colorIndex  int
 	colorMutex  sync.Mutex
 	lastSave    time.Time
 	saveTimer   *time.Timer
+	saving      sync.WaitGroup // Saves scheduled or running
 	db          *db.Database
-	userIDs     map[string]int // Map of client UserID to database user ID
-	userIDMutex sync.RWMutex
+	authorMutex sync.Mutex
+	authors     map[int]bool   // Database users who edited since the last save, guarded by authorMutex
+	lastSeq     map[string]int // Highest edit seq applied per client UserID
+	bus         bus.Bus
+	owner       bool // Whether this node applies and persists edits
+	remote      chan bus.Event
+	remoteUsers map[string]message.Message  // userJoined of clients on other nodes
+	threads     map[int]*db.CommentThread   // Comment threads by ID, guarded by mutex
+	suggestions map[int]*db.Suggestion      // Pending suggestions by ID, guarded by mutex
+	chat        []db.ChatMessage            // Latest chat messages, oldest first, guarded by mutex
+	presence    map[string]message.Presence // Latest presence by connection ID, guarded by mutex
+	tracking    map[string]string           // Whom each connection follows around the text, guarded by mutex
+	hub         *Hub
+	done        chan struct{} // Closed once the session has been evicted or shut down
+	stop        chan chan []*client.Client
+	exec        chan func()
+	idleSince   time.Time
 }
 
 type Hub struct {
@@ -45,12 +70,19 @@ type Hub struct {
 	mutex    sync.RWMutex
 	db       *db.Database
 	auth     *auth.AuthHandler
+	bus      bus.Bus
+
+	idleTimeout time.Duration
+	hooks       Hooks
+	counters    counters
 }
 
 func New(database *db.Database) *Hub {
 	return &Hub{
-		sessions: make(map[string]*Session),
-		db:       database,
+		sessions:    make(map[string]*Session),
+		db:          database,
+		bus:         bus.NewLocal(),
+		idleTimeout: DefaultIdleTimeout,
 	}
 }
 
@@ -58,7 +90,10 @@ func (h *Hub) SetAuthHandler(authHandler *auth.AuthHandler) {
 	h.auth = authHandler
 }
 
-func (h *Hub) GetOrCreateSession(sessionCode string) *Session {
+// GetOrCreateSession returns the running session for sessionCode, loading
+// it from the database if needed. mode only applies to sessions that do not
+// exist yet; existing sessions keep the mode they were created with.
+func (h *Hub) GetOrCreateSession(sessionCode, mode string) *Session {
 	h.mutex.Lock()
 	defer h.mutex.Unlock()
 
@@ -67,28 +102,65 @@ func (h *Hub) GetOrCreateSession(sessionCode string) *Session {
 	}
 
 	// Load session from database
-	dbSession, err := h.db.GetOrCreateSession(sessionCode)
+	dbSession, err := h.db.GetOrCreateSessionWithEngine(sessionCode, mode)
 	if err != nil {
 		log.Printf("Failed to load session from database: %v", err)
+		dbSession = &db.Session{SessionCode: sessionCode, Engine: mode}
+	}
+
+	engine, err := newEngine(dbSession.Engine, dbSession.Content, dbSession.State)
+	if err != nil {
+		log.Printf("Failed to restore session %s, starting from its text: %v", sessionCode, err)
+		engine, _ = newEngine(ModeOT, dbSession.Content, nil)
 	}
 
 	// Create new session
 	session := &Session{
-		broadcast:   make(chan message.Message),
+		broadcast:   make(chan envelope),
 		register:    make(chan *client.Client),
 		unregister:  make(chan *client.Client),
 		clients:     make(map[*client.Client]bool),
-		document:    dbSession.Content,
+		followers:   make(map[*client.Client]string),
+		engine:      engine,
 		sessionCode: sessionCode,
 		colorIndex:  0,
 		db:          h.db,
 		lastSave:    time.Now(),
-		userIDs:     make(map[string]int),
+		authors:     make(map[int]bool),
+		lastSeq:     make(map[string]int),
+		bus:         h.bus,
+		remote:      make(chan bus.Event, 64),
+		remoteUsers: make(map[string]message.Message),
+		threads:     loadThreads(h.db, sessionCode),
+		suggestions: loadSuggestions(h.db, sessionCode),
+		chat:        loadChat(h.db, sessionCode),
+		presence:    make(map[string]message.Presence),
+		tracking:    make(map[string]string),
+		hub:         h,
+		done:        make(chan struct{}),
+		stop:        make(chan chan []*client.Client),
+		exec:        make(chan func()),
 	}
 
+	owner, err := h.bus.Acquire(sessionCode)
+	if err != nil {
+		log.Printf("Failed to acquire ownership of session %s: %v", sessionCode, err)
+	}
+	session.owner = owner
+
 	h.sessions[sessionCode] = session
+	h.counters.created.Add(1)
 	go session.run()
 
+	if h.hooks.Created != nil {
+		h.hooks.Created(sessionCode)
+	}
+
+	if !owner {
+		// Another node holds the authoritative copy, fetch it
+		session.publish(bus.KindSyncRequest, "", message.Message{})
+	}
+
 	return session
 }
 
@@ -100,66 +172,255 @@ func (s *Session) getNextColor() string {
 	return color
 }
 
-func (s *Session) setUserID(clientUserID string, dbUserID int) {
-	s.userIDMutex.Lock()
-	defer s.userIDMutex.Unlock()
-	if dbUserID > 0 {
-		s.userIDs[clientUserID] = dbUserID
+// scheduleSave debounces persisting the document. Only the owning node
+// saves, so replicas never write stale versions.
+func (s *Session) scheduleSave() {
+	if !s.owner {
+		return
 	}
+	if s.saveTimer != nil && s.saveTimer.Stop() {
+		s.saving.Done()
+	}
+
+	s.saving.Add(1)
+	s.saveTimer = time.AfterFunc(5*time.Second, func() {
+		defer s.saving.Done()
+		s.save()
+	})
 }
 
-func (s *Session) getUserID(clientUserID string) *int {
-	s.userIDMutex.RLock()
-	defer s.userIDMutex.RUnlock()
-	if id, exists := s.userIDs[clientUserID]; exists && id > 0 {
-		return &id
+func (s *Session) save() {
+	content, state := s.snapshot()
+
+	// Credit everyone who edited since the previous version
+	s.authorMutex.Lock()
+	authors := make([]int, 0, len(s.authors))
+	for id := range s.authors {
+		authors = append(authors, id)
+	}
+	s.authors = make(map[int]bool)
+	s.authorMutex.Unlock()
+
+	if err := s.db.SaveThreadAnchors(s.threadAnchors()); err != nil {
+		log.Printf("Failed to save comment anchors for session %s: %v", s.sessionCode, err)
+	}
+	if err := s.db.SaveSuggestionAnchors(s.suggestionAnchors()); err != nil {
+		log.Printf("Failed to save suggestion anchors for session %s: %v", s.sessionCode, err)
+	}
+
+	if err := s.db.SaveDocumentState(s.sessionCode, content, state, authors); err != nil {
+		log.Printf("Failed to save document: %v", err)
+		// Keep the credit for the next attempt
+		for _, id := range authors {
+			s.addAuthor(id)
+		}
+	} else {
+		log.Printf("Document saved for session %s (authors: %v)", s.sessionCode, authors)
 	}
-	return nil
 }
 
-func (s *Session) scheduleSave() {
-	if s.saveTimer != nil {
-		s.saveTimer.Stop()
+// addAuthor credits a database user with the next saved version
+func (s *Session) addAuthor(dbUserID int) {
+	if dbUserID <= 0 {
+		return
 	}
+	s.authorMutex.Lock()
+	defer s.authorMutex.Unlock()
+	s.authors[dbUserID] = true
+}
 
-	s.saveTimer = time.AfterFunc(5*time.Second, func() {
+// Content returns a snapshot of the current document text.
+func (s *Session) Content() string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.engine.Content()
+}
+
+// snapshot returns the current text together with the engine state that
+// should be persisted with it.
+func (s *Session) snapshot() (string, []byte) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	state, err := s.engine.State()
+	if err != nil {
+		log.Printf("Failed to serialize state for session %s: %v", s.sessionCode, err)
+	}
+	return s.engine.Content(), state
+}
+
+// deliver queues msg for c, dropping the client if its buffer is full so it
+// reconnects and resyncs instead of silently missing operations.
+func (s *Session) deliver(c *client.Client, msg message.Message) {
+	select {
+	case c.Send <- msg:
+	default:
+		close(c.Send)
+		delete(s.clients, c)
+		s.hub.counters.clients.Add(-1)
+	}
+}
+
+// remove closes c's connection and tells everyone it left
+func (s *Session) remove(c *client.Client) {
+	delete(s.clients, c)
+	close(c.Send)
+	s.hub.counters.clients.Add(-1)
+
+	s.forgetPresence(c.UserID)
+
+	// Notify others about user leaving
+	s.publish(bus.KindBroadcast, "", message.Message{
+		Type:   "userLeft",
+		UserID: c.UserID,
+	})
+	for existingClient := range s.clients {
+		select {
+		case existingClient.Send <- message.Message{
+			Type:   "userLeft",
+			UserID: c.UserID,
+		}:
+		default:
+		}
+	}
+}
+
+// applyEdit hands an edit from a client to the session engine, acks it to
+// the sender and forwards the merged result to everyone else. Edits carrying
+// a seq the client already had applied are acked again but not reapplied, so
+// clients can safely resend after a lost ack.
+//
+// On nodes that do not own the session the edit is forwarded to the owner,
+// which announces the result to every node. Edits with a nil sender came
+// from another node or the server itself. authors are the database users
+// credited with the edit; zero stands for an anonymous edit.
+func (s *Session) applyEdit(sender *client.Client, msg message.Message, authors ...int) {
+	if msg.Seq > 0 && msg.Seq <= s.lastSeq[msg.UserID] {
 		s.mutex.RLock()
-		content := s.document
+		ack := message.Message{
+			Type:     "ack",
+			UserID:   msg.UserID,
+			Revision: s.engine.Revision(),
+			Seq:      msg.Seq,
+		}
 		s.mutex.RUnlock()
+		if sender != nil {
+			s.deliver(sender, ack)
+		} else {
+			s.publish(bus.KindApplied, msg.UserID, ack)
+		}
+		return
+	}
 
-		// Try to get any authenticated user ID from the session
-		var userID *int
-		s.userIDMutex.RLock()
-		for _, id := range s.userIDs {
-			if id > 0 {
-				userID = &id
-				break
-			}
+	if !s.owner {
+		err := s.bus.Publish(bus.Event{
+			Session: s.sessionCode,
+			Kind:    bus.KindEdit,
+			Authors: authors,
+			Message: msg,
+		})
+		if err != nil {
+			log.Printf("Failed to forward edit for session %s: %v", s.sessionCode, err)
 		}
-		s.userIDMutex.RUnlock()
+		return
+	}
 
-		if err := s.db.SaveDocument(s.sessionCode, content, userID); err != nil {
-			log.Printf("Failed to save document: %v", err)
+	s.mutex.Lock()
+	before := s.textBefore()
+	forward, err := s.engine.Apply(msg)
+	if err == nil {
+		s.shiftAnchors(before, forward)
+	}
+	revision := s.engine.Revision()
+	s.mutex.Unlock()
+
+	if err != nil {
+		log.Printf("Rejected %s from %s in session %s: %v", msg.Type, msg.UserID, s.sessionCode, err)
+		resync := s.initMessage("resync")
+		resync.UserID = msg.UserID
+		resync.Seq = msg.Seq
+		resync.Error = err.Error()
+		if sender != nil {
+			s.deliver(sender, resync)
 		} else {
-			log.Printf("Document saved for session %s (userID: %v)", s.sessionCode, userID)
+			s.publish(bus.KindRejected, msg.UserID, resync)
 		}
-	})
+		return
+	}
+
+	if msg.Seq > 0 {
+		s.lastSeq[msg.UserID] = msg.Seq
+	}
+	for _, author := range authors {
+		s.addAuthor(author)
+	}
+
+	applied := forward
+	applied.Seq = msg.Seq
+	s.publish(bus.KindApplied, msg.UserID, applied)
+	s.updateFollowers(forward)
+
+	// Schedule save after document update
+	s.scheduleSave()
+
+	for c := range s.clients {
+		if c == sender {
+			s.deliver(c, message.Message{
+				Type:     "ack",
+				UserID:   c.UserID,
+				Revision: revision,
+				Seq:      msg.Seq,
+			})
+			continue
+		}
+		s.deliver(c, forward)
+	}
 }
 
 func (s *Session) run() {
+	maintenance := time.NewTicker(ownershipInterval)
+	defer maintenance.Stop()
+
 	for {
 		select {
+		case ev := <-s.remote:
+			s.handleRemote(ev)
+
+		case fn := <-s.exec:
+			fn()
+			// The session was discarded
+			select {
+			case <-s.done:
+				return
+			default:
+			}
+
+		case reply := <-s.stop:
+			reply <- s.shutdown()
+			return
+
+		case <-maintenance.C:
+			s.checkOwnership()
+			if s.checkIdle() {
+				s.evict()
+				return
+			}
+
 		case c := <-s.register:
 			s.clients[c] = true
+			s.hub.counters.clients.Add(1)
+			s.checkIdle()
 
 			// Send current document state to new client
+			initMsg := s.initMessage("init")
+			initMsg.UserID = c.UserID
+			initMsg.Color = c.Color
+			initMsg.Name = c.Name
+			initMsg.AvatarURL = c.AvatarURL
+			initMsg.Pass = c.GuestPass
+			initMsg.TabToken = c.TabToken
+			initMsg.Role = string(c.Role())
 			select {
-			case c.Send <- message.Message{
-				Type:    "init",
-				Content: s.document,
-				UserID:  c.UserID,
-				Color:   c.Color,
-			}:
+			case c.Send <- initMsg:
 			default:
 			}
 
@@ -167,25 +428,26 @@ func (s *Session) run() {
 			for existingClient := range s.clients {
 				if existingClient != c {
 					select {
-					case c.Send <- message.Message{
-						Type:   "userJoined",
-						UserID: existingClient.UserID,
-						Color:  existingClient.Color,
-					}:
+					case c.Send <- joinedMessage(existingClient):
 					default:
 					}
 				}
 			}
 
+			// Send users connected through other nodes
+			for _, joined := range s.remoteUsers {
+				select {
+				case c.Send <- joined:
+				default:
+				}
+			}
+
 			// Notify others about new user
+			s.publish(bus.KindBroadcast, "", joinedMessage(c))
 			for existingClient := range s.clients {
 				if existingClient != c {
 					select {
-					case existingClient.Send <- message.Message{
-						Type:   "userJoined",
-						UserID: c.UserID,
-						Color:  c.Color,
-					}:
+					case existingClient.Send <- joinedMessage(c):
 					default:
 					}
 				}
@@ -193,111 +455,297 @@ func (s *Session) run() {
 
 		case c := <-s.unregister:
 			if _, ok := s.clients[c]; ok {
-				delete(s.clients, c)
-				close(c.Send)
-
-				// Remove user ID mapping
-				s.userIDMutex.Lock()
-				delete(s.userIDs, c.UserID)
-				s.userIDMutex.Unlock()
-
-				// Notify others about user leaving
-				for existingClient := range s.clients {
-					select {
-					case existingClient.Send <- message.Message{
-						Type:   "userLeft",
-						UserID: c.UserID,
-					}:
-					default:
-					}
+				s.remove(c)
+			}
+			s.checkIdle()
+
+		case env := <-s.broadcast:
+			switch env.msg.Type {
+			case "operation", "crdt":
+				author := 0
+				if env.sender != nil {
+					author = env.sender.DBUserID
+				}
+				s.applyEdit(env.sender, env.msg, author)
+				continue
+			case "comment", "reply", "resolve", "reopen":
+				if env.sender != nil {
+					s.handleComment(env.sender, env.msg)
+				}
+				continue
+			case "suggest", "accept", "reject", "acceptAll", "rejectAll":
+				if env.sender != nil {
+					s.handleSuggestion(env.sender, env.msg)
+				}
+				continue
+			case "chat":
+				if env.sender != nil {
+					s.handleChat(env.sender, env.msg)
+				}
+				continue
+			case "presence":
+				if env.sender != nil {
+					s.handlePresence(env.msg)
 				}
+				continue
+			case "follow":
+				if env.sender != nil {
+					s.handleTrack(env.sender, env.msg)
+				}
+				continue
+			case "update":
+				// Whole-document overwrites clobber concurrent edits, so
+				// they are no longer accepted from clients
+				log.Printf("Ignoring legacy update message from %s in session %s", env.msg.UserID, s.sessionCode)
+				continue
 			}
 
-		case msg := <-s.broadcast:
-			if msg.Type == "update" {
-				s.mutex.Lock()
-				s.document = msg.Content
-				s.mutex.Unlock()
-
-				// Schedule save after document update
-				s.scheduleSave()
+			// Every frame clients may send is handled above. Anything else,
+			// such as a forged init, ack or resync, would corrupt the state
+			// of other clients, so only the server's own broadcasts are
+			// passed along as they are.
+			if env.sender != nil {
+				log.Printf("Dropping %s message from %s in session %s", env.msg.Type, env.msg.UserID, s.sessionCode)
+				continue
 			}
-
+			s.publish(bus.KindBroadcast, "", env.msg)
 			for c := range s.clients {
-				select {
-				case c.Send <- msg:
-				default:
-					close(c.Send)
-					delete(s.clients, c)
-				}
+				s.deliver(c, env.msg)
 			}
 		}
 	}
 }
 
+// do runs fn on the session goroutine and waits for it to finish. It
+// reports false if the session was evicted or shut down before fn could run.
+func (s *Session) do(fn func()) bool {
+	finished := make(chan struct{})
+	select {
+	case s.exec <- func() {
+		fn()
+		close(finished)
+	}:
+	case <-s.done:
+		return false
+	}
+	<-finished
+	return true
+}
+
+// Content returns the current text of a session, loading it if nobody has
+// it open.
+func (h *Hub) Content(sessionCode string) string {
+	return h.GetOrCreateSession(sessionCode, "").Content()
+}
+
+// Unsaved returns the current text of a session and the database users
+// who edited it since it was last saved. The session is loaded if nobody
+// has it open.
+func (h *Hub) Unsaved(sessionCode string) (string, []int) {
+	s := h.GetOrCreateSession(sessionCode, "")
+	content := s.Content()
+
+	s.authorMutex.Lock()
+	defer s.authorMutex.Unlock()
+	authors := make([]int, 0, len(s.authors))
+	for id := range s.authors {
+		authors = append(authors, id)
+	}
+	return content, authors
+}
+
+// ContentWithSuggestions returns the current text of a session with its
+// pending suggestions carried out, and how many of them were left out for
+// overlapping others. The session is loaded if nobody has it open.
+func (h *Hub) ContentWithSuggestions(sessionCode string) (string, int) {
+	s := h.GetOrCreateSession(sessionCode, "")
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	pending := s.suggestionList()
+	content, applied := db.ApplySuggestions(s.engine.Content(), pending)
+	return content, len(pending) - len(applied)
+}
+
+// ReplaceContent changes the text of a session as if a client had edited
+// it, so every connected client receives the change. The session is loaded
+// if nobody has it open. author is credited with the change if non-zero.
+func (h *Hub) ReplaceContent(sessionCode, content string, author int) {
+	for {
+		session := h.GetOrCreateSession(sessionCode, "")
+		if session.do(func() { session.replaceContent(content, author) }) {
+			return
+		}
+	}
+}
+
+func (s *Session) replaceContent(content string, author int) {
+	s.mutex.RLock()
+	unchanged := s.engine.Content() == content
+	msg := s.engine.Diff(content)
+	s.mutex.RUnlock()
+
+	if unchanged {
+		return
+	}
+	msg.UserID = "server"
+	s.applyEdit(nil, msg, author)
+}
+
 func (s *Session) Register(c *client.Client) {
-	s.register <- c
+	s.join(c)
+}
+
+// join registers c and reports whether it worked. It fails if the session
+// was evicted after the caller looked it up.
+func (s *Session) join(c *client.Client) bool {
+	select {
+	case s.register <- c:
+		return true
+	case <-s.done:
+		return false
+	}
 }
 
 func (s *Session) Unregister(c *client.Client) {
-	s.unregister <- c
+	select {
+	case s.unregister <- c:
+	case <-s.done:
+	}
 }
 
 func (s *Session) Broadcast(msg message.Message) {
-	s.broadcast <- msg
+	select {
+	case s.broadcast <- envelope{msg: msg}:
+	case <-s.done:
+	}
+}
+
+func (s *Session) Submit(c *client.Client, msg message.Message) {
+	select {
+	case s.broadcast <- envelope{sender: c, msg: msg}:
+	case <-s.done:
+	}
 }
 
 func ServeWS(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	sessionCode := r.URL.Query().Get("session")
+	if sessionCode == "" {
+		http.Error(w, "Session code required", http.StatusBadRequest)
+		return
+	}
+	mode := r.URL.Query().Get("mode")
+	if !ValidMode(mode) {
+		http.Error(w, "Unknown session mode", http.StatusBadRequest)
+		return
+	}
+
+	// Check access before upgrading so refused clients get a proper status.
+	// An invalid token falls back to anonymous access.
+	var dbUserID int
+	var loginID, guestPass string
+	role := access.Editor
+	maxRole := access.Owner
+	if hub.auth != nil {
+		if claims, err := hub.auth.RequestClaims(r); err == nil && claims != nil {
+			dbUserID = claims.UserID
+			loginID = claims.LoginID
+			maxRole = claims.MaxRole()
+			log.Printf("Authenticated user ID %d for WebSocket connection", dbUserID)
+		}
+
+		var err error
+		role, err = hub.auth.SessionRole(sessionCode, dbUserID)
+		if err != nil {
+			log.Printf("Failed to check access to session %s: %v", sessionCode, err)
+			http.Error(w, "Failed to check access", http.StatusInternalServerError)
+			return
+		}
+
+		// A guest who redeemed an invite before comes back with a pass
+		// rather than using the invite up again
+		if pass := r.URL.Query().Get("pass"); pass != "" && dbUserID == 0 {
+			if passRole := hub.acceptGuestPass(sessionCode, pass, role); passRole != role {
+				role = passRole
+				guestPass = pass
+			}
+		}
+
+		// An invite link can grant more than the user has on their own
+		if invite := r.URL.Query().Get("invite"); invite != "" && guestPass == "" {
+			role, guestPass, err = hub.acceptInvite(sessionCode, invite, dbUserID, role)
+			if err != nil {
+				log.Printf("Refused invite to session %s: %v", sessionCode, err)
+				http.Error(w, "Invite is invalid or has expired", http.StatusForbidden)
+				return
+			}
+		}
+
+		if !role.Limit(maxRole).CanView() {
+			if dbUserID == 0 {
+				http.Error(w, "Login required", http.StatusUnauthorized)
+			} else {
+				http.Error(w, "Access denied", http.StatusForbidden)
+			}
+			return
+		}
+	}
+
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Println(err)
 		return
 	}
 
-	userID := r.URL.Query().Get("userId")
-	if userID == "" {
-		userID = "user" + string(rune(len(hub.sessions)+1))
+	tab := r.URL.Query().Get("userId")
+	var tabToken string
+	if dbUserID == 0 {
+		tab, tabToken = hub.guestTab(r.URL.Query().Get("tab"))
 	}
-
-	sessionCode := r.URL.Query().Get("session")
-	if sessionCode == "" {
-		log.Println("No session code provided")
-		conn.Close()
-		return
+	userID := connectionID(dbUserID, tab)
+	var name, avatarURL string
+	if dbUserID > 0 {
+		name, avatarURL = hub.identity(dbUserID)
 	}
 
-	// Try to authenticate the user if a token is provided
-	var dbUserID int
-	token := r.URL.Query().Get("token")
-	if token == "" {
-		// Try to get token from Authorization header
-		authHeader := r.Header.Get("Authorization")
-		if authHeader != "" {
-			token = strings.TrimPrefix(authHeader, "Bearer ")
+	// Retry if the session is evicted between looking it up and joining it
+	var session *Session
+	var c *client.Client
+	for {
+		session = hub.GetOrCreateSession(sessionCode, mode)
+
+		// The first signed-in user to open an unclaimed session owns it,
+		// unless they came with a key that may not write
+		if dbUserID > 0 && role == access.Editor && maxRole.CanEdit() {
+			claimed, err := hub.db.ClaimSession(sessionCode, dbUserID)
+			if err != nil {
+				log.Printf("Failed to claim session %s: %v", sessionCode, err)
+			} else if claimed {
+				log.Printf("User %d now owns session %s", dbUserID, sessionCode)
+				role = access.Owner
+			}
 		}
-	}
 
-	if token != "" && hub.auth != nil {
-		if id, err := hub.auth.ValidateToken(token); err == nil {
-			dbUserID = id
-			log.Printf("Authenticated user ID %d for WebSocket connection", dbUserID)
+		c = client.New(session, conn, userID, session.getNextColor())
+		c.Name = name
+		c.AvatarURL = avatarURL
+		c.DBUserID = dbUserID
+		c.LoginID = loginID
+		c.GuestPass = guestPass
+		c.TabToken = tabToken
+		c.LimitRole(maxRole)
+		c.SetRole(role)
+		if session.join(c) {
+			break
 		}
 	}
 
-	session := hub.GetOrCreateSession(sessionCode)
-	
-	// Store the database user ID if authenticated
 	if dbUserID > 0 {
-		session.setUserID(userID, dbUserID)
 		// Create initial user-session association
-		if err := session.db.SaveDocument(sessionCode, session.document, &dbUserID); err != nil {
+		if err := session.db.AddUserSession(sessionCode, dbUserID); err != nil {
 			log.Printf("Failed to create initial user-session association: %v", err)
 		}
 	}
 
-	c := client.New(session, conn, userID, session.getNextColor())
-	session.Register(c)
-
 	go c.WritePump()
 	go c.ReadPump()
-}
\ No newline at end of file
+}
@@ -0,0 +1,306 @@
+package hub
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"collab-editor/internal/bus"
+	"collab-editor/internal/client"
+	"collab-editor/internal/message"
+
+	"github.com/gorilla/websocket"
+)
+
+// DefaultIdleTimeout is how long a session without clients stays in memory
+const DefaultIdleTimeout = 10 * time.Minute
+
+// Hooks are called on session lifecycle changes. Any of them may be nil.
+// They run inline with the hub's own work and must not block.
+type Hooks struct {
+	// Created runs after a session was loaded into memory
+	Created func(sessionCode string)
+	// Emptied runs when the last local client leaves a session
+	Emptied func(sessionCode string)
+	// Evicted runs after an idle session was saved and removed
+	Evicted func(sessionCode string)
+}
+
+// Metrics is a snapshot of the hub's session counters
+type Metrics struct {
+	ActiveSessions   int   `json:"active_sessions"`
+	ConnectedClients int64 `json:"connected_clients"`
+	SessionsCreated  int64 `json:"sessions_created"`
+	SessionsEvicted  int64 `json:"sessions_evicted"`
+}
+
+type counters struct {
+	clients atomic.Int64
+	created atomic.Int64
+	evicted atomic.Int64
+}
+
+// SetIdleTimeout sets how long a session may go without clients before it
+// is evicted. Zero keeps idle sessions forever.
+func (h *Hub) SetIdleTimeout(d time.Duration) {
+	h.idleTimeout = d
+}
+
+func (h *Hub) SetHooks(hooks Hooks) {
+	h.hooks = hooks
+}
+
+func (h *Hub) Metrics() Metrics {
+	h.mutex.RLock()
+	active := len(h.sessions)
+	h.mutex.RUnlock()
+
+	return Metrics{
+		ActiveSessions:   active,
+		ConnectedClients: h.counters.clients.Load(),
+		SessionsCreated:  h.counters.created.Load(),
+		SessionsEvicted:  h.counters.evicted.Load(),
+	}
+}
+
+// ServeMetrics answers with the hub's counters to callers that send token
+// as a bearer token. Without a token metrics are not served at all.
+func ServeMetrics(hub *Hub, token string, w http.ResponseWriter, r *http.Request) {
+	if token == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(hub.Metrics())
+}
+
+// checkIdle tracks how long the session has been without local clients and
+// reports whether it has been idle long enough to be evicted.
+func (s *Session) checkIdle() bool {
+	if len(s.clients) > 0 || len(s.followers) > 0 {
+		s.idleSince = time.Time{}
+		return false
+	}
+
+	if s.idleSince.IsZero() {
+		s.idleSince = time.Now()
+		if s.hub.hooks.Emptied != nil {
+			s.hub.hooks.Emptied(s.sessionCode)
+		}
+	}
+
+	return s.hub.idleTimeout > 0 && time.Since(s.idleSince) >= s.hub.idleTimeout
+}
+
+// flush saves the document right away if a debounced save is pending and
+// returns once no save is running
+func (s *Session) flush() {
+	if s.saveTimer != nil && s.saveTimer.Stop() {
+		s.save()
+		s.saving.Done()
+	}
+	s.saving.Wait()
+}
+
+// waitSaves returns once no save of the session is running or ctx is done
+func (s *Session) waitSaves(ctx context.Context) error {
+	saved := make(chan struct{})
+	go func() {
+		s.saving.Wait()
+		close(saved)
+	}()
+
+	select {
+	case <-saved:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// evict removes the session from the hub, saves anything pending and gives
+// up ownership so another node can pick the session up.
+func (s *Session) evict() {
+	h := s.hub
+	h.mutex.Lock()
+	if h.sessions[s.sessionCode] == s {
+		delete(h.sessions, s.sessionCode)
+	}
+	close(s.done)
+	h.mutex.Unlock()
+
+	s.flush()
+
+	if s.owner {
+		if err := s.bus.Release(s.sessionCode); err != nil {
+			log.Printf("Failed to release ownership of session %s: %v", s.sessionCode, err)
+		}
+	}
+
+	h.counters.evicted.Add(1)
+	log.Printf("Evicted idle session %s", s.sessionCode)
+	if h.hooks.Evicted != nil {
+		h.hooks.Evicted(s.sessionCode)
+	}
+}
+
+// CloseSession disconnects everyone from a session that was deleted and
+// drops it from memory without saving, on this node and every other
+func (h *Hub) CloseSession(sessionCode string) {
+	err := h.bus.Publish(bus.Event{
+		Session: sessionCode,
+		Kind:    bus.KindDeleted,
+	})
+	if err != nil {
+		log.Printf("Failed to publish deletion of session %s: %v", sessionCode, err)
+	}
+	h.closeSession(sessionCode)
+}
+
+func (h *Hub) closeSession(sessionCode string) {
+	h.mutex.RLock()
+	session, ok := h.sessions[sessionCode]
+	h.mutex.RUnlock()
+	if ok {
+		session.do(session.discard)
+	}
+}
+
+// discard runs on the session goroutine. It closes every client and
+// removes the session like evict, but drops pending edits instead of saving
+// them. The goroutine stops after it.
+func (s *Session) discard() {
+	if s.saveTimer != nil && s.saveTimer.Stop() {
+		s.saving.Done()
+	}
+
+	for c := range s.clients {
+		c.SetCloseReason(closeDeleted, "session deleted")
+		close(c.Send)
+		delete(s.clients, c)
+		s.hub.counters.clients.Add(-1)
+	}
+	for c := range s.followers {
+		c.SetCloseReason(closeDeleted, "session deleted")
+		close(c.Send)
+		delete(s.followers, c)
+	}
+
+	h := s.hub
+	h.mutex.Lock()
+	if h.sessions[s.sessionCode] == s {
+		delete(h.sessions, s.sessionCode)
+	}
+	close(s.done)
+	h.mutex.Unlock()
+
+	if s.owner {
+		if err := s.bus.Release(s.sessionCode); err != nil {
+			log.Printf("Failed to release ownership of session %s: %v", s.sessionCode, err)
+		}
+	}
+	log.Printf("Closed deleted session %s", s.sessionCode)
+}
+
+// Shutdown tells every client the server is restarting, saves all pending
+// edits and closes the websockets. It returns once all clients have been
+// sent their close frame and every save has finished, or ctx is done.
+func (h *Hub) Shutdown(ctx context.Context) error {
+	h.mutex.RLock()
+	sessions := make([]*Session, 0, len(h.sessions))
+	for _, s := range h.sessions {
+		sessions = append(sessions, s)
+	}
+	h.mutex.RUnlock()
+
+	var closing []*client.Client
+	for _, s := range sessions {
+		reply := make(chan []*client.Client, 1)
+		select {
+		case s.stop <- reply:
+		case <-s.done:
+			continue
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		select {
+		case clients := <-reply:
+			closing = append(closing, clients...)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	for _, c := range closing {
+		select {
+		case <-c.Done():
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	// Sessions that were being evicted meanwhile may still be saving
+	for _, s := range sessions {
+		if err := s.waitSaves(ctx); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("Hub shut down %d sessions and %d clients", len(sessions), len(closing))
+	return nil
+}
+
+// shutdown runs on the session goroutine. It closes every client with a
+// restart notice, saves pending edits and returns the closed clients.
+func (s *Session) shutdown() []*client.Client {
+	closed := make([]*client.Client, 0, len(s.clients))
+	for c := range s.clients {
+		select {
+		case c.Send <- message.Message{
+			Type:    "restarting",
+			Content: "Server restarting",
+			UserID:  c.UserID,
+		}:
+		default:
+		}
+		c.SetCloseReason(websocket.CloseServiceRestart, "server restarting")
+		close(c.Send)
+		delete(s.clients, c)
+		s.hub.counters.clients.Add(-1)
+		closed = append(closed, c)
+	}
+	for c := range s.followers {
+		c.SetCloseReason(websocket.CloseServiceRestart, "server restarting")
+		close(c.Send)
+		delete(s.followers, c)
+		closed = append(closed, c)
+	}
+
+	s.flush()
+
+	if s.owner {
+		if err := s.bus.Release(s.sessionCode); err != nil {
+			log.Printf("Failed to release ownership of session %s: %v", s.sessionCode, err)
+		}
+	}
+	close(s.done)
+
+	return closed
+}
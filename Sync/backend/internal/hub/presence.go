@@ -0,0 +1,177 @@
+package hub
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strings"
+
+	"collab-editor/internal/bus"
+	"collab-editor/internal/client"
+	"collab-editor/internal/message"
+	"collab-editor/internal/ot"
+)
+
+// maxTabIDLength bounds the part of a connection ID the client picks
+const maxTabIDLength = 32
+
+// connectionID names a connection in presence messages. Signed-in users
+// pick an ID for their tab, which they keep across reconnects so resent
+// edits are recognised, and the server prefixes it with who is signed in,
+// so nobody can take another user's ID. Guests share one prefix, so their
+// tab comes from guestTab instead.
+func connectionID(dbUserID int, tab string) string {
+	tab = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+			return r
+		}
+		return -1
+	}, tab)
+	if len(tab) > maxTabIDLength {
+		tab = tab[:maxTabIDLength]
+	}
+	if tab == "" {
+		tab = randomTab()
+	}
+
+	if dbUserID > 0 {
+		return fmt.Sprintf("u%d-%s", dbUserID, tab)
+	}
+	return "guest-" + tab
+}
+
+// guestTab returns the tab of a guest connection and the token the guest
+// reconnects with to keep it. The server picks guest tabs, and only a tab
+// token it signed brings one back, so one guest cannot take over another's
+// ID and edit sequence.
+func (h *Hub) guestTab(token string) (string, string) {
+	if h.auth == nil {
+		return randomTab(), ""
+	}
+	if token != "" {
+		if tab, err := h.auth.ValidateGuestTab(token); err == nil {
+			return tab, token
+		}
+	}
+
+	tab := randomTab()
+	token, err := h.auth.GuestTab(tab)
+	if err != nil {
+		log.Printf("Failed to sign guest tab: %v", err)
+		return tab, ""
+	}
+	return tab, token
+}
+
+func randomTab() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// identity returns the name and avatar others see for a signed-in user
+func (h *Hub) identity(dbUserID int) (string, string) {
+	user, err := h.db.GetUserByID(dbUserID)
+	if err != nil {
+		log.Printf("Failed to load profile of user %d: %v", dbUserID, err)
+		return "", ""
+	}
+	if user.DisplayName != "" {
+		return user.DisplayName, user.AvatarURL
+	}
+	return user.Username, user.AvatarURL
+}
+
+// joinedMessage announces c to the other users of the session
+func joinedMessage(c *client.Client) message.Message {
+	return message.Message{
+		Type:      "userJoined",
+		UserID:    c.UserID,
+		Color:     c.Color,
+		Name:      c.Name,
+		AvatarURL: c.AvatarURL,
+	}
+}
+
+// maxRanges bounds the selections kept per client
+const maxRanges = 20
+
+// handlePresence keeps what a client has selected and relays it to
+// everyone. The ranges are moved from the revision the client saw onto the
+// current text.
+func (s *Session) handlePresence(msg message.Message) {
+	if msg.Presence == nil {
+		return
+	}
+	relay := s.setPresence(msg)
+	s.publish(bus.KindBroadcast, "", relay)
+	for c := range s.clients {
+		s.deliver(c, relay)
+	}
+}
+
+// setPresence stores the presence in msg, moved from msg.Revision onto the
+// current text, and returns msg as relayed at the current revision
+func (s *Session) setPresence(msg message.Message) message.Message {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	ranges := msg.Presence.Ranges
+	if len(ranges) > maxRanges {
+		ranges = ranges[:maxRanges]
+	}
+	length := ot.Length(s.engine.Content())
+	p := message.Presence{
+		Ranges: make([]message.Range, len(ranges)),
+		Idle:   msg.Presence.Idle,
+		Typing: msg.Presence.Typing,
+	}
+	for i, r := range ranges {
+		p.Ranges[i] = message.Range{
+			Anchor: clamp(s.engine.Rebase(msg.Revision, r.Anchor, true), 0, length),
+			Head:   clamp(s.engine.Rebase(msg.Revision, r.Head, true), 0, length),
+		}
+	}
+	if msg.Presence.Viewport != nil {
+		top := clamp(s.engine.Rebase(msg.Revision, *msg.Presence.Viewport, true), 0, length)
+		p.Viewport = &top
+	}
+	s.presence[msg.UserID] = p
+
+	relayed := copyPresence(p)
+	msg.Presence = &relayed
+	msg.Revision = s.engine.Revision()
+	return msg
+}
+
+// copyPresence returns a copy of p that shares nothing with it, as the
+// stored one keeps moving with edits
+func copyPresence(p message.Presence) message.Presence {
+	p.Ranges = append([]message.Range(nil), p.Ranges...)
+	if p.Viewport != nil {
+		top := *p.Viewport
+		p.Viewport = &top
+	}
+	return p
+}
+
+// presenceList returns copies of everyone's presence, by connection ID.
+// Callers hold s.mutex.
+func (s *Session) presenceList() map[string]message.Presence {
+	list := make(map[string]message.Presence, len(s.presence))
+	for id, p := range s.presence {
+		list[id] = copyPresence(p)
+	}
+	return list
+}
+
+// forgetPresence drops the presence of a client that left. Whoever was
+// following it stops.
+func (s *Session) forgetPresence(connID string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.presence, connID)
+	s.forgetTracking(connID)
+}
@@ -0,0 +1,322 @@
+package hub
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"collab-editor/internal/bus"
+	"collab-editor/internal/client"
+	"collab-editor/internal/db"
+	"collab-editor/internal/message"
+	"collab-editor/internal/ot"
+)
+
+// maxSuggestionLength bounds the text of a suggestion, in characters
+const maxSuggestionLength = 10000
+
+// loadSuggestions reads the pending suggestions of a session being opened
+func loadSuggestions(database *db.Database, sessionCode string) map[int]*db.Suggestion {
+	suggestions := make(map[int]*db.Suggestion)
+	list, err := database.PendingSuggestions(sessionCode)
+	if err != nil {
+		log.Printf("Failed to load suggestions of session %s: %v", sessionCode, err)
+		return suggestions
+	}
+	for i := range list {
+		suggestions[list[i].ID] = &list[i]
+	}
+	return suggestions
+}
+
+// handleSuggestion records a suggested change, or accepts or rejects
+// suggestions, for a signed-in client and announces the result
+func (s *Session) handleSuggestion(sender *client.Client, msg message.Message) {
+	author := sender.DBUserID
+	if author == 0 {
+		s.refuse(sender, "Sign in to suggest changes")
+		return
+	}
+
+	switch msg.Type {
+	case "suggest":
+		s.suggest(sender, author, msg)
+	case "accept", "reject":
+		s.resolveSuggestions(sender, author, msg.Type, []int{msg.SuggestionID})
+	case "acceptAll", "rejectAll":
+		s.mutex.RLock()
+		ids := make([]int, 0, len(s.suggestions))
+		for id := range s.suggestions {
+			ids = append(ids, id)
+		}
+		s.mutex.RUnlock()
+		s.resolveSuggestions(sender, author, strings.TrimSuffix(msg.Type, "All"), ids)
+	}
+}
+
+// suggest records the change a client proposes to the text between start
+// and end at msg.Revision. The client sends the text it saw there in
+// Content. A change that continues the author's own suggestion, as when
+// they keep typing, grows it rather than starting another.
+func (s *Session) suggest(sender *client.Client, author int, msg message.Message) {
+	if msg.Suggestion == nil {
+		s.refuse(sender, "Nothing to suggest")
+		return
+	}
+	text := msg.Suggestion.Text
+	if utf8.RuneCountInString(text) > maxSuggestionLength {
+		s.refuse(sender, "Suggestions must be at most 10000 characters")
+		return
+	}
+
+	s.mutex.RLock()
+	start, end := s.rangeAt(msg.Revision, msg.Suggestion.Start, msg.Suggestion.End, msg.Content)
+	s.mutex.RUnlock()
+	if start == end && text == "" {
+		return
+	}
+
+	if own, merged, ok := s.continued(author, start, end, text); ok {
+		if utf8.RuneCountInString(merged.Text) > maxSuggestionLength {
+			s.refuse(sender, "Suggestions must be at most 10000 characters")
+			return
+		}
+		err := s.db.UpdateSuggestion(merged.ID, merged.Start, merged.End, merged.Text)
+		if err == nil {
+			s.mutex.Lock()
+			*own = merged
+			s.mutex.Unlock()
+			s.announceSuggestions([]db.Suggestion{merged})
+			return
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			log.Printf("Failed to update suggestion in session %s: %v", s.sessionCode, err)
+			s.refuse(sender, "Failed to save suggestion")
+			return
+		}
+		// Resolved on another node meanwhile, start a new one
+	}
+
+	created, err := s.db.CreateSuggestion(s.sessionCode, author, start, end, text)
+	if err != nil {
+		log.Printf("Failed to save suggestion in session %s: %v", s.sessionCode, err)
+		s.refuse(sender, "Failed to save suggestion")
+		return
+	}
+	s.mutex.Lock()
+	s.suggestions[created.ID] = created
+	s.mutex.Unlock()
+	s.announceSuggestions([]db.Suggestion{*created})
+}
+
+// continued finds the author's latest suggestion that replacing start to
+// end with text carries on, and returns it with the change folded in
+func (s *Session) continued(author, start, end int, text string) (*db.Suggestion, db.Suggestion, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var latest *db.Suggestion
+	var merged db.Suggestion
+	for _, sg := range s.suggestions {
+		if sg.UserID != author || (latest != nil && sg.ID < latest.ID) {
+			continue
+		}
+		if m, ok := extend(*sg, start, end, text); ok {
+			latest, merged = sg, m
+		}
+	}
+	return latest, merged, latest != nil
+}
+
+// extend folds replacing start to end with text into sg if the change
+// continues it: typing on at its end, typing over what it deletes, or
+// deleting on from either edge
+func extend(sg db.Suggestion, start, end int, text string) (db.Suggestion, bool) {
+	switch {
+	case start == end && start == sg.End:
+		sg.Text += text
+	case start == end && start == sg.Start && sg.Text == "":
+		sg.Text = text
+	case text == "" && end == sg.Start:
+		sg.Start = start
+	case text == "" && start == sg.End:
+		sg.End = end
+	default:
+		return sg, false
+	}
+	return sg, true
+}
+
+// resolveSuggestions accepts or rejects suggestions. Accepting needs edit
+// rights and changes the text, crediting the authors; authors may also
+// reject their own suggestions.
+func (s *Session) resolveSuggestions(sender *client.Client, author int, action string, ids []int) {
+	s.mutex.RLock()
+	list := make([]db.Suggestion, 0, len(ids))
+	for _, id := range ids {
+		if sg, ok := s.suggestions[id]; ok {
+			list = append(list, *sg)
+		}
+	}
+	s.mutex.RUnlock()
+	if len(list) == 0 {
+		if len(ids) == 1 {
+			s.refuse(sender, "Suggestion not found")
+		}
+		return
+	}
+
+	if !sender.Role().CanEdit() && !(action == "reject" && len(ids) == 1 && list[0].UserID == author) {
+		s.refuse(sender, "Only editors can accept or reject suggestions")
+		return
+	}
+	status := db.SuggestionRejected
+	var edit *message.Message
+	if action == "accept" {
+		status = db.SuggestionAccepted
+		// Overlapping suggestions cannot all be applied, the rest stay
+		// pending. Nothing is marked accepted unless the edit can be made.
+		var err error
+		if edit, list, err = s.suggestionsEdit(list); err != nil {
+			log.Printf("Failed to apply suggestions in session %s: %v", s.sessionCode, err)
+			s.refuse(sender, "Failed to apply suggestions")
+			return
+		}
+	}
+
+	pick := make([]int, len(list))
+	for i, sg := range list {
+		pick[i] = sg.ID
+	}
+	resolved, err := s.db.ResolveSuggestions(s.sessionCode, pick, status, author)
+	if err != nil {
+		log.Printf("Failed to %s suggestions in session %s: %v", action, s.sessionCode, err)
+		s.refuse(sender, "Failed to update suggestions")
+		return
+	}
+	done := make(map[int]bool, len(resolved))
+	for _, id := range resolved {
+		done[id] = true
+	}
+
+	var changed []db.Suggestion
+	s.mutex.Lock()
+	for _, sg := range list {
+		if !done[sg.ID] {
+			continue
+		}
+		delete(s.suggestions, sg.ID)
+		sg.Status = status
+		sg.ResolvedBy = sender.Name
+		changed = append(changed, sg)
+	}
+	s.mutex.Unlock()
+	if len(changed) == 0 {
+		return
+	}
+
+	if status == db.SuggestionAccepted {
+		// Leave out suggestions resolved elsewhere in the meantime
+		if len(changed) < len(list) {
+			var err error
+			if edit, _, err = s.suggestionsEdit(changed); err != nil {
+				log.Printf("Failed to apply suggestions in session %s: %v", s.sessionCode, err)
+				edit = nil
+			}
+		}
+		if edit != nil {
+			authors := make([]int, len(changed))
+			for i, sg := range changed {
+				authors[i] = sg.UserID
+			}
+			s.applyEdit(nil, *edit, authors...)
+		}
+	}
+	s.announceSuggestions(changed)
+}
+
+// suggestionsEdit builds the edit by the server that carries out list as one
+// operation, skipping suggestions that overlap an earlier one. It returns
+// the edit, nil if the text stays the same, and the suggestions it covers.
+func (s *Session) suggestionsEdit(list []db.Suggestion) (*message.Message, []db.Suggestion, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	op, applied := db.SuggestionsOperation(s.engine.Content(), list)
+	if op.IsNoop() {
+		return nil, applied, nil
+	}
+	msg, err := s.engine.Edit(op)
+	if err != nil {
+		return nil, nil, err
+	}
+	msg.UserID = "server"
+	return &msg, applied, nil
+}
+
+// announceSuggestions tells everyone about new, changed or resolved
+// suggestions
+func (s *Session) announceSuggestions(list []db.Suggestion) {
+	s.mutex.RLock()
+	announce := message.Message{
+		Type:        "suggestions",
+		Revision:    s.engine.Revision(),
+		Suggestions: list,
+	}
+	s.mutex.RUnlock()
+
+	s.publish(bus.KindBroadcast, "", announce)
+	for c := range s.clients {
+		s.deliver(c, announce)
+	}
+}
+
+// mergeSuggestions takes in suggestions announced by another node, moving
+// pending ones from the revision they were announced at. It returns them as
+// this node sees them.
+func (s *Session) mergeSuggestions(list []db.Suggestion, revision int) []db.Suggestion {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	length := ot.Length(s.engine.Content())
+	merged := make([]db.Suggestion, len(list))
+	for i, sg := range list {
+		if sg.Status != db.SuggestionPending {
+			delete(s.suggestions, sg.ID)
+			merged[i] = sg
+			continue
+		}
+		sg.Start = clamp(s.engine.Rebase(revision, sg.Start, true), 0, length)
+		sg.End = clamp(s.engine.Rebase(revision, sg.End, false), sg.Start, length)
+		stored := sg
+		s.suggestions[sg.ID] = &stored
+		merged[i] = sg
+	}
+	// The owner saves where new suggestions have moved to
+	s.scheduleSave()
+	return merged
+}
+
+// setSuggestions replaces the pending suggestions with those of the session
+// owner. Callers hold s.mutex.
+func (s *Session) setSuggestions(list []db.Suggestion) {
+	s.suggestions = make(map[int]*db.Suggestion, len(list))
+	for i := range list {
+		sg := list[i]
+		s.suggestions[sg.ID] = &sg
+	}
+}
+
+// suggestionList returns copies of the pending suggestions, oldest first.
+// Callers hold s.mutex.
+func (s *Session) suggestionList() []db.Suggestion {
+	list := make([]db.Suggestion, 0, len(s.suggestions))
+	for _, sg := range s.suggestions {
+		list = append(list, *sg)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
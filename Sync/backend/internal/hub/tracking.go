@@ -0,0 +1,73 @@
+package hub
+
+import (
+	"collab-editor/internal/bus"
+	"collab-editor/internal/client"
+	"collab-editor/internal/message"
+)
+
+// handleTrack makes the sender follow another connection around the
+// document, or stop with an empty target, and tells everyone. This is
+// users following each other inside a session, unrelated to the read-only
+// followers of a publication.
+func (s *Session) handleTrack(sender *client.Client, msg message.Message) {
+	if msg.Target == sender.UserID {
+		return
+	}
+	if msg.Target != "" && !s.connected(msg.Target) {
+		s.refuse(sender, "That user has left the session")
+		return
+	}
+
+	s.setTracking(msg.UserID, msg.Target)
+	announce := message.Message{Type: "follow", UserID: msg.UserID, Target: msg.Target}
+	s.publish(bus.KindBroadcast, "", announce)
+	for c := range s.clients {
+		s.deliver(c, announce)
+	}
+}
+
+// connected reports whether a connection is in the session on any node
+func (s *Session) connected(connID string) bool {
+	if _, ok := s.remoteUsers[connID]; ok {
+		return true
+	}
+	for c := range s.clients {
+		if c.UserID == connID {
+			return true
+		}
+	}
+	return false
+}
+
+// setTracking records whom a connection follows, if anyone
+func (s *Session) setTracking(connID, target string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if target == "" {
+		delete(s.tracking, connID)
+	} else {
+		s.tracking[connID] = target
+	}
+}
+
+// forgetTracking stops a connection that left from following anyone, and
+// anyone from following it. Callers hold s.mutex.
+func (s *Session) forgetTracking(connID string) {
+	delete(s.tracking, connID)
+	for tracker, target := range s.tracking {
+		if target == connID {
+			delete(s.tracking, tracker)
+		}
+	}
+}
+
+// trackingList returns a copy of whom each connection follows. Callers
+// hold s.mutex.
+func (s *Session) trackingList() map[string]string {
+	list := make(map[string]string, len(s.tracking))
+	for connID, target := range s.tracking {
+		list[connID] = target
+	}
+	return list
+}
@@ -1,9 +1,145 @@
+// Package message defines the JSON frames exchanged over the websocket.
+//
+// Edits are sent as deltas rather than whole documents. In "ot" mode a
+// client sends {"type":"operation","revision":r,"seq":n,"operation":[...]}
+// where operation is a list of components (positive numbers retain, negative
+// numbers delete, strings insert), r is the server revision the delta was
+// made against and n is the client's own sequence number. The server rebases
+// the delta over anything the client has not seen yet, answers the sender
+// with {"type":"ack","revision":r2,"seq":n} and forwards the rebased delta to
+// everyone else. Deltas it cannot rebase are answered with a "resync" frame
+// carrying the full document and the reason in error.
+//
+// {"type":"presence","revision":r,"presence":{"ranges":[{"anchor":a,
+// "head":h}],"idle":false,"typing":true}} reports what a client has selected
+// in revision r, which it sends once none of its own edits are in flight.
+// A range runs from where the selection was started to where the caret is.
+// The server moves the ranges onto its current text, keeps them moving with
+// later edits and relays them at the revision they are for. viewport is the
+// position of the first character the client has in view. init carries the
+// latest presence of everyone in presences, by userId.
+//
+// {"type":"follow","target":id} makes the sender follow the connection id
+// around the document, as when someone presents it to the group; an empty
+// target stops following. It is announced to everyone, and init carries
+// who follows whom in follows.
+//
+// The init frame tells a client its role in the session. A "role" frame
+// announces a change; clients whose role does not allow editing must not
+// send edits, and the server drops any they do send. A guest who joined
+// through an invite link gets a pass in init, which it sends back as the
+// pass query parameter when it reconnects instead of using the invite again.
+//
+// userId identifies a connection, not a person. The server sets it, along
+// with name and avatarUrl from the signed-in account, on every frame it
+// relays, so clients cannot speak for someone else. Guests are given theirs
+// along with a tabToken in init, which they send back as the tab query
+// parameter to keep it when they reconnect.
+//
+// Signed-in commenters discuss the text in threads. {"type":"comment",
+// "revision":r,"thread":{"start":s,"end":e,"quote":q},"content":body}
+// starts one on the range s to e of revision r, "reply" adds content to the
+// thread threadId, and "resolve" and "reopen" change its state. Every change
+// is announced to everyone as {"type":"thread","thread":{...}} with the
+// whole thread; init carries all of them in threads. Anchors move with the
+// text, and refused requests are answered with an "error" frame.
+//
+// In suggestion mode commenters propose changes instead of making them:
+// {"type":"suggest","revision":r,"suggestion":{"start":s,"end":e,
+// "text":t},"content":seen} proposes replacing the range s to e, which read
+// seen, with t. Editors answer with "accept" or "reject" for suggestionId,
+// or "acceptAll" and "rejectAll"; authors may reject their own. Changes are
+// announced as {"type":"suggestions","suggestions":[...]} with each
+// suggestion's status, and init carries the pending ones in suggestions.
+//
+// Signed-in commenters also chat: {"type":"chat","content":body} is saved
+// and announced to everyone as {"type":"chat","chat":{...}}, whose mentions
+// are the user IDs of the session members it @mentions by username. init
+// carries the latest messages in chatHistory; older ones are paged in over
+// HTTP.
 package message
 
+import (
+	"collab-editor/internal/crdt"
+	"collab-editor/internal/db"
+	"collab-editor/internal/ot"
+)
+
 type Message struct {
-	Type      string `json:"type"`
-	Content   string `json:"content"`
-	UserID    string `json:"userId"`
-	CursorPos int    `json:"cursorPos,omitempty"`
-	Color     string `json:"color,omitempty"`
+	Type      string        `json:"type"`
+	Content   string        `json:"content,omitempty"`
+	UserID    string        `json:"userId"`
+	Color     string        `json:"color,omitempty"`
+	Name      string        `json:"name,omitempty"`
+	AvatarURL string        `json:"avatarUrl,omitempty"`
+	Revision  int           `json:"revision,omitempty"`
+	Seq       int           `json:"seq,omitempty"`
+	Error     string        `json:"error,omitempty"`
+	Operation *ot.Operation `json:"operation,omitempty"`
+	Mode      string        `json:"mode,omitempty"`
+	Changes   []crdt.Op     `json:"changes,omitempty"`
+	Role      string        `json:"role,omitempty"`
+	Pass      string        `json:"pass,omitempty"`
+	TabToken  string        `json:"tabToken,omitempty"`
+	Presence  *Presence     `json:"presence,omitempty"`
+	Target    string        `json:"target,omitempty"`
+
+	Presences map[string]Presence `json:"presences,omitempty"`
+	Follows   map[string]string   `json:"follows,omitempty"`
+
+	ThreadID int                `json:"threadId,omitempty"`
+	Thread   *db.CommentThread  `json:"thread,omitempty"`
+	Threads  []db.CommentThread `json:"threads,omitempty"`
+
+	SuggestionID int             `json:"suggestionId,omitempty"`
+	Suggestion   *db.Suggestion  `json:"suggestion,omitempty"`
+	Suggestions  []db.Suggestion `json:"suggestions,omitempty"`
+
+	Chat        *db.ChatMessage  `json:"chat,omitempty"`
+	ChatHistory []db.ChatMessage `json:"chatHistory,omitempty"`
+}
+
+// Range is a selection from Anchor, where it was started, to Head, where the
+// caret is. Both are the same for a bare caret.
+type Range struct {
+	Anchor int `json:"anchor"`
+	Head   int `json:"head"`
+}
+
+// Presence is what someone is doing in the document: what they have
+// selected and in view, whether they have stepped away and whether they are
+// typing
+type Presence struct {
+	Ranges   []Range `json:"ranges"`
+	Viewport *int    `json:"viewport,omitempty"`
+	Idle     bool    `json:"idle,omitempty"`
+	Typing   bool    `json:"typing,omitempty"`
+}
+
+// IsEdit reports whether the message changes the document text
+func (m Message) IsEdit() bool {
+	switch m.Type {
+	case "operation", "crdt", "update":
+		return true
+	}
+	return false
+}
+
+// IsComment reports whether the message starts or changes a comment thread
+func (m Message) IsComment() bool {
+	switch m.Type {
+	case "comment", "reply", "resolve", "reopen":
+		return true
+	}
+	return false
+}
+
+// IsSuggestion reports whether the message proposes, accepts or rejects a
+// suggested change
+func (m Message) IsSuggestion() bool {
+	switch m.Type {
+	case "suggest", "accept", "reject", "acceptAll", "rejectAll":
+		return true
+	}
+	return false
 }
@@ -0,0 +1,310 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"collab-editor/internal/oidc/oidctest"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const redirectURL = "http://app.test/api/oidc/callback"
+
+func newProvider(idp *oidctest.IdP) *Provider {
+	return NewProvider(Config{
+		Issuer:      idp.URL,
+		ClientID:    idp.ClientID,
+		RedirectURL: redirectURL,
+		Scopes:      []string{"openid", "email"},
+	})
+}
+
+// signIn runs the browser's part of the flow against the IdP and returns
+// the code it hands back
+func signIn(t *testing.T, p *Provider, state, nonce, verifier string) string {
+	t.Helper()
+	target, err := p.AuthCodeURL(context.Background(), state, nonce, verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	noRedirect := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := noRedirect.Get(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("authorize returned %s", resp.Status)
+	}
+
+	back, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := back.Query().Get("state"); got != state {
+		t.Fatalf("state came back as %q, want %q", got, state)
+	}
+	return back.Query().Get("code")
+}
+
+func TestChallenge(t *testing.T) {
+	// RFC 7636, appendix B
+	got := Challenge("dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk")
+	if want := "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"; got != want {
+		t.Errorf("Challenge = %q, want %q", got, want)
+	}
+}
+
+func TestAuthCodeURL(t *testing.T) {
+	idp := oidctest.New(t, "client")
+	p := newProvider(idp)
+
+	target, err := p.AuthCodeURL(context.Background(), "the-state", "the-nonce", "the-verifier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := u.Scheme + "://" + u.Host + u.Path; got != idp.URL+"/authorize" {
+		t.Errorf("endpoint = %q, want the discovered one", got)
+	}
+
+	want := map[string]string{
+		"response_type":         "code",
+		"client_id":             "client",
+		"redirect_uri":          redirectURL,
+		"scope":                 "openid email",
+		"state":                 "the-state",
+		"nonce":                 "the-nonce",
+		"code_challenge":        Challenge("the-verifier"),
+		"code_challenge_method": "S256",
+	}
+	for key, value := range want {
+		if got := u.Query().Get(key); got != value {
+			t.Errorf("%s = %q, want %q", key, got, value)
+		}
+	}
+	if u.Query().Has("code_verifier") {
+		t.Error("the verifier must not leave the server")
+	}
+}
+
+func TestDiscovery(t *testing.T) {
+	t.Run("issuer mismatch", func(t *testing.T) {
+		idp := oidctest.New(t, "client")
+		idp.Issuer = "https://evil.test"
+		if _, err := newProvider(idp).AuthCodeURL(context.Background(), "s", "n", "v"); err == nil {
+			t.Fatal("accepted a discovery document for another issuer")
+		}
+	})
+
+	t.Run("missing endpoints", func(t *testing.T) {
+		var srv *httptest.Server
+		srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			json.NewEncoder(w).Encode(map[string]string{"issuer": srv.URL})
+		}))
+		defer srv.Close()
+
+		p := NewProvider(Config{Issuer: srv.URL, ClientID: "client", RedirectURL: redirectURL})
+		if _, err := p.AuthCodeURL(context.Background(), "s", "n", "v"); err == nil {
+			t.Fatal("accepted a discovery document without endpoints")
+		}
+	})
+
+	t.Run("unavailable", func(t *testing.T) {
+		srv := httptest.NewServer(http.NotFoundHandler())
+		defer srv.Close()
+
+		p := NewProvider(Config{Issuer: srv.URL, ClientID: "client", RedirectURL: redirectURL})
+		if _, err := p.AuthCodeURL(context.Background(), "s", "n", "v"); err == nil {
+			t.Fatal("expected an error without a discovery document")
+		}
+	})
+}
+
+func TestExchange(t *testing.T) {
+	idp := oidctest.New(t, "client")
+	idp.Claims["email"] = "ana@example.com"
+	idp.Claims["email_verified"] = "true"
+	idp.Claims["preferred_username"] = "ana"
+	p := newProvider(idp)
+
+	code := signIn(t, p, "state", "nonce", "verifier")
+	claims, err := p.Exchange(context.Background(), code, "verifier", "nonce")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Claims{
+		Issuer:            idp.URL,
+		Subject:           "user-1",
+		Email:             "ana@example.com",
+		EmailVerified:     true,
+		PreferredUsername: "ana",
+	}
+	if *claims != want {
+		t.Errorf("claims = %+v, want %+v", *claims, want)
+	}
+
+	if _, err := p.Exchange(context.Background(), code, "verifier", "nonce"); err == nil {
+		t.Error("redeemed a code twice")
+	}
+}
+
+func TestExchangeChecksPKCE(t *testing.T) {
+	idp := oidctest.New(t, "client")
+	p := newProvider(idp)
+
+	code := signIn(t, p, "state", "nonce", "verifier")
+	if _, err := p.Exchange(context.Background(), code, "another-verifier", "nonce"); err == nil {
+		t.Fatal("the IdP accepted the code with the wrong verifier")
+	}
+}
+
+func TestExchangeChecksNonce(t *testing.T) {
+	idp := oidctest.New(t, "client")
+	p := newProvider(idp)
+
+	code := signIn(t, p, "state", "nonce", "verifier")
+	if _, err := p.Exchange(context.Background(), code, "verifier", "another-nonce"); err == nil {
+		t.Fatal("accepted an ID token for another sign-in")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	idp := oidctest.New(t, "client")
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		token func() string
+		ok    bool
+	}{
+		{"valid", func() string {
+			return idp.Sign(idp.IDToken("nonce"))
+		}, true},
+		{"signed by another key", func() string {
+			token := jwt.NewWithClaims(jwt.SigningMethodRS256, idp.IDToken("nonce"))
+			token.Header["kid"] = idp.KeyID
+			signed, _ := token.SignedString(otherKey)
+			return signed
+		}, false},
+		{"unknown key", func() string {
+			token := jwt.NewWithClaims(jwt.SigningMethodRS256, idp.IDToken("nonce"))
+			token.Header["kid"] = "rotated"
+			signed, _ := token.SignedString(otherKey)
+			return signed
+		}, false},
+		{"hmac with the client id", func() string {
+			signed, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, idp.IDToken("nonce")).SignedString([]byte("client"))
+			return signed
+		}, false},
+		{"unsigned", func() string {
+			signed, _ := jwt.NewWithClaims(jwt.SigningMethodNone, idp.IDToken("nonce")).SignedString(jwt.UnsafeAllowNoneSignatureType)
+			return signed
+		}, false},
+		{"wrong issuer", func() string {
+			claims := idp.IDToken("nonce")
+			claims["iss"] = "https://evil.test"
+			return idp.Sign(claims)
+		}, false},
+		{"wrong audience", func() string {
+			claims := idp.IDToken("nonce")
+			claims["aud"] = "another-client"
+			return idp.Sign(claims)
+		}, false},
+		{"several audiences without azp", func() string {
+			claims := idp.IDToken("nonce")
+			claims["aud"] = []string{"client", "another-client"}
+			return idp.Sign(claims)
+		}, false},
+		{"several audiences with azp", func() string {
+			claims := idp.IDToken("nonce")
+			claims["aud"] = []string{"client", "another-client"}
+			claims["azp"] = "client"
+			return idp.Sign(claims)
+		}, true},
+		{"expired", func() string {
+			claims := idp.IDToken("nonce")
+			claims["exp"] = time.Now().Add(-time.Hour).Unix()
+			return idp.Sign(claims)
+		}, false},
+		{"no expiry", func() string {
+			claims := idp.IDToken("nonce")
+			delete(claims, "exp")
+			return idp.Sign(claims)
+		}, false},
+		{"wrong nonce", func() string {
+			return idp.Sign(idp.IDToken("another-nonce"))
+		}, false},
+		{"no subject", func() string {
+			claims := idp.IDToken("nonce")
+			delete(claims, "sub")
+			return idp.Sign(claims)
+		}, false},
+	}
+
+	p := newProvider(idp)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := p.Verify(context.Background(), tt.token(), "nonce")
+			if tt.ok && err != nil {
+				t.Errorf("rejected: %v", err)
+			}
+			if !tt.ok && err == nil {
+				t.Error("accepted")
+			}
+		})
+	}
+}
+
+func TestVerifyRequiresNonce(t *testing.T) {
+	idp := oidctest.New(t, "client")
+	token := idp.Sign(idp.IDToken(""))
+	if _, err := newProvider(idp).Verify(context.Background(), token, ""); err == nil {
+		t.Fatal("accepted an ID token without a nonce")
+	}
+}
+
+func TestConfigFromEnv(t *testing.T) {
+	t.Setenv("OIDC_ISSUER", "")
+	if _, err := ConfigFromEnv(); err != ErrNotConfigured {
+		t.Errorf("without an issuer err = %v, want ErrNotConfigured", err)
+	}
+
+	t.Setenv("OIDC_ISSUER", "https://idp.test/")
+	t.Setenv("OIDC_CLIENT_ID", "")
+	if _, err := ConfigFromEnv(); err == nil {
+		t.Error("accepted a config without a client ID")
+	}
+
+	t.Setenv("OIDC_CLIENT_ID", "client")
+	t.Setenv("OIDC_REDIRECT_URL", redirectURL)
+	t.Setenv("OIDC_SCOPES", "")
+	cfg, err := ConfigFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Issuer != "https://idp.test" {
+		t.Errorf("issuer = %q, want the trailing slash trimmed", cfg.Issuer)
+	}
+	if strings.Join(cfg.Scopes, " ") != "openid email profile" {
+		t.Errorf("scopes = %v, want the defaults", cfg.Scopes)
+	}
+}
@@ -0,0 +1,187 @@
+// Package oidctest runs a mock OpenID Connect provider for tests. It serves
+// discovery, an authorization endpoint that hands out codes, a token
+// endpoint that enforces PKCE, and the JWKS of the key it signs with.
+package oidctest
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// IdP is a mock identity provider. Tests may change the exported fields
+// before running a flow.
+type IdP struct {
+	*httptest.Server
+	ClientID string
+	Key      *rsa.PrivateKey
+	KeyID    string
+	// Issuer is the issuer in discovery and ID tokens, the server's URL
+	// unless changed
+	Issuer string
+	// Claims are added to every ID token the token endpoint issues
+	Claims jwt.MapClaims
+
+	mu    sync.Mutex
+	codes map[string]grant
+}
+
+type grant struct {
+	challenge   string
+	redirectURI string
+	nonce       string
+}
+
+// New starts an IdP for clientID, stopped when the test ends
+func New(t testing.TB, clientID string) *IdP {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idp := &IdP{
+		ClientID: clientID,
+		Key:      key,
+		KeyID:    "test-key",
+		Claims:   jwt.MapClaims{"sub": "user-1"},
+		codes:    make(map[string]grant),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", idp.discovery)
+	mux.HandleFunc("/authorize", idp.authorize)
+	mux.HandleFunc("/token", idp.token)
+	mux.HandleFunc("/jwks", idp.jwks)
+	idp.Server = httptest.NewServer(mux)
+	idp.Issuer = idp.URL
+	t.Cleanup(idp.Close)
+	return idp
+}
+
+// IDToken returns claims for an ID token valid for the next hour, issued by
+// the IdP to its client for nonce
+func (idp *IdP) IDToken(nonce string) jwt.MapClaims {
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":   idp.Issuer,
+		"aud":   idp.ClientID,
+		"nonce": nonce,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	}
+	for k, v := range idp.Claims {
+		claims[k] = v
+	}
+	return claims
+}
+
+// Sign signs claims with the IdP's key
+func (idp *IdP) Sign(claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = idp.KeyID
+	signed, err := token.SignedString(idp.Key)
+	if err != nil {
+		panic(err)
+	}
+	return signed
+}
+
+func (idp *IdP) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]string{
+		"issuer":                 idp.Issuer,
+		"authorization_endpoint": idp.URL + "/authorize",
+		"token_endpoint":         idp.URL + "/token",
+		"jwks_uri":               idp.URL + "/jwks",
+	})
+}
+
+// authorize signs the user in straight away and redirects back with a code
+func (idp *IdP) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("response_type") != "code" || q.Get("client_id") != idp.ClientID {
+		http.Error(w, "unsupported request", http.StatusBadRequest)
+		return
+	}
+	if q.Get("code_challenge") == "" || q.Get("code_challenge_method") != "S256" {
+		http.Error(w, "PKCE with S256 is required", http.StatusBadRequest)
+		return
+	}
+
+	code := randomString()
+	idp.mu.Lock()
+	idp.codes[code] = grant{
+		challenge:   q.Get("code_challenge"),
+		redirectURI: q.Get("redirect_uri"),
+		nonce:       q.Get("nonce"),
+	}
+	idp.mu.Unlock()
+
+	back := url.Values{"code": {code}, "state": {q.Get("state")}}
+	http.Redirect(w, r, q.Get("redirect_uri")+"?"+back.Encode(), http.StatusFound)
+}
+
+// token redeems a code once, checking the PKCE verifier against the
+// challenge it was issued for
+func (idp *IdP) token(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.ParseForm() != nil {
+		http.Error(w, "invalid_request", http.StatusBadRequest)
+		return
+	}
+
+	idp.mu.Lock()
+	g, ok := idp.codes[r.PostForm.Get("code")]
+	delete(idp.codes, r.PostForm.Get("code"))
+	idp.mu.Unlock()
+
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	switch {
+	case !ok, r.PostForm.Get("grant_type") != "authorization_code":
+		http.Error(w, "invalid_grant", http.StatusBadRequest)
+	case r.PostForm.Get("redirect_uri") != g.redirectURI, r.PostForm.Get("client_id") != idp.ClientID:
+		http.Error(w, "invalid_grant", http.StatusBadRequest)
+	case base64.RawURLEncoding.EncodeToString(sum[:]) != g.challenge:
+		http.Error(w, "invalid_grant: code verifier does not match", http.StatusBadRequest)
+	default:
+		writeJSON(w, map[string]string{
+			"access_token": randomString(),
+			"token_type":   "Bearer",
+			"id_token":     idp.Sign(idp.IDToken(g.nonce)),
+		})
+	}
+}
+
+func (idp *IdP) jwks(w http.ResponseWriter, r *http.Request) {
+	pub := idp.Key.PublicKey
+	writeJSON(w, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": idp.KeyID,
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}},
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func randomString() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
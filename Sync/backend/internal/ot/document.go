@@ -0,0 +1,89 @@
+package ot
+
+// DefaultHistoryLimit is the minimum number of accepted operations a Document
+// keeps for transforming late operations. Clients further behind than that
+// may have to resync.
+const DefaultHistoryLimit = 1000
+
+// Document is the server-side authority for a single text. Every accepted
+// operation bumps the revision by one and is kept in the history so that
+// operations based on older revisions can be transformed before applying.
+type Document struct {
+	content string
+	history []Operation
+	// base is the revision of the oldest operation still in history
+	base  int
+	limit int
+}
+
+func NewDocument(content string) *Document {
+	return &Document{content: content, limit: DefaultHistoryLimit}
+}
+
+// NewDocumentAt starts a document whose content is already at revision, for
+// replicas that copy a document from another server.
+func NewDocumentAt(content string, revision int) *Document {
+	return &Document{content: content, base: revision, limit: DefaultHistoryLimit}
+}
+
+func (d *Document) Content() string {
+	return d.content
+}
+
+func (d *Document) Revision() int {
+	return d.base + len(d.history)
+}
+
+// Receive transforms op, which the client based on revision, against every
+// operation accepted since then and applies the result. The transformed
+// operation is returned so it can be sent to the other clients. Operations
+// based on revisions that have already dropped out of the history are
+// rejected with ErrStale.
+func (d *Document) Receive(revision int, op Operation) (Operation, error) {
+	if revision < 0 || revision > d.Revision() {
+		return Operation{}, ErrRevision
+	}
+	if revision < d.base {
+		return Operation{}, ErrStale
+	}
+
+	for _, concurrent := range d.history[revision-d.base:] {
+		var err error
+		op, _, err = Transform(op, concurrent)
+		if err != nil {
+			return Operation{}, err
+		}
+	}
+
+	content, err := op.Apply(d.content)
+	if err != nil {
+		return Operation{}, err
+	}
+
+	d.content = content
+	d.history = append(d.history, op)
+
+	// Trim in batches so the copy only happens once every limit operations
+	if len(d.history) >= 2*d.limit {
+		over := len(d.history) - d.limit
+		d.history = append([]Operation(nil), d.history[over:]...)
+		d.base += over
+	}
+	return op, nil
+}
+
+// TransformIndex moves position i, taken from the text at revision, through
+// every operation accepted since then. See Operation.TransformIndex for
+// pushed.
+func (d *Document) TransformIndex(revision, i int, pushed bool) (int, error) {
+	if revision < 0 || revision > d.Revision() {
+		return 0, ErrRevision
+	}
+	if revision < d.base {
+		return 0, ErrStale
+	}
+	for _, op := range d.history[revision-d.base:] {
+		i = op.TransformIndex(i, pushed)
+	}
+	return i, nil
+}
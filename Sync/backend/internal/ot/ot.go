@@ -0,0 +1,378 @@
+package ot
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"unicode/utf16"
+)
+
+var (
+	ErrBaseLength = errors.New("operation base length does not match document length")
+	ErrRevision   = errors.New("operation revision is out of range")
+	ErrStale      = errors.New("operation revision is too old to rebase")
+)
+
+// Component is a single step of an Operation. Exactly one of the fields is
+// set: Retain skips characters, Insert adds text and Delete removes characters.
+type Component struct {
+	Retain int
+	Insert string
+	Delete int
+}
+
+// Operation is a sequence of components that walks the whole document. All
+// lengths are counted in UTF-16 code units so they line up with JavaScript
+// string indexes on the client.
+type Operation struct {
+	Components   []Component
+	BaseLength   int
+	TargetLength int
+}
+
+// Length returns the length of s in UTF-16 code units.
+func Length(s string) int {
+	return len(utf16.Encode([]rune(s)))
+}
+
+func (o *Operation) Retain(n int) *Operation {
+	if n <= 0 {
+		return o
+	}
+	o.BaseLength += n
+	o.TargetLength += n
+	if last := len(o.Components) - 1; last >= 0 && o.Components[last].Retain > 0 {
+		o.Components[last].Retain += n
+		return o
+	}
+	o.Components = append(o.Components, Component{Retain: n})
+	return o
+}
+
+func (o *Operation) Insert(s string) *Operation {
+	if s == "" {
+		return o
+	}
+	o.TargetLength += Length(s)
+	last := len(o.Components) - 1
+	if last >= 0 && o.Components[last].Insert != "" {
+		o.Components[last].Insert += s
+		return o
+	}
+	// Keep inserts before deletes so equivalent operations compare equal
+	if last >= 0 && o.Components[last].Delete > 0 {
+		if last > 0 && o.Components[last-1].Insert != "" {
+			o.Components[last-1].Insert += s
+			return o
+		}
+		o.Components = append(o.Components, o.Components[last])
+		o.Components[last] = Component{Insert: s}
+		return o
+	}
+	o.Components = append(o.Components, Component{Insert: s})
+	return o
+}
+
+func (o *Operation) Delete(n int) *Operation {
+	if n <= 0 {
+		return o
+	}
+	o.BaseLength += n
+	if last := len(o.Components) - 1; last >= 0 && o.Components[last].Delete > 0 {
+		o.Components[last].Delete += n
+		return o
+	}
+	o.Components = append(o.Components, Component{Delete: n})
+	return o
+}
+
+// FromDiff builds the operation that turns oldText into newText, keeping the
+// common prefix and suffix and replacing whatever is in between.
+func FromDiff(oldText, newText string) Operation {
+	a := utf16.Encode([]rune(oldText))
+	b := utf16.Encode([]rune(newText))
+
+	start := 0
+	for start < len(a) && start < len(b) && a[start] == b[start] {
+		start++
+	}
+	// Characters that share a high surrogate must not be split apart, the
+	// inserted half on its own would not survive as a string
+	if start > 0 && isHighSurrogate(a[start-1]) {
+		start--
+	}
+	endA, endB := len(a), len(b)
+	for endA > start && endB > start && a[endA-1] == b[endB-1] {
+		endA--
+		endB--
+	}
+	if endA < len(a) && isLowSurrogate(a[endA]) {
+		endA++
+		endB++
+	}
+
+	var op Operation
+	op.Retain(start)
+	op.Delete(endA - start)
+	op.Insert(string(utf16.Decode(b[start:endB])))
+	op.Retain(len(a) - endA)
+	return op
+}
+
+func isHighSurrogate(u uint16) bool {
+	return u >= 0xd800 && u < 0xdc00
+}
+
+func isLowSurrogate(u uint16) bool {
+	return u >= 0xdc00 && u < 0xe000
+}
+
+// IsNoop reports whether applying the operation leaves the document unchanged.
+func (o *Operation) IsNoop() bool {
+	for _, c := range o.Components {
+		if c.Retain == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Apply runs the operation against doc and returns the resulting text.
+func (o *Operation) Apply(doc string) (string, error) {
+	src := utf16.Encode([]rune(doc))
+	if len(src) != o.BaseLength {
+		return "", ErrBaseLength
+	}
+
+	out := make([]uint16, 0, o.TargetLength)
+	pos := 0
+	for _, c := range o.Components {
+		switch {
+		case c.Retain > 0:
+			out = append(out, src[pos:pos+c.Retain]...)
+			pos += c.Retain
+		case c.Insert != "":
+			out = append(out, utf16.Encode([]rune(c.Insert))...)
+		case c.Delete > 0:
+			pos += c.Delete
+		}
+	}
+
+	return string(utf16.Decode(out)), nil
+}
+
+// Compose merges a and b into a single operation with the same effect as
+// applying a followed by b.
+func Compose(a, b Operation) (Operation, error) {
+	if a.TargetLength != b.BaseLength {
+		return Operation{}, fmt.Errorf("compose: first target length %d does not match second base length %d", a.TargetLength, b.BaseLength)
+	}
+
+	var result Operation
+	ai, bi := 0, 0
+	var ca, cb *Component
+	next := func(ops []Component, i *int) *Component {
+		if *i >= len(ops) {
+			return nil
+		}
+		c := ops[*i]
+		*i++
+		return &c
+	}
+	ca, cb = next(a.Components, &ai), next(b.Components, &bi)
+
+	for ca != nil || cb != nil {
+		if ca != nil && ca.Delete > 0 {
+			result.Delete(ca.Delete)
+			ca = next(a.Components, &ai)
+			continue
+		}
+		if cb != nil && cb.Insert != "" {
+			result.Insert(cb.Insert)
+			cb = next(b.Components, &bi)
+			continue
+		}
+		if ca == nil || cb == nil {
+			return Operation{}, errors.New("compose: operations have different lengths")
+		}
+
+		switch {
+		case ca.Retain > 0 && cb.Retain > 0:
+			n := min(ca.Retain, cb.Retain)
+			result.Retain(n)
+			ca.Retain -= n
+			cb.Retain -= n
+		case ca.Insert != "" && cb.Delete > 0:
+			units := utf16.Encode([]rune(ca.Insert))
+			n := min(len(units), cb.Delete)
+			ca.Insert = string(utf16.Decode(units[n:]))
+			cb.Delete -= n
+		case ca.Insert != "" && cb.Retain > 0:
+			units := utf16.Encode([]rune(ca.Insert))
+			n := min(len(units), cb.Retain)
+			result.Insert(string(utf16.Decode(units[:n])))
+			ca.Insert = string(utf16.Decode(units[n:]))
+			cb.Retain -= n
+		case ca.Retain > 0 && cb.Delete > 0:
+			n := min(ca.Retain, cb.Delete)
+			result.Delete(n)
+			ca.Retain -= n
+			cb.Delete -= n
+		}
+
+		if ca.Retain == 0 && ca.Insert == "" && ca.Delete == 0 {
+			ca = next(a.Components, &ai)
+		}
+		if cb.Retain == 0 && cb.Insert == "" && cb.Delete == 0 {
+			cb = next(b.Components, &bi)
+		}
+	}
+
+	return result, nil
+}
+
+// TransformIndex returns where position i of the document the operation
+// applies to ends up in the result. Text inserted exactly at i moves the
+// position along if pushed is set and stays after it otherwise; deleted
+// text around i collapses onto the start of the deletion.
+func (o *Operation) TransformIndex(i int, pushed bool) int {
+	pos, out := 0, i
+	for _, c := range o.Components {
+		switch {
+		case c.Retain > 0:
+			pos += c.Retain
+		case c.Insert != "":
+			if pos < i || (pos == i && pushed) {
+				out += Length(c.Insert)
+			}
+		case c.Delete > 0:
+			out -= min(i, pos+c.Delete) - min(i, pos)
+			pos += c.Delete
+		}
+		if pos > i {
+			break
+		}
+	}
+	return out
+}
+
+// Transform takes two concurrent operations a and b that apply to the same
+// document and returns a' and b' such that applying a then b' gives the same
+// result as applying b then a'. When both insert at the same position, a's
+// text ends up first.
+func Transform(a, b Operation) (Operation, Operation, error) {
+	if a.BaseLength != b.BaseLength {
+		return Operation{}, Operation{}, fmt.Errorf("transform: base lengths %d and %d differ", a.BaseLength, b.BaseLength)
+	}
+
+	var aPrime, bPrime Operation
+	ai, bi := 0, 0
+	var ca, cb *Component
+	next := func(ops []Component, i *int) *Component {
+		if *i >= len(ops) {
+			return nil
+		}
+		c := ops[*i]
+		*i++
+		return &c
+	}
+	ca, cb = next(a.Components, &ai), next(b.Components, &bi)
+
+	for ca != nil || cb != nil {
+		if ca != nil && ca.Insert != "" {
+			aPrime.Insert(ca.Insert)
+			bPrime.Retain(Length(ca.Insert))
+			ca = next(a.Components, &ai)
+			continue
+		}
+		if cb != nil && cb.Insert != "" {
+			aPrime.Retain(Length(cb.Insert))
+			bPrime.Insert(cb.Insert)
+			cb = next(b.Components, &bi)
+			continue
+		}
+		if ca == nil || cb == nil {
+			return Operation{}, Operation{}, errors.New("transform: operations have different lengths")
+		}
+
+		switch {
+		case ca.Retain > 0 && cb.Retain > 0:
+			n := min(ca.Retain, cb.Retain)
+			aPrime.Retain(n)
+			bPrime.Retain(n)
+			ca.Retain -= n
+			cb.Retain -= n
+		case ca.Delete > 0 && cb.Delete > 0:
+			// Both sides removed the same text, nothing left to do for it
+			n := min(ca.Delete, cb.Delete)
+			ca.Delete -= n
+			cb.Delete -= n
+		case ca.Delete > 0 && cb.Retain > 0:
+			n := min(ca.Delete, cb.Retain)
+			aPrime.Delete(n)
+			ca.Delete -= n
+			cb.Retain -= n
+		case ca.Retain > 0 && cb.Delete > 0:
+			n := min(ca.Retain, cb.Delete)
+			bPrime.Delete(n)
+			ca.Retain -= n
+			cb.Delete -= n
+		}
+
+		if ca.Retain == 0 && ca.Delete == 0 {
+			ca = next(a.Components, &ai)
+		}
+		if cb.Retain == 0 && cb.Delete == 0 {
+			cb = next(b.Components, &bi)
+		}
+	}
+
+	return aPrime, bPrime, nil
+}
+
+// MarshalJSON encodes the operation in the compact form used by the client:
+// positive numbers retain, negative numbers delete and strings insert.
+func (o Operation) MarshalJSON() ([]byte, error) {
+	parts := make([]interface{}, 0, len(o.Components))
+	for _, c := range o.Components {
+		switch {
+		case c.Retain > 0:
+			parts = append(parts, c.Retain)
+		case c.Insert != "":
+			parts = append(parts, c.Insert)
+		case c.Delete > 0:
+			parts = append(parts, -c.Delete)
+		}
+	}
+	return json.Marshal(parts)
+}
+
+func (o *Operation) UnmarshalJSON(data []byte) error {
+	var parts []interface{}
+	if err := json.Unmarshal(data, &parts); err != nil {
+		return err
+	}
+
+	*o = Operation{}
+	for _, p := range parts {
+		switch v := p.(type) {
+		case float64:
+			if v != float64(int(v)) || v == 0 {
+				return fmt.Errorf("invalid operation component %v", v)
+			}
+			if v > 0 {
+				o.Retain(int(v))
+			} else {
+				o.Delete(int(-v))
+			}
+		case string:
+			if v == "" {
+				return errors.New("invalid empty insert in operation")
+			}
+			o.Insert(v)
+		default:
+			return fmt.Errorf("invalid operation component %v", v)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,342 @@
+package ot
+
+import (
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"testing"
+)
+
+// op builds an operation from the client's compact form: positive numbers
+// retain, negative numbers delete and strings insert
+func op(parts ...interface{}) Operation {
+	var o Operation
+	for _, p := range parts {
+		switch v := p.(type) {
+		case int:
+			if v > 0 {
+				o.Retain(v)
+			} else {
+				o.Delete(-v)
+			}
+		case string:
+			o.Insert(v)
+		}
+	}
+	return o
+}
+
+func apply(t *testing.T, o Operation, doc string) string {
+	t.Helper()
+	out, err := o.Apply(doc)
+	if err != nil {
+		t.Fatalf("apply %v to %q: %v", o.Components, doc, err)
+	}
+	return out
+}
+
+func TestTransform(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  string
+		a, b Operation
+		want string
+	}{
+		// Inserts from a go first on a tie, as TextOperation.transform in
+		// frontend/src/js/ot.js does, so client and server converge
+		{"insert tie", "ab", op(1, "X", 1), op(1, "Y", 1), "aXYb"},
+		{"insert tie at start", "ab", op("X", 2), op("Y", 2), "XYab"},
+		{"insert tie at end", "ab", op(2, "X"), op(2, "Y"), "abXY"},
+		{"insert tie in empty document", "", op("X"), op("Y"), "XY"},
+		{"inserts apart", "abc", op("X", 3), op(3, "Y"), "XabcY"},
+
+		{"same delete", "abcdef", op(1, -3, 2), op(1, -3, 2), "aef"},
+		{"overlapping deletes", "abcdef", op(1, -3, 2), op(2, -3, 1), "af"},
+		{"delete inside delete", "abcdef", op(1, -4, 1), op(2, -2, 2), "af"},
+		{"adjacent deletes", "abcdef", op(1, -2, 3), op(3, -2, 1), "af"},
+		{"delete everything twice", "abc", op(-3), op(1, -1, 1), ""},
+
+		{"insert inside delete", "abcdef", op(1, -4, 1), op(3, "X", 3), "aXf"},
+		{"insert at delete start", "abcdef", op(1, -4, 1), op(1, "X", 5), "aXf"},
+		{"insert at delete end", "abcdef", op(1, -4, 1), op(5, "X", 1), "aXf"},
+		{"replace against replace", "abc", op(1, -1, "X", 1), op(1, -1, "Y", 1), "aXYc"},
+
+		// Lengths are UTF-16 code units: 😀 takes two
+		{"delete surrogate pair", "a😀b", op(1, -2, 1), op(3, "!", 1), "a!b"},
+		{"insert tie after surrogate pair", "😀", op(2, "é"), op(2, "👍"), "😀é👍"},
+		{"insert pair inside delete", "a😀b", op(-4), op(1, "🎉", 3), "🎉"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			aPrime, bPrime, err := Transform(tt.a, tt.b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ab := apply(t, bPrime, apply(t, tt.a, tt.doc))
+			ba := apply(t, aPrime, apply(t, tt.b, tt.doc))
+			if ab != tt.want || ba != tt.want {
+				t.Errorf("a then b' = %q, b then a' = %q, want %q", ab, ba, tt.want)
+			}
+		})
+	}
+}
+
+func TestTransformLengthMismatch(t *testing.T) {
+	if _, _, err := Transform(op(2, "X"), op(3, "Y")); err == nil {
+		t.Error("transformed operations on documents of different lengths")
+	}
+}
+
+func TestCompose(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  string
+		a, b Operation
+	}{
+		{"insert then insert", "ab", op(1, "X", 1), op(2, "Y", 1)},
+		{"insert then delete it", "ab", op(1, "XY", 1), op(1, -2, 1)},
+		{"insert then delete around it", "abc", op(1, "X", 2), op(-2, 1, -1)},
+		{"delete then insert", "abc", op(1, -1, 1), op(1, "X", 1)},
+		{"delete then delete", "abcdef", op(1, -2, 3), op(1, -2, 1)},
+		{"replace everything", "abc", op(-3, "XYZ"), op(-3, "Q")},
+		{"surrogate pairs", "a😀b", op(1, -2, "🎉", 1), op(3, "👍", 1)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := Compose(tt.a, tt.b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := apply(t, tt.b, apply(t, tt.a, tt.doc))
+			if got := apply(t, c, tt.doc); got != want {
+				t.Errorf("composed = %q, a then b = %q", got, want)
+			}
+		})
+	}
+}
+
+func TestComposeLengthMismatch(t *testing.T) {
+	if _, err := Compose(op(2, "X"), op(2)); err == nil {
+		t.Error("composed operations whose lengths do not line up")
+	}
+}
+
+// randomOp returns a random operation on doc that includes characters
+// outside the basic multilingual plane. It never splits a surrogate pair,
+// which a Go string cannot hold half of.
+func randomOp(r *rand.Rand, doc string) Operation {
+	var o Operation
+	runes := []rune(doc)
+	alphabet := []string{"a", "b", "é", "😀", "👍🏽", "\n"}
+	for len(runes) > 0 {
+		n := 1 + r.Intn(len(runes))
+		switch r.Intn(3) {
+		case 0:
+			o.Retain(Length(string(runes[:n])))
+			runes = runes[n:]
+		case 1:
+			o.Delete(Length(string(runes[:n])))
+			runes = runes[n:]
+		case 2:
+			o.Insert(alphabet[r.Intn(len(alphabet))])
+		}
+	}
+	if r.Intn(2) == 0 {
+		o.Insert(alphabet[r.Intn(len(alphabet))])
+	}
+	return o
+}
+
+func TestRandomOperations(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 2000; i++ {
+		doc := apply(t, randomOp(r, ""), "")
+		a := randomOp(r, doc)
+		afterA := apply(t, a, doc)
+		b := randomOp(r, afterA)
+
+		c, err := Compose(a, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := apply(t, c, doc), apply(t, b, afterA); got != want {
+			t.Fatalf("compose of %v and %v on %q = %q, want %q", a.Components, b.Components, doc, got, want)
+		}
+
+		concurrent := randomOp(r, doc)
+		aPrime, bPrime, err := Transform(a, concurrent)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ab := apply(t, bPrime, afterA)
+		ba := apply(t, aPrime, apply(t, concurrent, doc))
+		if ab != ba {
+			t.Fatalf("transform of %v and %v on %q diverged: %q and %q", a.Components, concurrent.Components, doc, ab, ba)
+		}
+	}
+}
+
+func TestLength(t *testing.T) {
+	tests := []struct {
+		s    string
+		want int
+	}{
+		{"", 0},
+		{"abc", 3},
+		{"é", 1},
+		{"😀", 2},
+		{"a😀b", 4},
+		{"👍🏽", 4},
+	}
+	for _, tt := range tests {
+		if got := Length(tt.s); got != tt.want {
+			t.Errorf("Length(%q) = %d, want %d", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestApplyChecksBaseLength(t *testing.T) {
+	// 😀 counts as two, so an operation over two characters does not fit
+	o := op(2)
+	if _, err := o.Apply("a😀"); !errors.Is(err, ErrBaseLength) {
+		t.Errorf("err = %v, want ErrBaseLength", err)
+	}
+}
+
+func TestFromDiff(t *testing.T) {
+	tests := []struct{ from, to string }{
+		{"", ""},
+		{"", "abc"},
+		{"abc", ""},
+		{"abc", "abc"},
+		{"abc", "aXc"},
+		{"a😀b", "a👍b"},
+		{"😀😀", "😀"},
+		{"😀", "👍"},
+		{"a\U0001F600", "a\U0001F640"},
+		{"\U00010600b", "\U0001F600b"},
+		{"hello world", "hello brave new world"},
+	}
+	for _, tt := range tests {
+		o := FromDiff(tt.from, tt.to)
+		if got := apply(t, o, tt.from); got != tt.to {
+			t.Errorf("FromDiff(%q, %q) gives %q", tt.from, tt.to, got)
+		}
+	}
+	if o := FromDiff("a😀b", "a👍b"); o.BaseLength != 4 || o.TargetLength != 4 {
+		t.Errorf("lengths %d and %d, want UTF-16 lengths 4 and 4", o.BaseLength, o.TargetLength)
+	}
+}
+
+func TestJSON(t *testing.T) {
+	o := op(2, "😀", -3, 1)
+	data, err := json.Marshal(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `[2,"😀",-3,1]` {
+		t.Errorf("marshaled to %s", data)
+	}
+
+	var back Operation
+	if err := json.Unmarshal(data, &back); err != nil {
+		t.Fatal(err)
+	}
+	if back.BaseLength != 6 || back.TargetLength != 5 {
+		t.Errorf("lengths %d and %d, want 6 and 5", back.BaseLength, back.TargetLength)
+	}
+
+	for _, bad := range []string{`[0]`, `[1.5]`, `[""]`, `[true]`, `{}`} {
+		if err := json.Unmarshal([]byte(bad), &back); err == nil {
+			t.Errorf("accepted %s", bad)
+		}
+	}
+}
+
+func TestDocumentReceive(t *testing.T) {
+	d := NewDocument("ab")
+	if _, err := d.Receive(0, op(1, "X", 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another client also based its edit on revision 0 and loses the tie
+	// against the operation already accepted, which is transformed first
+	got, err := d.Receive(0, op(1, "Y", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Content() != "aYXb" || d.Revision() != 2 {
+		t.Errorf("content %q at revision %d, want \"aYXb\" at 2", d.Content(), d.Revision())
+	}
+	if got.BaseLength != 3 {
+		t.Errorf("returned operation applies to length %d, want the transformed one", got.BaseLength)
+	}
+
+	if _, err := d.Receive(3, op(4)); !errors.Is(err, ErrRevision) {
+		t.Errorf("future revision: err = %v, want ErrRevision", err)
+	}
+	if _, err := d.Receive(-1, op(4)); !errors.Is(err, ErrRevision) {
+		t.Errorf("negative revision: err = %v, want ErrRevision", err)
+	}
+}
+
+func TestDocumentTrimmedHistory(t *testing.T) {
+	d := NewDocument("")
+	d.limit = 2
+
+	// Four edits make the history reach twice the limit, which trims it
+	// back to the last two
+	for i := 0; i < 4; i++ {
+		if _, err := d.Receive(i, op(i, "a")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d.base != 2 || len(d.history) != 2 || d.Revision() != 4 {
+		t.Fatalf("base %d with %d operations, want 2 with 2", d.base, len(d.history))
+	}
+
+	if _, err := d.Receive(1, op(1, "X")); !errors.Is(err, ErrStale) {
+		t.Errorf("trimmed revision: err = %v, want ErrStale", err)
+	}
+	if _, err := d.TransformIndex(1, 0, true); !errors.Is(err, ErrStale) {
+		t.Errorf("trimmed revision: TransformIndex err = %v, want ErrStale", err)
+	}
+
+	// The oldest revision still kept is transformed against both operations
+	if _, err := d.Receive(2, op("X", 2)); err != nil {
+		t.Fatal(err)
+	}
+	if d.Content() != "Xaaaa" {
+		t.Errorf("content %q, want \"Xaaaa\"", d.Content())
+	}
+	i, err := d.TransformIndex(2, 2, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i != 5 {
+		t.Errorf("index 2 at revision 2 moved to %d, want 5", i)
+	}
+}
+
+func TestTransformIndex(t *testing.T) {
+	o := op(1, "XY", -2, 1)
+	tests := []struct {
+		i      int
+		pushed bool
+		want   int
+	}{
+		{0, true, 0},
+		{1, true, 3},
+		{1, false, 1},
+		{2, true, 3},
+		{3, true, 3},
+		{4, true, 4},
+	}
+	for _, tt := range tests {
+		if got := o.TransformIndex(tt.i, tt.pushed); got != tt.want {
+			t.Errorf("TransformIndex(%d, %v) = %d, want %d", tt.i, tt.pushed, got, tt.want)
+		}
+	}
+}
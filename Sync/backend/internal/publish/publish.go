@@ -0,0 +1,294 @@
+// Package publish serves public, read-only snapshots of sessions.
+package publish
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+
+	"collab-editor/internal/access"
+	"collab-editor/internal/auth"
+	"collab-editor/internal/db"
+	"collab-editor/internal/hub"
+)
+
+type PublishHandler struct {
+	db   *db.Database
+	auth *auth.AuthHandler
+	hub  *hub.Hub
+}
+
+type PublishRequest struct {
+	SessionCode string `json:"session_code"`
+	Live        bool   `json:"live"`
+}
+
+type PublishResponse struct {
+	Publication *db.Publication `json:"publication"`
+	URL         string          `json:"url"`
+}
+
+func NewPublishHandler(database *db.Database, authHandler *auth.AuthHandler, h *hub.Hub) *PublishHandler {
+	return &PublishHandler{
+		db:   database,
+		auth: authHandler,
+		hub:  h,
+	}
+}
+
+// Publications lists (GET), creates (POST) and takes down (DELETE) the
+// public snapshots of a session. Anyone who can edit a session can publish
+// it.
+func (h *PublishHandler) Publications(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		h.list(w, r)
+	case http.MethodPost:
+		h.publish(w, r)
+	case http.MethodDelete:
+		h.unpublish(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *PublishHandler) list(w http.ResponseWriter, r *http.Request) {
+	sessionCode := r.URL.Query().Get("session")
+	if sessionCode == "" {
+		http.Error(w, "Session code required", http.StatusBadRequest)
+		return
+	}
+
+	if _, _, ok := h.auth.Authorize(w, r, sessionCode, access.Role.CanView); !ok {
+		return
+	}
+
+	publications, err := h.db.ListPublications(sessionCode)
+	if err != nil {
+		http.Error(w, "Failed to list publications", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(publications)
+}
+
+func (h *PublishHandler) publish(w http.ResponseWriter, r *http.Request) {
+	var req PublishRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.SessionCode == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	userID, _, ok := h.auth.Authorize(w, r, req.SessionCode, access.Role.CanEdit)
+	if !ok {
+		return
+	}
+	if userID == 0 {
+		http.Error(w, "Login required", http.StatusUnauthorized)
+		return
+	}
+
+	slug, err := newSlug()
+	if err != nil {
+		http.Error(w, "Failed to publish document", http.StatusInternalServerError)
+		return
+	}
+
+	// Snapshot what users see right now, which may not be saved yet
+	content := h.hub.Content(req.SessionCode)
+	publication, err := h.db.CreatePublication(req.SessionCode, slug, content, req.Live, userID)
+	if err != nil {
+		log.Printf("Failed to publish session %s: %v", req.SessionCode, err)
+		http.Error(w, "Failed to publish document", http.StatusInternalServerError)
+		return
+	}
+	publication.Content = ""
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(PublishResponse{
+		Publication: publication,
+		URL:         "/p/" + slug,
+	})
+}
+
+func (h *PublishHandler) unpublish(w http.ResponseWriter, r *http.Request) {
+	sessionCode := r.URL.Query().Get("session")
+	slug := r.URL.Query().Get("slug")
+	if sessionCode == "" || slug == "" {
+		http.Error(w, "Session code and slug required", http.StatusBadRequest)
+		return
+	}
+
+	if _, _, ok := h.auth.Authorize(w, r, sessionCode, access.Role.CanEdit); !ok {
+		return
+	}
+
+	deleted, err := h.db.DeletePublication(sessionCode, slug)
+	if err != nil {
+		http.Error(w, "Failed to unpublish document", http.StatusInternalServerError)
+		return
+	}
+	if !deleted {
+		http.Error(w, "Publication not found", http.StatusNotFound)
+		return
+	}
+	h.hub.Unpublish(sessionCode, slug)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"status": "unpublished",
+		"slug":   slug,
+	})
+}
+
+// View renders a publication at /p/{slug}. With ?live=1 a live publication
+// follows the session as it is edited instead of showing the snapshot.
+func (h *PublishHandler) View(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	publication, ok := h.load(w, strings.TrimPrefix(r.URL.Path, "/p/"))
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := pageTemplate.Execute(w, page{
+		Publication: publication,
+		Following:   publication.Live && r.URL.Query().Get("live") == "1",
+	})
+	if err != nil {
+		log.Printf("Failed to render publication %s: %v", publication.Slug, err)
+	}
+}
+
+// Follow serves the read-only websocket of a live publication
+func (h *PublishHandler) Follow(w http.ResponseWriter, r *http.Request) {
+	publication, ok := h.load(w, r.URL.Query().Get("slug"))
+	if !ok {
+		return
+	}
+	if !publication.Live {
+		http.Error(w, "Publication cannot be followed live", http.StatusForbidden)
+		return
+	}
+
+	hub.ServeFollower(h.hub, w, r, publication.SessionCode, publication.Slug)
+}
+
+// load fetches a publication and writes the error response if it fails
+func (h *PublishHandler) load(w http.ResponseWriter, slug string) (*db.Publication, bool) {
+	publication, err := h.db.GetPublication(slug)
+	if errors.Is(err, sql.ErrNoRows) || slug == "" {
+		http.Error(w, "Publication not found", http.StatusNotFound)
+		return nil, false
+	}
+	if err != nil {
+		http.Error(w, "Failed to load publication", http.StatusInternalServerError)
+		return nil, false
+	}
+	return publication, true
+}
+
+// newSlug returns an unguessable identifier for a publication URL
+func newSlug() (string, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+type page struct {
+	Publication *db.Publication
+	Following   bool
+}
+
+var pageTemplate = template.Must(template.New("publication").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>Published document</title>
+    <style>
+        body { font-family: system-ui, sans-serif; background: #f3f4f6; margin: 0; padding: 2rem; }
+        main { max-width: 48rem; margin: 0 auto; background: #fff; border-radius: 0.5rem; padding: 2rem; box-shadow: 0 1px 3px rgba(0,0,0,0.1); }
+        header { color: #6b7280; font-size: 0.875rem; margin-bottom: 1.5rem; }
+        #content { white-space: pre-wrap; word-wrap: break-word; font-family: ui-monospace, monospace; line-height: 1.5; }
+    </style>
+</head>
+<body>
+<main>
+    <header>
+        {{if .Following}}<span id="status">Connecting...</span>{{else}}Published{{end}}
+        {{with .Publication.PublishedBy}}by {{.}}{{end}}
+        on {{.Publication.CreatedAt.Format "2 January 2006, 15:04"}}
+        {{if and .Publication.Live (not .Following)}}&middot; <a href="?live=1">Follow live</a>{{end}}
+        {{if .Following}}&middot; <a href="?">Show snapshot</a>{{end}}
+    </header>
+    <div id="content">{{.Publication.Content}}</div>
+</main>
+{{if .Following}}
+<script>
+(function() {
+    const contentEl = document.getElementById('content');
+    const statusEl = document.getElementById('status');
+    const scheme = location.protocol === 'https:' ? 'wss' : 'ws';
+    const url = scheme + '://' + location.host + '/ws/public?slug={{.Publication.Slug}}';
+    let text = contentEl.textContent;
+
+    // Applies an OT operation: positive numbers retain, negative numbers
+    // delete and strings insert
+    function apply(ops) {
+        const parts = [];
+        let pos = 0;
+        ops.forEach(c => {
+            if (typeof c === 'string') {
+                parts.push(c);
+            } else if (c > 0) {
+                parts.push(text.slice(pos, pos + c));
+                pos += c;
+            } else {
+                pos -= c;
+            }
+        });
+        text = parts.join('');
+    }
+
+    function connect() {
+        const ws = new WebSocket(url);
+        ws.onopen = () => { statusEl.textContent = 'Following live'; };
+        ws.onmessage = (event) => {
+            const msg = JSON.parse(event.data);
+            if (msg.type === 'operation') {
+                apply(msg.operation);
+            } else {
+                text = msg.content || '';
+            }
+            contentEl.textContent = text;
+        };
+        ws.onclose = (event) => {
+            if (event.code === 4004) {
+                statusEl.textContent = 'This publication was removed';
+                return;
+            }
+            statusEl.textContent = 'Disconnected - reconnecting...';
+            setTimeout(connect, 3000);
+        };
+    }
+    connect();
+})();
+</script>
+{{end}}
+</body>
+</html>
+`))
@@ -0,0 +1,116 @@
+package totp
+
+import (
+	"encoding/base32"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// The SHA1 secret of RFC 6238 appendix B, "12345678901234567890"
+var rfcSecret = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+
+func TestCodeRFC6238(t *testing.T) {
+	// The RFC lists 8 digit codes; 6 digit codes are their last 6 digits
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		got, err := Code(rfcSecret, Step(time.Unix(tt.unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("code at %d = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestCodeLowercaseSecret(t *testing.T) {
+	upper, err := Code("GEZDGNBVGY3TQOJQ", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lower, err := Code("gezdgnbvgy3tqojq", 1)
+	if err != nil || lower != upper {
+		t.Errorf("lowercase secret gives %q, %v; want %q", lower, err, upper)
+	}
+
+	if _, err := Code("not base32!", 1); err == nil {
+		t.Error("accepted a secret that is not base32")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	step := Step(now)
+	code := func(s int64) string {
+		c, err := Code(rfcSecret, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	tests := []struct {
+		name string
+		code string
+		ok   bool
+		step int64
+	}{
+		{"current", code(step), true, step},
+		{"previous", code(step - 1), true, step - 1},
+		{"next", code(step + 1), true, step + 1},
+		{"two behind", code(step - 2), false, 0},
+		{"two ahead", code(step + 2), false, 0},
+		{"with spaces", "050 471", true, step},
+		{"too short", "05047", false, 0},
+		{"too long", "0504710", false, 0},
+		{"empty", "", false, 0},
+	}
+	for _, tt := range tests {
+		got, ok := Validate(rfcSecret, tt.code, now)
+		if ok != tt.ok || got != tt.step {
+			t.Errorf("%s: Validate(%q) = %d, %v; want %d, %v", tt.name, tt.code, got, ok, tt.step, tt.ok)
+		}
+	}
+}
+
+func TestGenerateSecret(t *testing.T) {
+	a, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a == b || len(a) != 32 {
+		t.Errorf("secrets %q and %q, want two different 160 bit secrets", a, b)
+	}
+	if _, err := Code(a, 1); err != nil {
+		t.Errorf("generated secret does not decode: %v", err)
+	}
+}
+
+func TestURI(t *testing.T) {
+	u, err := url.Parse(URI("Collab Editor", "ana@example.com", "SECRET"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Scheme != "otpauth" || u.Host != "totp" || u.Path != "/Collab Editor:ana@example.com" {
+		t.Errorf("URI is %s", u)
+	}
+	q := u.Query()
+	if q.Get("secret") != "SECRET" || q.Get("issuer") != "Collab Editor" || q.Get("digits") != "6" || q.Get("period") != "30" {
+		t.Errorf("URI parameters are %v", q)
+	}
+}
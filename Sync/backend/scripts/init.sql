@@ -4,6 +4,84 @@ CREATE TABLE IF NOT EXISTS users (
     username VARCHAR(50) UNIQUE NOT NULL,
     email VARCHAR(100) UNIQUE NOT NULL,
     password_hash VARCHAR(255) NOT NULL,
+    email_verified BOOLEAN NOT NULL DEFAULT FALSE,
+    display_name VARCHAR(100) NOT NULL DEFAULT '',
+    avatar_url VARCHAR(500) NOT NULL DEFAULT '',
+    totp_secret VARCHAR(64),
+    totp_enabled BOOLEAN NOT NULL DEFAULT FALSE,
+    totp_last_step BIGINT NOT NULL DEFAULT 0,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Create refresh_tokens table (rotating refresh tokens, stored hashed).
+-- Every sign-in starts a login; rotated tokens stay in it.
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+    login_id VARCHAR(32) NOT NULL,
+    token_hash CHAR(64) UNIQUE NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    revoked_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Create api_keys table (personal keys for scripts, stored hashed). The
+-- prefix is kept in the clear so users can tell their keys apart.
+CREATE TABLE IF NOT EXISTS api_keys (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+    name VARCHAR(100) NOT NULL,
+    prefix VARCHAR(16) NOT NULL,
+    key_hash CHAR(64) UNIQUE NOT NULL,
+    scopes TEXT[] NOT NULL,
+    expires_at TIMESTAMP,
+    last_used_at TIMESTAMP,
+    revoked_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Create user_tokens table (single-use links sent by email, stored hashed).
+-- Verification links are bound to the address they were sent to.
+CREATE TABLE IF NOT EXISTS user_tokens (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+    purpose VARCHAR(20) NOT NULL,
+    token_hash CHAR(64) UNIQUE NOT NULL,
+    email VARCHAR(100) NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Create recovery_codes table (one-time second factor codes, stored hashed)
+CREATE TABLE IF NOT EXISTS recovery_codes (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+    code_hash CHAR(64) NOT NULL,
+    used_at TIMESTAMP,
+    UNIQUE (user_id, code_hash)
+);
+
+-- Create user_identities table (accounts at single sign-on providers).
+-- A user signs in with the provider once their issuer and subject are here.
+CREATE TABLE IF NOT EXISTS user_identities (
+    issuer VARCHAR(255) NOT NULL,
+    subject VARCHAR(255) NOT NULL,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    email VARCHAR(100),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (issuer, subject)
+);
+
+-- Create auth_attempts table (audit of sign-in attempts, which also drives
+-- backoff and lockout across all instances)
+CREATE TABLE IF NOT EXISTS auth_attempts (
+    id SERIAL PRIMARY KEY,
+    kind VARCHAR(20) NOT NULL,
+    username VARCHAR(100),
+    ip VARCHAR(64) NOT NULL,
+    success BOOLEAN NOT NULL,
+    reason VARCHAR(50),
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 );
 
@@ -11,6 +89,8 @@ CREATE TABLE IF NOT EXISTS users (
 CREATE TABLE IF NOT EXISTS editing_sessions (
     id SERIAL PRIMARY KEY,
     session_code VARCHAR(6) UNIQUE NOT NULL,
+    engine VARCHAR(10) NOT NULL DEFAULT 'ot',
+    owner_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     last_modified TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 );
@@ -20,11 +100,19 @@ CREATE TABLE IF NOT EXISTS documents (
     id SERIAL PRIMARY KEY,
     session_id INTEGER REFERENCES editing_sessions(id) ON DELETE CASCADE,
     content TEXT,
+    state BYTEA,
     version INTEGER DEFAULT 1,
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 );
 
+-- Create document_authors table (users who edited since the previous version)
+CREATE TABLE IF NOT EXISTS document_authors (
+    document_id INTEGER REFERENCES documents(id) ON DELETE CASCADE,
+    user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+    PRIMARY KEY (document_id, user_id)
+);
+
 -- Create user_sessions table (many-to-many relationship)
 CREATE TABLE IF NOT EXISTS user_sessions (
     user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
@@ -34,7 +122,127 @@ CREATE TABLE IF NOT EXISTS user_sessions (
     PRIMARY KEY (user_id, session_id)
 );
 
+-- Create session_members table (roles granted by the session owner)
+CREATE TABLE IF NOT EXISTS session_members (
+    session_id INTEGER REFERENCES editing_sessions(id) ON DELETE CASCADE,
+    user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+    role VARCHAR(10) NOT NULL CHECK (role IN ('owner', 'editor', 'commenter', 'viewer')),
+    granted_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (session_id, user_id)
+);
+
+-- Sessions from before owners were recorded belong to the first user who
+-- opened them, so that the next user to sign in cannot claim them
+ALTER TABLE editing_sessions ADD COLUMN IF NOT EXISTS owner_id INTEGER REFERENCES users(id) ON DELETE SET NULL;
+
+UPDATE editing_sessions es SET owner_id = earliest.user_id
+FROM (
+    SELECT DISTINCT ON (session_id) session_id, user_id
+    FROM user_sessions
+    ORDER BY session_id, joined_at, user_id
+) earliest
+WHERE earliest.session_id = es.id AND es.owner_id IS NULL;
+
+INSERT INTO session_members (session_id, user_id, role)
+SELECT id, owner_id, 'owner' FROM editing_sessions WHERE owner_id IS NOT NULL
+ON CONFLICT (session_id, user_id) DO UPDATE SET role = 'owner';
+
+-- Create session_invites table (invite links minted by the session owner)
+CREATE TABLE IF NOT EXISTS session_invites (
+    id SERIAL PRIMARY KEY,
+    session_id INTEGER REFERENCES editing_sessions(id) ON DELETE CASCADE,
+    role VARCHAR(10) NOT NULL CHECK (role IN ('editor', 'commenter', 'viewer')),
+    created_by INTEGER REFERENCES users(id) ON DELETE CASCADE,
+    expires_at TIMESTAMP NOT NULL,
+    max_uses INTEGER,
+    uses INTEGER NOT NULL DEFAULT 0,
+    revoked_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Create publications table (public, immutable snapshots of a session)
+CREATE TABLE IF NOT EXISTS publications (
+    id SERIAL PRIMARY KEY,
+    slug VARCHAR(32) UNIQUE NOT NULL,
+    session_id INTEGER REFERENCES editing_sessions(id) ON DELETE CASCADE,
+    content TEXT NOT NULL,
+    live BOOLEAN NOT NULL DEFAULT FALSE,
+    published_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Create comment_threads table (discussions anchored to a range of the
+-- text; the anchor moves with edits and is saved along with the document)
+CREATE TABLE IF NOT EXISTS comment_threads (
+    id SERIAL PRIMARY KEY,
+    session_id INTEGER REFERENCES editing_sessions(id) ON DELETE CASCADE,
+    anchor_start INTEGER NOT NULL,
+    anchor_end INTEGER NOT NULL,
+    quote TEXT NOT NULL,
+    created_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    resolved_at TIMESTAMP,
+    resolved_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Create comments table (the messages of a thread)
+CREATE TABLE IF NOT EXISTS comments (
+    id SERIAL PRIMARY KEY,
+    thread_id INTEGER REFERENCES comment_threads(id) ON DELETE CASCADE,
+    user_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    body TEXT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Create suggestions table (proposed replacements of a range of the text,
+-- anchored like comment threads until accepted or rejected)
+CREATE TABLE IF NOT EXISTS suggestions (
+    id SERIAL PRIMARY KEY,
+    session_id INTEGER REFERENCES editing_sessions(id) ON DELETE CASCADE,
+    user_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    anchor_start INTEGER NOT NULL,
+    anchor_end INTEGER NOT NULL,
+    text TEXT NOT NULL,
+    status VARCHAR(10) NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'accepted', 'rejected')),
+    resolved_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    resolved_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Create chat_messages table (the chat of a session; mentions holds the
+-- IDs of members @mentioned)
+CREATE TABLE IF NOT EXISTS chat_messages (
+    id SERIAL PRIMARY KEY,
+    session_id INTEGER REFERENCES editing_sessions(id) ON DELETE CASCADE,
+    user_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    body TEXT NOT NULL,
+    mentions INTEGER[] NOT NULL DEFAULT '{}',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Create hub_events table (bus payloads too large for NOTIFY)
+CREATE TABLE IF NOT EXISTS hub_events (
+    id BIGSERIAL PRIMARY KEY,
+    payload TEXT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
 -- Create indexes for performance
 CREATE INDEX idx_sessions_code ON editing_sessions(session_code);
+CREATE INDEX idx_refresh_tokens_login ON refresh_tokens(login_id);
+CREATE INDEX idx_refresh_tokens_user ON refresh_tokens(user_id);
+CREATE INDEX idx_api_keys_user ON api_keys(user_id);
+CREATE INDEX idx_user_tokens_user ON user_tokens(user_id);
+CREATE INDEX idx_user_identities_user ON user_identities(user_id);
+CREATE INDEX idx_auth_attempts_username ON auth_attempts(kind, username, created_at);
+CREATE INDEX idx_auth_attempts_ip ON auth_attempts(kind, ip, created_at);
 CREATE INDEX idx_user_sessions_user ON user_sessions(user_id);
-CREATE INDEX idx_user_sessions_session ON user_sessions(session_id);
\ No newline at end of file
+CREATE INDEX idx_user_sessions_session ON user_sessions(session_id);
+CREATE INDEX idx_document_authors_user ON document_authors(user_id);
+CREATE INDEX idx_session_members_user ON session_members(user_id);
+CREATE INDEX idx_session_invites_session ON session_invites(session_id);
+CREATE INDEX idx_publications_session ON publications(session_id);
+CREATE INDEX idx_comment_threads_session ON comment_threads(session_id);
+CREATE INDEX idx_comments_thread ON comments(thread_id);
+CREATE INDEX idx_suggestions_session ON suggestions(session_id);
+CREATE INDEX idx_chat_messages_session ON chat_messages(session_id, id);
\ No newline at end of file
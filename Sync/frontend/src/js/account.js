@@ -0,0 +1,122 @@
+// Profile, password and deletion of the signed-in user's account
+
+async function accountRequest(path, method = 'GET', body = null) {
+    const token = await freshToken();
+    if (!token) {
+        hideAccountModal();
+        showLoginModal();
+        throw new Error('Please log in again');
+    }
+
+    const options = { method, headers: { 'Authorization': `Bearer ${token}` } };
+    if (body) {
+        options.headers['Content-Type'] = 'application/json';
+        options.body = JSON.stringify(body);
+    }
+
+    const response = await fetch(`${API_BASE}/me${path}`, options);
+    if (!response.ok) {
+        throw new Error(await response.text());
+    }
+    return response.json();
+}
+
+function showAccountMessage(text, ok) {
+    const message = document.getElementById('accountMessage');
+    message.textContent = text;
+    message.className = `mt-4 text-sm ${ok ? 'text-green-600' : 'text-red-600'}`;
+}
+
+function showProfile(profile) {
+    document.getElementById('profileUsername').value = profile.username;
+    document.getElementById('profileEmail').value = profile.email;
+    document.getElementById('profileEmail').defaultValue = profile.email;
+    document.getElementById('profileDisplayName').value = profile.display_name;
+    document.getElementById('profileAvatarUrl').value = profile.avatar_url;
+    document.getElementById('profileEmailStatus').textContent = profile.email_verified
+        ? 'Email verified'
+        : 'Email not verified yet - check your inbox for the link';
+    // Keep the name in the navigation bar current
+    localStorage.setItem('user', JSON.stringify({ id: profile.id, username: profile.username }));
+    checkAuth();
+}
+
+async function showAccountModal() {
+    const modal = document.getElementById('accountModal');
+    modal.classList.remove('hidden');
+    modal.classList.add('flex');
+    document.getElementById('accountMessage').classList.add('hidden');
+
+    try {
+        showProfile(await accountRequest(''));
+    } catch (error) {
+        showAccountMessage(error.message, false);
+    }
+}
+
+function hideAccountModal() {
+    document.getElementById('accountModal').classList.add('hidden');
+}
+
+document.getElementById('profileForm').addEventListener('submit', async (e) => {
+    e.preventDefault();
+
+    const current = { email: document.getElementById('profileEmail').defaultValue };
+    const body = {
+        username: document.getElementById('profileUsername').value,
+        email: document.getElementById('profileEmail').value,
+        display_name: document.getElementById('profileDisplayName').value,
+        avatar_url: document.getElementById('profileAvatarUrl').value,
+    };
+    try {
+        let profile;
+        try {
+            profile = await accountRequest('', 'PATCH', body);
+        } catch (error) {
+            // Changing the email needs the password
+            if (!error.message.includes('password')) throw error;
+            const password = prompt('Enter your password to change your email:');
+            if (!password) return;
+            profile = await accountRequest('', 'PATCH', { ...body, current_password: password });
+        }
+        showProfile(profile);
+        showAccountMessage(profile.email !== current.email && !profile.email_verified
+            ? 'Profile saved. Check your inbox to verify the new email.' : 'Profile saved', true);
+    } catch (error) {
+        showAccountMessage(error.message, false);
+    }
+});
+
+document.getElementById('passwordForm').addEventListener('submit', async (e) => {
+    e.preventDefault();
+
+    try {
+        const result = await accountRequest('/password', 'POST', {
+            current_password: document.getElementById('currentPassword').value,
+            new_password: document.getElementById('changedPassword').value,
+        });
+        e.target.reset();
+        showAccountMessage(`Password changed. ${result.logins_ended} other logins were signed out.`, true);
+    } catch (error) {
+        showAccountMessage(error.message, false);
+    }
+});
+
+document.getElementById('deleteAccountForm').addEventListener('submit', async (e) => {
+    e.preventDefault();
+    if (!confirm('Delete your account for good? This cannot be undone.')) return;
+
+    const sessions = document.querySelector('input[name="ownedSessions"]:checked').value;
+    try {
+        await accountRequest('', 'DELETE', {
+            password: document.getElementById('deletePassword').value,
+            sessions,
+            transfer_to: document.getElementById('transferTo').value,
+        });
+        clearTokens();
+        hideAccountModal();
+        checkAuth();
+    } catch (error) {
+        showAccountMessage(error.message, false);
+    }
+});
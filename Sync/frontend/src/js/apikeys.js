@@ -0,0 +1,109 @@
+// Personal API keys of the signed-in user
+
+async function apiKeysRequest(method = 'GET', query = '', body = null) {
+    const token = await freshToken();
+    if (!token) {
+        hideApiKeysModal();
+        showLoginModal();
+        throw new Error('Please log in again');
+    }
+
+    const options = { method, headers: { 'Authorization': `Bearer ${token}` } };
+    if (body) {
+        options.headers['Content-Type'] = 'application/json';
+        options.body = JSON.stringify(body);
+    }
+
+    const response = await fetch(`${API_BASE}/keys${query}`, options);
+    if (!response.ok) {
+        throw new Error(await response.text());
+    }
+    return response.json();
+}
+
+function showApiKeysError(error) {
+    const errorDiv = document.getElementById('apiKeysError');
+    errorDiv.textContent = error.message;
+    errorDiv.classList.remove('hidden');
+}
+
+async function loadApiKeys() {
+    const list = document.getElementById('apiKeysList');
+    try {
+        const keys = await apiKeysRequest();
+        if (keys.length === 0) {
+            list.innerHTML = '<p class="text-gray-500">No API keys yet.</p>';
+            return;
+        }
+
+        list.innerHTML = '';
+        keys.forEach(key => {
+            const row = document.createElement('div');
+            row.className = 'border rounded-lg p-3 flex justify-between items-center';
+
+            const info = document.createElement('div');
+            const name = document.createElement('p');
+            name.className = 'font-semibold';
+            name.textContent = `${key.name} (${key.prefix}...)`;
+            const details = document.createElement('p');
+            details.className = 'text-sm text-gray-600';
+            details.textContent = `Scopes: ${key.scopes.join(', ')} · ` +
+                (key.last_used_at ? `last used ${new Date(key.last_used_at).toLocaleString()}` : 'never used') +
+                (key.expires_at ? ` · expires ${new Date(key.expires_at).toLocaleDateString()}` : '');
+            info.append(name, details);
+
+            const revoke = document.createElement('button');
+            revoke.className = 'text-red-600 hover:text-red-800';
+            revoke.textContent = 'Revoke';
+            revoke.onclick = () => revokeApiKey(key);
+
+            row.append(info, revoke);
+            list.appendChild(row);
+        });
+    } catch (error) {
+        showApiKeysError(error);
+    }
+}
+
+function showApiKeysModal() {
+    const modal = document.getElementById('apiKeysModal');
+    modal.classList.remove('hidden');
+    modal.classList.add('flex');
+    document.getElementById('newApiKey').classList.add('hidden');
+    document.getElementById('apiKeysError').classList.add('hidden');
+    loadApiKeys();
+}
+
+function hideApiKeysModal() {
+    document.getElementById('apiKeysModal').classList.add('hidden');
+}
+
+async function revokeApiKey(key) {
+    if (!confirm(`Revoke "${key.name}"? Scripts using it stop working.`)) return;
+
+    try {
+        await apiKeysRequest('DELETE', `?id=${key.id}`);
+        loadApiKeys();
+    } catch (error) {
+        showApiKeysError(error);
+    }
+}
+
+document.getElementById('apiKeyForm').addEventListener('submit', async (e) => {
+    e.preventDefault();
+    document.getElementById('apiKeysError').classList.add('hidden');
+
+    const scopes = [...document.querySelectorAll('input[name="apiKeyScope"]:checked')].map(input => input.value);
+    try {
+        const result = await apiKeysRequest('POST', '', {
+            name: document.getElementById('apiKeyName').value,
+            scopes,
+        });
+        document.getElementById('newApiKeyValue').textContent = result.key;
+        document.getElementById('newApiKey').classList.remove('hidden');
+        e.target.reset();
+        loadApiKeys();
+    } catch (error) {
+        showApiKeysError(error);
+    }
+});
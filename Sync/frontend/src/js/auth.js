@@ -42,6 +42,15 @@ function hideLoginModal() {
     if (loginModal) loginModal.classList.add('hidden');
     if (loginError) loginError.classList.add('hidden');
     if (loginForm) loginForm.reset();
+
+    // Start over at the password next time
+    const secondFactorForm = document.getElementById('secondFactorForm');
+    loginChallenge = null;
+    if (loginForm) loginForm.classList.remove('hidden');
+    if (secondFactorForm) {
+        secondFactorForm.classList.add('hidden');
+        secondFactorForm.reset();
+    }
 }
 
 function showRegisterModal() {
@@ -93,8 +102,11 @@ document.getElementById('loginForm').addEventListener('submit', async (e) => {
         
         if (response.ok) {
             const data = await response.json();
-            localStorage.setItem('token', data.token);
-            localStorage.setItem('user', JSON.stringify(data.user));
+            if (data.second_factor_required) {
+                showSecondFactor(data.challenge);
+                return;
+            }
+            storeTokens(data);
             hideLoginModal();
             checkAuth();
         } else {
@@ -108,6 +120,45 @@ document.getElementById('loginForm').addEventListener('submit', async (e) => {
     }
 });
 
+// The password or single sign-on was right but the account also wants a code
+let loginChallenge = null;
+
+function showSecondFactor(challenge) {
+    loginChallenge = challenge;
+    document.getElementById('loginForm').classList.add('hidden');
+    document.getElementById('loginError').classList.add('hidden');
+    document.getElementById('secondFactorForm').classList.remove('hidden');
+    document.getElementById('secondFactorCode').focus();
+}
+
+document.getElementById('secondFactorForm').addEventListener('submit', async (e) => {
+    e.preventDefault();
+
+    const loginError = document.getElementById('loginError');
+    try {
+        const response = await fetch(`${API_BASE}/2fa/verify`, {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({
+                challenge: loginChallenge,
+                code: document.getElementById('secondFactorCode').value.trim(),
+            }),
+        });
+
+        if (response.ok) {
+            storeTokens(await response.json());
+            hideLoginModal();
+            checkAuth();
+        } else {
+            loginError.textContent = await response.text();
+            loginError.classList.remove('hidden');
+        }
+    } catch (error) {
+        loginError.textContent = 'An error occurred. Please try again.';
+        loginError.classList.remove('hidden');
+    }
+});
+
 // Register form handler
 document.getElementById('registerForm').addEventListener('submit', async (e) => {
     e.preventDefault();
@@ -127,8 +178,7 @@ document.getElementById('registerForm').addEventListener('submit', async (e) =>
         
         if (response.ok) {
             const data = await response.json();
-            localStorage.setItem('token', data.token);
-            localStorage.setItem('user', JSON.stringify(data.user));
+            storeTokens(data);
             hideRegisterModal();
             checkAuth();
         } else {
@@ -142,16 +192,92 @@ document.getElementById('registerForm').addEventListener('submit', async (e) =>
     }
 });
 
+// Emails a reset link; the server answers the same for unknown emails
+async function forgotPassword() {
+    const email = prompt('Enter the email of your account:');
+    if (!email) return;
+
+    const loginError = document.getElementById('loginError');
+    try {
+        const response = await fetch(`${API_BASE}/password/forgot`, {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ email }),
+        });
+        const text = response.ok ? (await response.json()).status : await response.text();
+        alert(text);
+    } catch (error) {
+        loginError.textContent = 'An error occurred. Please try again.';
+        loginError.classList.remove('hidden');
+    }
+}
+
+// Single sign-on happens on the identity provider's pages
+function loginWithSSO() {
+    window.location.href = `${API_BASE}/oidc/login`;
+}
+
+// Only offer single sign-on when the server has an identity provider
+async function checkSSO() {
+    const ssoLogin = document.getElementById('ssoLogin');
+    if (!ssoLogin) return;
+
+    try {
+        const response = await fetch(`${API_BASE}/oidc/config`);
+        if (response.ok && (await response.json()).enabled) {
+            ssoLogin.classList.remove('hidden');
+        }
+    } catch (error) {
+        console.error('Failed to check single sign-on:', error);
+    }
+}
+
+// After single sign-on the server sends us back with the tokens, a
+// challenge for the second factor or an error in the URL fragment
+function finishSSO() {
+    const params = new URLSearchParams(window.location.hash.slice(1));
+    if (!params.has('token') && !params.has('challenge') && !params.has('sso_error')) return;
+
+    history.replaceState(null, '', window.location.pathname + window.location.search);
+
+    if (params.has('challenge')) {
+        showLoginModal();
+        showSecondFactor(params.get('challenge'));
+        return;
+    }
+    if (params.has('sso_error')) {
+        showLoginModal();
+        const loginError = document.getElementById('loginError');
+        loginError.textContent = params.get('sso_error');
+        loginError.classList.remove('hidden');
+        return;
+    }
+
+    storeTokens({
+        token: params.get('token'),
+        refresh_token: params.get('refresh_token'),
+        expires_in: Number(params.get('expires_in')),
+        user: { id: Number(params.get('user_id')), username: params.get('username') },
+    });
+}
+
+finishSSO();
+checkSSO();
+
 // Logout function
 function logout() {
-    localStorage.removeItem('token');
-    localStorage.removeItem('user');
+    signOut();
     checkAuth();
 }
 
+// Ends every login, e.g. after a device was lost
+function logoutEverywhere() {
+    signOut(true).then(checkAuth);
+}
+
 // View sessions function
 async function viewSessions() {
-    const token = localStorage.getItem('token');
+    const token = await freshToken();
     
     if (!token) {
         showLoginModal();
@@ -193,6 +319,7 @@ function displaySessions(sessions) {
                 <div>
                     <h3 class="font-semibold">Session: ${session.session_code}</h3>
                     <p class="text-sm text-gray-600">Last modified: ${new Date(session.last_modified).toLocaleString()}</p>
+                    ${session.authors && session.authors.length ? `<p class="text-sm text-gray-500">Edited by: ${session.authors.map(a => a.username).join(', ')}</p>` : ''}
                 </div>
                 <button class="text-blue-600 hover:text-blue-800">Open →</button>
             </div>
@@ -0,0 +1,113 @@
+// The session chat. The latest messages come with init, older ones are
+// paged in from the history endpoint on request.
+class ChatPanel {
+    constructor(container, form, input, loadEarlier, sessionCode, send) {
+        this.container = container;
+        this.form = form;
+        this.input = input;
+        this.loadEarlier = loadEarlier;
+        this.sessionCode = sessionCode;
+        this.send = send;
+        this.messages = [];
+        this.dbUserId = null;
+
+        this.form.addEventListener('submit', (e) => {
+            e.preventDefault();
+            const content = this.input.value.trim();
+            if (!content) return;
+            this.send('chat', { content });
+            this.input.value = '';
+        });
+        this.loadEarlier.addEventListener('click', () => this.fetchEarlier());
+    }
+
+    // Replaces the messages, as sent with init and resync. A full backlog
+    // means there may be more to page in.
+    setMessages(messages, dbUserId) {
+        this.messages = messages;
+        this.dbUserId = dbUserId;
+        this.loadEarlier.classList.toggle('hidden', messages.length < CHAT_BACKLOG);
+        this.render(true);
+    }
+
+    addMessage(message) {
+        const atBottom = this.container.scrollTop + this.container.clientHeight >= this.container.scrollHeight - 10;
+        this.messages.push(message);
+        this.render(atBottom);
+        if (this.mentionsMe(message)) {
+            this.container.classList.add('ring-2', 'ring-yellow-300');
+            setTimeout(() => this.container.classList.remove('ring-2', 'ring-yellow-300'), 3000);
+        }
+    }
+
+    setCanChat(canChat) {
+        this.form.classList.toggle('hidden', !canChat);
+    }
+
+    async fetchEarlier() {
+        const params = new URLSearchParams({ session: this.sessionCode });
+        if (this.messages.length > 0) {
+            params.set('before', this.messages[0].id);
+        }
+        try {
+            const token = await freshToken();
+            const response = await fetch(`http://localhost:8080/api/session/chat?${params}`, {
+                headers: token ? { 'Authorization': `Bearer ${token}` } : {}
+            });
+            if (!response.ok) {
+                throw new Error(await response.text());
+            }
+            const page = await response.json();
+            const known = new Set(this.messages.map(m => m.id));
+            this.messages = page.messages.filter(m => !known.has(m.id)).concat(this.messages);
+            this.loadEarlier.classList.toggle('hidden', !page.has_more);
+            this.render(false);
+        } catch (error) {
+            console.error('Failed to load chat history:', error);
+        }
+    }
+
+    mentionsMe(message) {
+        return !!this.dbUserId && (message.mentions || []).includes(this.dbUserId);
+    }
+
+    render(scrollToBottom) {
+        this.container.replaceChildren();
+        if (this.messages.length === 0) {
+            const empty = document.createElement('p');
+            empty.className = 'text-sm text-gray-500';
+            empty.textContent = 'No messages yet';
+            this.container.appendChild(empty);
+            return;
+        }
+
+        this.messages.forEach(message => {
+            const item = document.createElement('div');
+            item.className = 'text-sm px-2 py-1 rounded' + (this.mentionsMe(message) ? ' bg-yellow-50' : '');
+            const meta = document.createElement('div');
+            meta.className = 'text-xs text-gray-500';
+            meta.textContent = `${message.author || 'Deleted user'} · ${new Date(message.created_at).toLocaleString()}`;
+            const body = document.createElement('div');
+            body.className = 'whitespace-pre-wrap text-gray-800';
+            // Set @mentions apart from the rest of the message
+            message.body.split(/(@\S+)/).forEach(part => {
+                if (part.startsWith('@')) {
+                    const mention = document.createElement('strong');
+                    mention.className = 'text-blue-700';
+                    mention.textContent = part;
+                    body.appendChild(mention);
+                } else {
+                    body.appendChild(document.createTextNode(part));
+                }
+            });
+            item.append(meta, body);
+            this.container.appendChild(item);
+        });
+        if (scrollToBottom) {
+            this.container.scrollTop = this.container.scrollHeight;
+        }
+    }
+}
+
+// How many of the latest messages the server sends with init
+const CHAT_BACKLOG = 50;
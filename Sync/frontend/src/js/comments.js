@@ -0,0 +1,136 @@
+// Comment threads anchored to ranges of the text. Anchors are kept in
+// terms of the local text, so they follow our own edits as well as others'.
+class CommentsPanel {
+    constructor(container, editor, showResolved, send) {
+        this.container = container;
+        this.editor = editor;
+        this.showResolved = showResolved;
+        this.send = send;
+        this.threads = new Map();
+        this.canComment = false;
+
+        this.showResolved.addEventListener('change', () => this.render());
+    }
+
+    // Replaces every thread, as sent with init and resync
+    setThreads(threads) {
+        this.threads.clear();
+        threads.forEach(thread => this.threads.set(thread.id, thread));
+        this.render();
+    }
+
+    // Takes in a new or changed thread. The server's anchor does not know
+    // about our edits in flight, pending lists them as operations.
+    updateThread(thread, pending) {
+        pending.forEach(op => {
+            thread.start = op.transformIndex(thread.start, true);
+            thread.end = Math.max(op.transformIndex(thread.end, false), thread.start);
+        });
+        this.threads.set(thread.id, thread);
+        this.render();
+    }
+
+    // Moves every anchor through an operation applied to the local text
+    transform(operation) {
+        this.threads.forEach(thread => {
+            thread.start = operation.transformIndex(thread.start, true);
+            thread.end = Math.max(operation.transformIndex(thread.end, false), thread.start);
+        });
+    }
+
+    setCanComment(canComment) {
+        this.canComment = canComment;
+        this.render();
+    }
+
+    // Starts a thread on the selected text
+    commentOnSelection(revision) {
+        const start = this.editor.selectionStart;
+        const end = this.editor.selectionEnd;
+        if (start === end) {
+            alert('Select the text you want to comment on');
+            return;
+        }
+        const content = prompt('Comment:');
+        if (!content || !content.trim()) return;
+
+        const quote = this.editor.value.slice(start, end);
+        this.send('comment', { revision, thread: { start, end, quote }, content });
+    }
+
+    render() {
+        this.container.replaceChildren();
+        const visible = [...this.threads.values()]
+            .filter(thread => this.showResolved.checked || !thread.resolved_at)
+            .sort((a, b) => a.start - b.start || a.id - b.id);
+
+        if (visible.length === 0) {
+            const empty = document.createElement('p');
+            empty.className = 'text-sm text-gray-500';
+            empty.textContent = 'No comments';
+            this.container.appendChild(empty);
+            return;
+        }
+        visible.forEach(thread => this.container.appendChild(this.renderThread(thread)));
+    }
+
+    renderThread(thread) {
+        const card = document.createElement('div');
+        card.className = 'border rounded-lg p-3 ' + (thread.resolved_at ? 'bg-gray-50 opacity-75' : 'bg-white');
+
+        // Clicking the quote selects the text the thread is about
+        const quote = document.createElement('button');
+        quote.className = 'block w-full text-left text-sm italic text-gray-600 border-l-4 border-yellow-300 pl-2 mb-2 truncate';
+        quote.textContent = thread.start === thread.end ? `"${thread.quote}" (text removed)` : `"${thread.quote}"`;
+        quote.addEventListener('click', () => {
+            this.editor.focus();
+            this.editor.setSelectionRange(thread.start, thread.end);
+        });
+        card.appendChild(quote);
+
+        thread.comments.forEach(comment => {
+            const item = document.createElement('div');
+            item.className = 'text-sm mb-2';
+            const meta = document.createElement('div');
+            meta.className = 'text-xs text-gray-500';
+            meta.textContent = `${comment.author || 'Deleted user'} · ${new Date(comment.created_at).toLocaleString()}`;
+            const body = document.createElement('div');
+            body.className = 'whitespace-pre-wrap text-gray-800';
+            body.textContent = comment.body;
+            item.append(meta, body);
+            card.appendChild(item);
+        });
+
+        if (thread.resolved_at) {
+            const resolved = document.createElement('div');
+            resolved.className = 'text-xs text-green-700 mb-2';
+            resolved.textContent = `Resolved${thread.resolved_by ? ' by ' + thread.resolved_by : ''}`;
+            card.appendChild(resolved);
+        }
+
+        if (this.canComment) {
+            const form = document.createElement('form');
+            form.className = 'flex gap-2';
+            const input = document.createElement('input');
+            input.type = 'text';
+            input.placeholder = 'Reply';
+            input.className = 'flex-1 px-2 py-1 border rounded text-sm focus:outline-none focus:border-blue-500';
+            const toggle = document.createElement('button');
+            toggle.type = 'button';
+            toggle.className = 'text-sm text-blue-600 hover:text-blue-800';
+            toggle.textContent = thread.resolved_at ? 'Reopen' : 'Resolve';
+            toggle.addEventListener('click', () => {
+                this.send(thread.resolved_at ? 'reopen' : 'resolve', { threadId: thread.id });
+            });
+            form.addEventListener('submit', (e) => {
+                e.preventDefault();
+                if (!input.value.trim()) return;
+                this.send('reply', { threadId: thread.id, content: input.value });
+                input.value = '';
+            });
+            form.append(input, toggle);
+            card.appendChild(form);
+        }
+        return card;
+    }
+}
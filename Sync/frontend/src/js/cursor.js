@@ -3,30 +3,63 @@ class CursorManager {
         this.editorContainer = editorContainer;
         this.editor = editor;
         this.cursors = {};
-        this.cursorPositions = new Map();
+        this.selections = {};
+        this.presence = new Map();
+        this.userNames = new Map();
         this.cursorsContainer = document.getElementById('cursors');
     }
 
-    updateCursor(userId, position, color) {
+    // Shows what a user has selected, with their caret at the head of the
+    // first range, and whether they are typing or have stepped away
+    updatePresence(userId, presence, color) {
+        this.presence.set(userId, presence);
+
         let cursor = this.cursors[userId];
-        
         if (!cursor) {
             cursor = this.createCursor(userId, color);
             this.cursors[userId] = cursor;
         }
-        
-        // Store position for later use
-        this.cursorPositions.set(userId, position);
-        
-        // Calculate and update cursor position
-        const coords = this.getTextPositionInTextarea(position);
-        
-        cursor.style.left = coords.left + 'px';
-        cursor.style.top = coords.top + 'px';
+
+        const ranges = presence.ranges || [];
+        cursor.style.display = ranges.length > 0 ? '' : 'none';
+        if (ranges.length > 0) {
+            const coords = this.getTextPositionInTextarea(ranges[0].head);
+            cursor.style.left = coords.left + 'px';
+            cursor.style.top = coords.top + 'px';
+        }
         cursor.style.color = color; // Set color for the ::before element
-        
-        // Debug log
-        console.log(`Cursor updated for ${userId} at position ${position}:`, coords);
+        cursor.classList.toggle('idle', !!presence.idle);
+
+        const name = this.userNames.get(userId) || userId;
+        const label = cursor.querySelector('.cursor-label');
+        label.textContent = presence.typing ? `${name} is typing...` : presence.idle ? `${name} (idle)` : name;
+
+        // The editor already shows our own selection
+        if (userId !== this.currentUserId) {
+            this.drawSelections(userId, ranges, color);
+        }
+    }
+
+    drawSelections(userId, ranges, color) {
+        (this.selections[userId] || []).forEach(box => box.remove());
+        this.selections[userId] = [];
+
+        ranges.forEach(range => {
+            if (range.anchor === range.head) return;
+            const start = Math.min(range.anchor, range.head);
+            const end = Math.max(range.anchor, range.head);
+            this.getSelectionRects(start, end).forEach(rect => {
+                const box = document.createElement('div');
+                box.className = 'selection';
+                box.style.left = rect.left + 'px';
+                box.style.top = rect.top + 'px';
+                box.style.width = rect.width + 'px';
+                box.style.height = rect.height + 'px';
+                box.style.backgroundColor = color;
+                this.cursorsContainer.appendChild(box);
+                this.selections[userId].push(box);
+            });
+        });
     }
 
     createCursor(userId, color) {
@@ -40,7 +73,7 @@ class CursorManager {
         
         const label = document.createElement('div');
         label.className = 'cursor-label';
-        label.textContent = userId;
+        label.textContent = this.userNames.get(userId) || userId;
         label.style.backgroundColor = color;
         label.style.color = 'white';
         cursor.appendChild(label);
@@ -53,8 +86,12 @@ class CursorManager {
         this.currentUserId = userId;
     }
 
-    getTextPositionInTextarea(charIndex) {
-        // Create a hidden div with the same styling as the textarea
+    setUserName(userId, name) {
+        this.userNames.set(userId, name);
+    }
+
+    // Creates a hidden div laid out like the textarea
+    createMirror() {
         const mirror = document.createElement('div');
         const styles = window.getComputedStyle(this.editor);
         
@@ -74,6 +111,31 @@ class CursorManager {
             visibility: hidden;
             overflow: hidden;
         `;
+        return mirror;
+    }
+
+    // Returns the boxes, one per line, covering the text from start to end
+    getSelectionRects(start, end) {
+        const mirror = this.createMirror();
+        mirror.appendChild(document.createTextNode(this.editor.value.substring(0, start)));
+        const selected = document.createElement('span');
+        selected.textContent = this.editor.value.substring(start, end);
+        mirror.appendChild(selected);
+        this.editorContainer.appendChild(mirror);
+
+        const containerRect = this.editorContainer.getBoundingClientRect();
+        const rects = [...selected.getClientRects()].map(rect => ({
+            left: rect.left - containerRect.left - this.editor.scrollLeft,
+            top: rect.top - containerRect.top - this.editor.scrollTop,
+            width: rect.width,
+            height: rect.height
+        }));
+        this.editorContainer.removeChild(mirror);
+        return rects;
+    }
+
+    getTextPositionInTextarea(charIndex) {
+        const mirror = this.createMirror();
         
         // Insert text up to cursor position
         const textBeforeCursor = this.editor.value.substring(0, charIndex);
@@ -108,49 +170,68 @@ class CursorManager {
         };
     }
 
+    // Returns the position of the first character in view
+    getTopVisiblePosition() {
+        const origin = this.getTextPositionInTextarea(0).top;
+        let lo = 0;
+        let hi = this.editor.value.length;
+        while (lo < hi) {
+            const mid = Math.floor((lo + hi) / 2);
+            if (this.getTextPositionInTextarea(mid).top - origin < this.editor.scrollTop) {
+                lo = mid + 1;
+            } else {
+                hi = mid;
+            }
+        }
+        return lo;
+    }
+
+    // Scrolls the editor so the line holding position is at the top
+    scrollToPosition(position) {
+        const origin = this.getTextPositionInTextarea(0).top;
+        this.editor.scrollTop = this.getTextPositionInTextarea(position).top - origin;
+    }
+
     removeCursor(userId) {
         if (this.cursors[userId]) {
             this.cursors[userId].remove();
             delete this.cursors[userId];
         }
-        this.cursorPositions.delete(userId);
+        (this.selections[userId] || []).forEach(box => box.remove());
+        delete this.selections[userId];
+        this.presence.delete(userId);
+        this.userNames.delete(userId);
     }
 
-    adjustCursorPosition(oldText, newText, cursorPos, changePos) {
-        if (changePos >= cursorPos) {
-            return cursorPos;
-        }
-        
-        const diff = newText.length - oldText.length;
-        return Math.max(0, cursorPos + diff);
-    }
+    // Shifts every known selection through an operation applied to the text
+    transformAllCursors(operation, connectedUsers) {
+        const shift = pos => operation.baseLength >= pos ? operation.transformIndex(pos) : pos;
+        this.presence.forEach((presence, uid) => {
+            const ranges = (presence.ranges || []).map(range => ({
+                anchor: shift(range.anchor),
+                head: shift(range.head)
+            }));
+            const shifted = { ...presence, ranges };
+            this.presence.set(uid, shifted);
 
-    adjustAllCursors(oldText, newText, changingUserId, connectedUsers) {
-        this.cursorPositions.forEach((pos, uid) => {
-            if (uid !== changingUserId) {
-                const changePos = this.cursorPositions.get(changingUserId) || 0;
-                const newPos = this.adjustCursorPosition(oldText, newText, pos, changePos);
-                this.cursorPositions.set(uid, newPos);
-                
-                const color = connectedUsers.get(uid);
-                if (color) {
-                    this.updateCursor(uid, newPos, color);
-                }
+            const color = connectedUsers.get(uid);
+            if (color) {
+                this.updatePresence(uid, shifted, color);
             }
         });
     }
 
     refreshAllPositions(connectedUsers) {
-        this.cursorPositions.forEach((pos, uid) => {
+        this.presence.forEach((presence, uid) => {
             const color = connectedUsers.get(uid);
             if (color) {
-                this.updateCursor(uid, pos, color);
+                this.updatePresence(uid, presence, color);
             }
         });
     }
 
     clear() {
         Object.keys(this.cursors).forEach(userId => this.removeCursor(userId));
-        this.cursorPositions.clear();
+        this.presence.clear();
     }
 }
\ No newline at end of file
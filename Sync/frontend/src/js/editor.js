@@ -6,6 +6,10 @@ class Editor {
         this.isRemoteUpdate = false;
         this.saveTimer = null;
         this.lastSavedContent = '';
+        this.lastValue = '';
+        this.readOnly = false;
+        this.suggesting = false;
+        this.onSuggest = null;
         
         this.setupEventListeners();
         this.setupAutoSave();
@@ -14,9 +18,30 @@ class Editor {
     setupEventListeners() {
         let hasUnsavedChanges = false;
         
+        // In suggestion mode typing proposes changes instead of making them
+        this.editor.addEventListener('beforeinput', (e) => {
+            if (!this.suggesting || this.isRemoteUpdate) return;
+            e.preventDefault();
+            const change = this.suggestedChange(e);
+            if (change && this.onSuggest) {
+                this.onSuggest(change);
+                // Stay where the next keystroke continues the suggestion
+                const caret = e.inputType === 'deleteContentBackward' && !change.text ? change.start : change.end;
+                this.editor.setSelectionRange(caret, caret);
+            }
+        });
+
         this.editor.addEventListener('input', () => {
+            if (this.suggesting && !this.isRemoteUpdate) {
+                // Input the browser would not let us cancel, such as IME composition
+                this.editor.value = this.lastValue;
+                return;
+            }
             if (!this.isRemoteUpdate && this.onUpdate) {
-                this.onUpdate(this.editor.value);
+                const operation = TextOperation.fromDiff(this.lastValue, this.editor.value);
+                this.lastValue = this.editor.value;
+                if (operation.isNoop()) return;
+                this.onUpdate(operation);
                 this.scheduleSave();
                 
                 // Mark that we have unsaved changes
@@ -29,11 +54,11 @@ class Editor {
             }
         });
 
-        // Send cursor position on various events
-        ['keyup', 'keydown', 'click', 'select', 'focus'].forEach(eventType => {
+        // Send the selection on various events
+        ['keyup', 'keydown', 'click', 'mouseup', 'select', 'focus'].forEach(eventType => {
             this.editor.addEventListener(eventType, () => {
                 if (this.onCursorMove) {
-                    this.onCursorMove(this.editor.selectionStart);
+                    this.onCursorMove(this.getSelection());
                 }
             });
         });
@@ -45,7 +70,7 @@ class Editor {
             if (navigationKeys.includes(e.key)) {
                 setTimeout(() => {
                     if (this.onCursorMove) {
-                        this.onCursorMove(this.editor.selectionStart);
+                        this.onCursorMove(this.getSelection());
                     }
                 }, 0);
             }
@@ -77,6 +102,58 @@ class Editor {
         }, 30000);
     }
 
+    // Viewers and commenters can follow along but not type
+    setReadOnly(readOnly) {
+        this.readOnly = readOnly;
+        this.editor.readOnly = readOnly && !this.suggesting;
+    }
+
+    // Commenters may type while suggesting, as it leaves the text alone
+    setSuggesting(suggesting) {
+        this.suggesting = suggesting;
+        this.editor.readOnly = this.readOnly && !suggesting;
+    }
+
+    // Works out the change an input event would have made: the range it
+    // replaces, the text it puts there, and what that range read before
+    suggestedChange(e) {
+        const value = this.editor.value;
+        let start = this.editor.selectionStart;
+        let end = this.editor.selectionEnd;
+        let text = '';
+
+        switch (e.inputType) {
+            case 'insertText':
+            case 'insertReplacementText':
+            case 'insertFromPaste':
+            case 'insertFromDrop':
+                text = e.data || (e.dataTransfer ? e.dataTransfer.getData('text/plain') : '');
+                break;
+            case 'insertLineBreak':
+            case 'insertParagraph':
+                text = '\n';
+                break;
+            case 'deleteContentBackward':
+                if (start === end) start = Math.max(0, start - 1);
+                break;
+            case 'deleteContentForward':
+                if (start === end) end = Math.min(value.length, end + 1);
+                break;
+            case 'deleteByCut':
+            case 'deleteByDrag':
+            case 'deleteWordBackward':
+            case 'deleteWordForward':
+                // Only whole selections, word boundaries are the browser's call
+                break;
+            default:
+                // Undo, redo and formatting have nothing to suggest
+                return null;
+        }
+
+        if (start === end && !text) return null;
+        return { start, end, text, seen: value.slice(start, end) };
+    }
+
     scheduleSave() {
         // Clear existing timer
         if (this.saveTimer) {
@@ -97,6 +174,11 @@ class Editor {
             return;
         }
 
+        // Only signed-in editors may save versions
+        if (this.readOnly || !localStorage.getItem('token')) {
+            return;
+        }
+
         // Get session code from URL
         const urlParams = new URLSearchParams(window.location.search);
         const sessionCode = urlParams.get('session');
@@ -106,7 +188,7 @@ class Editor {
         }
 
         // Check if user is authenticated
-        const token = localStorage.getItem('token');
+        const token = await freshToken();
         
         console.log('Attempting to save document...', {
             sessionCode,
@@ -158,6 +240,11 @@ class Editor {
             return;
         }
 
+        // Only signed-in editors may save versions
+        if (this.readOnly || !localStorage.getItem('token')) {
+            return;
+        }
+
         // Get session code from URL
         const urlParams = new URLSearchParams(window.location.search);
         const sessionCode = urlParams.get('session');
@@ -185,7 +272,8 @@ class Editor {
                 content: content
             });
 
-            navigator.sendBeacon('http://localhost:8080/api/document/save', 
+            // sendBeacon cannot set headers, so the token goes in the URL
+            navigator.sendBeacon(`http://localhost:8080/api/document/save?token=${encodeURIComponent(token)}`,
                 new Blob([data], { type: 'application/json' }));
             
             this.lastSavedContent = content;
@@ -240,12 +328,35 @@ class Editor {
         }
         this.isRemoteUpdate = false;
         this.lastSavedContent = content;
+        this.lastValue = content;
+    }
+
+    // Applies an operation from another user, keeping the local selection
+    // anchored to the same text.
+    applyOperation(operation) {
+        this.isRemoteUpdate = true;
+        const start = operation.transformIndex(this.editor.selectionStart);
+        const end = operation.transformIndex(this.editor.selectionEnd);
+        this.editor.value = operation.apply(this.editor.value);
+        this.editor.setSelectionRange(start, end);
+        this.isRemoteUpdate = false;
+        this.lastValue = this.editor.value;
     }
 
     getCursorPosition() {
         return this.editor.selectionStart;
     }
 
+    // Returns the selection as a range from where it was started to where
+    // the caret is
+    getSelection() {
+        const { selectionStart, selectionEnd, selectionDirection } = this.editor;
+        if (selectionDirection === 'backward') {
+            return { anchor: selectionEnd, head: selectionStart };
+        }
+        return { anchor: selectionStart, head: selectionEnd };
+    }
+
     setCursorPosition(position) {
         this.editor.setSelectionRange(position, position);
     }
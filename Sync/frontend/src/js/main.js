@@ -3,6 +3,7 @@
     // Get session code from URL
     const urlParams = new URLSearchParams(window.location.search);
     const sessionCode = urlParams.get('session');
+    const invite = urlParams.get('invite');
     
     // Redirect to landing page if no session code
     if (!sessionCode) {
@@ -27,11 +28,61 @@
         });
     });
     
-    const userId = 'user' + Math.random().toString(36).substr(2, 9);
+    // Publish a public snapshot, optionally followable live
+    const publishBtn = document.getElementById('publish');
+    publishBtn.addEventListener('click', async () => {
+        const live = confirm('Let readers follow live edits? Cancel publishes a static snapshot only.');
+        try {
+            const response = await fetch('http://localhost:8080/api/document/publish', {
+                method: 'POST',
+                headers: {
+                    'Content-Type': 'application/json',
+                    'Authorization': `Bearer ${await freshToken()}`
+                },
+                body: JSON.stringify({ session_code: sessionCode, live })
+            });
+            if (!response.ok) {
+                throw new Error(await response.text());
+            }
+            const result = await response.json();
+            const link = `http://localhost:8080${result.url}`;
+            await navigator.clipboard.writeText(link);
+            alert(`Published at ${link} (copied to clipboard)`);
+        } catch (error) {
+            console.error('Failed to publish:', error);
+            alert('Failed to publish document');
+        }
+    });
+
+    // How long after the last keystroke we stop typing, and after the last
+    // sign of life we are idle
+    const TYPING_TIMEOUT = 2000;
+    const IDLE_TIMEOUT = 60000;
+
+    // The server prefixes our tab ID with who we are and tells us the result
+    const tabId = Math.random().toString(36).substr(2, 9);
+    let userId = tabId;
     const connectedUsers = new Map();
     let cursorManager;
     let editor;
     let wsManager;
+    let otClient;
+    let comments;
+    let suggestions;
+    let chat;
+
+    // What we are doing in the document, as shown to others
+    let presence = { ranges: [], idle: false, typing: false };
+    let sentPresence = '';
+    let typingTimer = null;
+    let idleTimer = null;
+    let viewportTimer = null;
+
+    // Who follows whom around the document, by user ID, and whom we follow
+    const follows = new Map();
+    let following = null;
+    // Presence from init, shown once we know the user's color
+    let initialPresence = {};
 
     // Get authentication token
     const token = localStorage.getItem('token');
@@ -47,6 +98,9 @@
     const editorContainer = document.getElementById('editor-container');
     const statusEl = document.getElementById('status');
     const usersEl = document.getElementById('users');
+    const roleEl = document.getElementById('role');
+    const addCommentBtn = document.getElementById('addComment');
+    const suggestModeBtn = document.getElementById('suggestMode');
 
     // Initialize components
     function init() {
@@ -54,42 +108,112 @@
         cursorManager = new CursorManager(editorContainer, editorElement);
         cursorManager.setCurrentUserId(userId);
 
+        comments = new CommentsPanel(
+            document.getElementById('comments'),
+            editorElement,
+            document.getElementById('showResolved'),
+            (type, data) => wsManager.sendMessage(type, data)
+        );
+        addCommentBtn.addEventListener('click', () => {
+            comments.commentOnSelection(otClient.revision);
+        });
+
+        suggestions = new SuggestionsPanel(
+            document.getElementById('suggestions'),
+            editorElement,
+            (type, data) => wsManager.sendMessage(type, data)
+        );
+        suggestModeBtn.addEventListener('click', () => {
+            setSuggesting(!editor.suggesting);
+        });
+
+        chat = new ChatPanel(
+            document.getElementById('chat'),
+            document.getElementById('chatForm'),
+            document.getElementById('chatInput'),
+            document.getElementById('chatEarlier'),
+            sessionCode,
+            (type, data) => wsManager.sendMessage(type, data)
+        );
+
         // Create editor
         editor = new Editor(
             editorElement,
-            (content) => {
-                wsManager.sendMessage('update', { content });
-                // Send cursor position after content update
-                const pos = editor.getCursorPosition();
-                cursorManager.cursorPositions.set(userId, pos);
-                wsManager.sendMessage('cursor', { cursorPos: pos });
+            (operation) => {
+                otClient.applyClient(operation);
+                comments.transform(operation);
+                suggestions.transform(operation);
+                clearTimeout(typingTimer);
+                typingTimer = setTimeout(() => updatePresence({ typing: false }), TYPING_TIMEOUT);
+                updatePresence({ ranges: [editor.getSelection()], typing: true });
             },
-            (position) => {
-                cursorManager.cursorPositions.set(userId, position);
-                wsManager.sendMessage('cursor', { cursorPos: position });
-                // Update own cursor display
-                const myColor = connectedUsers.get(userId);
-                if (myColor) {
-                    cursorManager.updateCursor(userId, position, myColor);
-                }
+            (selection) => {
+                updatePresence({ ranges: [selection] });
+            }
+        );
+
+        // Anything we do at all means we are back
+        ['keydown', 'mousedown', 'mousemove', 'focus'].forEach(eventType => {
+            window.addEventListener(eventType, markActive);
+        });
+        document.addEventListener('visibilitychange', () => {
+            if (document.hidden) {
+                updatePresence({ idle: true });
+            } else {
+                markActive();
+            }
+        });
+        markActive();
+
+        // Create OT client that tracks our unacknowledged edits
+        otClient = new OTClient(
+            0,
+            (revision, seq, operation) => {
+                wsManager.sendMessage('operation', { revision, seq, operation });
+            },
+            (operation) => {
+                editor.applyOperation(operation);
+                comments.transform(operation);
+                suggestions.transform(operation);
             }
         );
 
         // Create WebSocket manager
         wsManager = new WebSocketManager(
-            userId,
+            tabId,
             sessionCode,
             handleMessage,
             handleStatusChange,
             token,
-            dbUserId
+            dbUserId,
+            invite
         );
 
         // Setup scroll handler
         editorElement.addEventListener('scroll', () => {
             cursorManager.refreshAllPositions(connectedUsers);
+            // Followers scroll along with what we have in view
+            clearTimeout(viewportTimer);
+            viewportTimer = setTimeout(() => {
+                updatePresence({ viewport: cursorManager.getTopVisiblePosition() });
+            }, 200);
         });
 
+        // Finding our own way around stops following someone else
+        ['wheel', 'mousedown', 'keydown'].forEach(eventType => {
+            editorElement.addEventListener(eventType, () => {
+                if (following) follow(null);
+            });
+        });
+
+        editor.onSuggest = (change) => {
+            wsManager.sendMessage('suggest', {
+                revision: otClient.revision,
+                suggestion: { start: change.start, end: change.end, text: change.text },
+                content: change.seen
+            });
+        };
+
         // Connect to server
         wsManager.connect();
         
@@ -101,57 +225,254 @@
     function handleMessage(msg) {
         switch(msg.type) {
             case 'init':
-                editor.updateContent(msg.content, false);
-                updateUserBadge(msg.userId, msg.color, true);
+                otClient.reset(msg.revision || 0);
+                editor.updateContent(msg.content || '', false);
+                comments.setThreads(msg.threads || []);
+                suggestions.setSuggestions(msg.suggestions || []);
+                chat.setMessages(msg.chatHistory || [], dbUserId);
+                applyRole(msg.role);
+                // Signed-in users are members now, reconnects need no invite
+                if (token) {
+                    wsManager.invite = null;
+                }
+                if (msg.tabToken) {
+                    wsManager.tabToken = msg.tabToken;
+                }
+                if (msg.pass) {
+                    sessionStorage.setItem(`guestPass:${sessionCode}`, msg.pass);
+                    wsManager.pass = msg.pass;
+                }
+                userId = msg.userId;
+                cursorManager.setCurrentUserId(userId);
+                cursorManager.setUserName(userId, displayName(msg));
+                initialPresence = msg.presences || {};
+                follows.clear();
+                Object.entries(msg.follows || {}).forEach(([follower, target]) => follows.set(follower, target));
+                following = null;
+                updateUserBadge(msg, true);
                 connectedUsers.set(msg.userId, msg.color);
+                updateFollowBadges();
                 // Show own cursor
-                cursorManager.updateCursor(msg.userId, 0, msg.color);
+                sentPresence = '';
+                updatePresence({ ranges: [editor.getSelection()] });
                 break;
             
-            case 'update':
-                if (msg.userId !== userId) {
-                    const oldContent = editorElement.value;
-                    const myCursorPos = editor.getCursorPosition();
-                    
-                    editor.updateContent(msg.content, false);
-                    
-                    // Adjust cursor positions
-                    const changePos = cursorManager.cursorPositions.get(msg.userId) || 0;
-                    const newCursorPos = cursorManager.adjustCursorPosition(
-                        oldContent, 
-                        msg.content, 
-                        myCursorPos, 
-                        changePos
-                    );
-                    editor.setCursorPosition(newCursorPos);
-                    
-                    cursorManager.adjustAllCursors(oldContent, msg.content, msg.userId, connectedUsers);
-                }
+            case 'operation': {
+                const operation = TextOperation.fromJSON(msg.operation);
+                otClient.applyServer(msg.revision || 0, operation);
+                cursorManager.transformAllCursors(operation, connectedUsers);
+                break;
+            }
+
+            case 'ack':
+                otClient.serverAck(msg.revision || 0, msg.seq);
+                // Positions held back while our edit was in flight
+                sendPresence();
+                break;
+
+            case 'resync':
+                // The server could not rebase our edit, start over from its copy
+                console.warn('Resyncing document:', msg.error);
+                otClient.reset(msg.revision || 0);
+                editor.updateContent(msg.content || '', true);
+                comments.setThreads(msg.threads || []);
+                suggestions.setSuggestions(msg.suggestions || []);
+                break;
+
+            case 'thread':
+                comments.updateThread(msg.thread, [otClient.outstanding, otClient.buffer].filter(Boolean));
+                break;
+
+            case 'suggestions':
+                suggestions.update(msg.suggestions || [], [otClient.outstanding, otClient.buffer].filter(Boolean));
+                break;
+
+            case 'chat':
+                chat.addMessage(msg.chat);
+                break;
+
+            case 'error':
+                alert(msg.error);
                 break;
             
-            case 'cursor':
+            case 'presence':
                 if (msg.userId !== userId) {
-                    cursorManager.updateCursor(msg.userId, msg.cursorPos, msg.color);
+                    // The server's positions do not know about our edits in flight
+                    const pending = [otClient.outstanding, otClient.buffer].filter(Boolean);
+                    const ranges = (msg.presence.ranges || []).map(range => {
+                        let { anchor, head } = range;
+                        pending.forEach(op => {
+                            anchor = op.transformIndex(anchor);
+                            head = op.transformIndex(head);
+                        });
+                        return { anchor, head };
+                    });
+                    cursorManager.setUserName(msg.userId, displayName(msg));
+                    cursorManager.updatePresence(msg.userId, { ...msg.presence, ranges }, msg.color);
+                    if (msg.userId === following) {
+                        showFollowed();
+                    }
                 }
                 break;
+
+            case 'follow':
+                if (msg.target) {
+                    follows.set(msg.userId, msg.target);
+                } else {
+                    follows.delete(msg.userId);
+                }
+                if (msg.userId === userId) {
+                    following = msg.target || null;
+                    showFollowed();
+                }
+                updateFollowBadges();
+                break;
             
             case 'userJoined':
                 if (msg.userId !== userId && !connectedUsers.has(msg.userId)) {
-                    updateUserBadge(msg.userId, msg.color, false);
+                    cursorManager.setUserName(msg.userId, displayName(msg));
+                    updateUserBadge(msg, false);
                     connectedUsers.set(msg.userId, msg.color);
+                    // Where they were when we joined
+                    if (initialPresence[msg.userId]) {
+                        cursorManager.updatePresence(msg.userId, initialPresence[msg.userId], msg.color);
+                        delete initialPresence[msg.userId];
+                    }
+                    updateFollowBadges();
                 }
                 break;
             
+            case 'role':
+                applyRole(msg.role);
+                break;
+
+            case 'restarting':
+                statusEl.textContent = 'Server restarting - reconnecting...';
+                statusEl.className = 'text-sm text-yellow-600';
+                break;
+
             case 'userLeft':
                 cursorManager.removeCursor(msg.userId);
                 removeUserBadge(msg.userId);
                 connectedUsers.delete(msg.userId);
+                // The server forgets their follows, and who followed them
+                follows.forEach((target, follower) => {
+                    if (follower === msg.userId || target === msg.userId) follows.delete(follower);
+                });
+                if (following === msg.userId) following = null;
+                updateFollowBadges();
                 break;
         }
     }
 
+    // Changes what we show others we are doing, and tells them
+    function updatePresence(changes) {
+        presence = { ...presence, ...changes };
+        const myColor = connectedUsers.get(userId);
+        if (myColor) {
+            cursorManager.updatePresence(userId, presence, myColor);
+        }
+        sendPresence();
+    }
+
+    // Positions are only meaningful to the server once it has our edits, so
+    // they wait for the ack while one is in flight
+    function sendPresence() {
+        if (!wsManager || otClient.outstanding) return;
+        const frame = JSON.stringify(presence);
+        if (frame === sentPresence) return;
+        sentPresence = frame;
+        wsManager.sendMessage('presence', { revision: otClient.revision, presence });
+    }
+
+    // Follows another user around the document, or stops with null
+    function follow(target) {
+        following = target;
+        wsManager.sendMessage('follow', { target: target || '' });
+        showFollowed();
+        updateFollowBadges();
+    }
+
+    // Scrolls to what the user we follow has in view, or else to their caret
+    function showFollowed() {
+        const presence = following && cursorManager.presence.get(following);
+        if (!presence) return;
+        if (presence.viewport != null) {
+            cursorManager.scrollToPosition(presence.viewport);
+        } else if (presence.ranges && presence.ranges.length > 0) {
+            cursorManager.scrollToPosition(presence.ranges[0].head);
+        }
+    }
+
+    // Marks whom we follow and how many follow each user
+    function updateFollowBadges() {
+        connectedUsers.forEach((color, uid) => {
+            const badge = document.getElementById(`user-${uid}`);
+            if (!badge) return;
+            badge.classList.toggle('ring-2', uid === following);
+            badge.classList.toggle('ring-offset-2', uid === following);
+            const count = [...follows.values()].filter(target => target === uid).length;
+            badge.querySelector('.follow-count').textContent = count > 0 ? ` · followed by ${count}` : '';
+        });
+    }
+
+    function markActive() {
+        clearTimeout(idleTimer);
+        idleTimer = setTimeout(() => updatePresence({ idle: true }), IDLE_TIMEOUT);
+        if (presence.idle) {
+            updatePresence({ idle: false });
+        }
+    }
+
+    // Make the editor read-only unless our role allows editing
+    function applyRole(role) {
+        const canEdit = role === 'owner' || role === 'editor';
+        editor.setReadOnly(!canEdit);
+        roleEl.textContent = role && role !== 'editor' ? `(${role})` : '';
+        // Publishing needs an account and edit rights
+        publishBtn.classList.toggle('hidden', !canEdit || !token);
+        // Comments are tied to accounts
+        const canComment = !!token && (canEdit || role === 'commenter');
+        addCommentBtn.classList.toggle('hidden', !canComment);
+        comments.setCanComment(canComment);
+        // So are suggestions, which editors accept or reject
+        suggestModeBtn.classList.toggle('hidden', !canComment);
+        if (!canComment) setSuggesting(false);
+        suggestions.setPermissions(canEdit && !!token, dbUserId);
+        chat.setCanChat(canComment);
+    }
+
+    // Switches between editing the text and suggesting changes to it
+    function setSuggesting(suggesting) {
+        editor.setSuggesting(suggesting);
+        suggestModeBtn.textContent = suggesting ? 'Stop Suggesting' : 'Suggest Edits';
+        suggestModeBtn.classList.toggle('bg-yellow-200', suggesting);
+    }
+
     // Handle connection status changes
     function handleStatusChange(status) {
+        if (status === 'loggedOut') {
+            clearTokens();
+            statusEl.textContent = 'You were signed out - sign in again to keep editing';
+            statusEl.className = 'text-sm text-red-600';
+            editor.setReadOnly(true);
+            setSuggesting(false);
+            return;
+        }
+        if (status === 'deleted') {
+            statusEl.textContent = 'This session was deleted';
+            statusEl.className = 'text-sm text-red-600';
+            editor.setReadOnly(true);
+            setSuggesting(false);
+            return;
+        }
+        if (status === 'revoked') {
+            statusEl.textContent = 'Your access to this session was revoked';
+            statusEl.className = 'text-sm text-red-600';
+            editor.setReadOnly(true);
+            setSuggesting(false);
+            return;
+        }
         if (status === 'connected') {
             statusEl.textContent = 'Connected';
             statusEl.className = 'text-sm text-green-600';
@@ -162,21 +483,47 @@
             connectedUsers.clear();
             usersEl.innerHTML = '';
             cursorManager.clear();
+            follows.clear();
+            following = null;
         }
     }
 
     // Update user badge
-    function updateUserBadge(userId, color, isSelf) {
-        if (document.getElementById(`user-${userId}`)) return;
+    function updateUserBadge(msg, isSelf) {
+        if (document.getElementById(`user-${msg.userId}`)) return;
         
         const badge = document.createElement('div');
-        badge.id = `user-${userId}`;
-        badge.className = 'px-3 py-1 rounded-full text-white text-sm';
-        badge.style.backgroundColor = color;
-        badge.textContent = isSelf ? `${userId} (You)` : userId;
+        badge.id = `user-${msg.userId}`;
+        badge.className = 'flex items-center gap-1 px-3 py-1 rounded-full text-white text-sm';
+        badge.style.backgroundColor = msg.color;
+        badge.title = msg.userId;
+        if (msg.avatarUrl) {
+            const avatar = document.createElement('img');
+            avatar.src = msg.avatarUrl;
+            avatar.alt = '';
+            avatar.referrerPolicy = 'no-referrer';
+            avatar.className = 'w-5 h-5 rounded-full';
+            badge.appendChild(avatar);
+        }
+        const name = displayName(msg);
+        badge.appendChild(document.createTextNode(isSelf ? `${name} (You)` : name));
+        const followCount = document.createElement('span');
+        followCount.className = 'follow-count';
+        badge.appendChild(followCount);
+        // Click someone else to follow them around the document
+        if (!isSelf) {
+            badge.classList.add('cursor-pointer');
+            badge.title = `Follow ${name}`;
+            badge.addEventListener('click', () => follow(following === msg.userId ? null : msg.userId));
+        }
         usersEl.appendChild(badge);
     }
 
+    // Name to show for a user, as given by the server
+    function displayName(msg) {
+        return msg.name || 'Guest';
+    }
+
     // Remove user badge
     function removeUserBadge(userId) {
         const badge = document.getElementById(`user-${userId}`);
@@ -0,0 +1,305 @@
+// Text operations matching the backend's ot package. An operation is an
+// array of components: positive numbers retain, negative numbers delete and
+// strings insert. Lengths are JavaScript string lengths (UTF-16 code units).
+function isHighSurrogate(code) {
+    return code >= 0xd800 && code < 0xdc00;
+}
+
+function isLowSurrogate(code) {
+    return code >= 0xdc00 && code < 0xe000;
+}
+
+class TextOperation {
+    constructor() {
+        this.ops = [];
+        this.baseLength = 0;
+        this.targetLength = 0;
+    }
+
+    static fromJSON(ops) {
+        const op = new TextOperation();
+        ops.forEach(c => {
+            if (typeof c === 'string') op.insert(c);
+            else if (c > 0) op.retain(c);
+            else op.delete(-c);
+        });
+        return op;
+    }
+
+    // Builds the operation that turns oldText into newText by keeping the
+    // common prefix and suffix and replacing whatever is in between.
+    static fromDiff(oldText, newText) {
+        let start = 0;
+        while (start < oldText.length && start < newText.length && oldText[start] === newText[start]) {
+            start++;
+        }
+        // Do not split a surrogate pair, the server cannot store half of one
+        if (start > 0 && isHighSurrogate(oldText.charCodeAt(start - 1))) {
+            start--;
+        }
+        let oldEnd = oldText.length;
+        let newEnd = newText.length;
+        while (oldEnd > start && newEnd > start && oldText[oldEnd - 1] === newText[newEnd - 1]) {
+            oldEnd--;
+            newEnd--;
+        }
+        if (oldEnd < oldText.length && isLowSurrogate(oldText.charCodeAt(oldEnd))) {
+            oldEnd++;
+            newEnd++;
+        }
+
+        return new TextOperation()
+            .retain(start)
+            .delete(oldEnd - start)
+            .insert(newText.slice(start, newEnd))
+            .retain(oldText.length - oldEnd);
+    }
+
+    toJSON() {
+        return this.ops;
+    }
+
+    retain(n) {
+        if (n <= 0) return this;
+        this.baseLength += n;
+        this.targetLength += n;
+        const last = this.ops.length - 1;
+        if (last >= 0 && typeof this.ops[last] === 'number' && this.ops[last] > 0) {
+            this.ops[last] += n;
+        } else {
+            this.ops.push(n);
+        }
+        return this;
+    }
+
+    insert(str) {
+        if (!str) return this;
+        this.targetLength += str.length;
+        const ops = this.ops;
+        const last = ops.length - 1;
+        if (last >= 0 && typeof ops[last] === 'string') {
+            ops[last] += str;
+        } else if (last >= 0 && typeof ops[last] === 'number' && ops[last] < 0) {
+            // Keep inserts before deletes, like the server does
+            if (last > 0 && typeof ops[last - 1] === 'string') {
+                ops[last - 1] += str;
+            } else {
+                ops.push(ops[last]);
+                ops[last] = str;
+            }
+        } else {
+            ops.push(str);
+        }
+        return this;
+    }
+
+    delete(n) {
+        if (n <= 0) return this;
+        this.baseLength += n;
+        const last = this.ops.length - 1;
+        if (last >= 0 && typeof this.ops[last] === 'number' && this.ops[last] < 0) {
+            this.ops[last] -= n;
+        } else {
+            this.ops.push(-n);
+        }
+        return this;
+    }
+
+    isNoop() {
+        return this.ops.every(c => typeof c === 'number' && c > 0);
+    }
+
+    apply(str) {
+        if (str.length !== this.baseLength) {
+            throw new Error('Operation base length does not match document length');
+        }
+        const parts = [];
+        let pos = 0;
+        this.ops.forEach(c => {
+            if (typeof c === 'string') {
+                parts.push(c);
+            } else if (c > 0) {
+                parts.push(str.slice(pos, pos + c));
+                pos += c;
+            } else {
+                pos -= c;
+            }
+        });
+        return parts.join('');
+    }
+
+    // Maps an index in the original text to the matching index after the
+    // operation has been applied. Text inserted right at the index moves it
+    // along unless pushed is false.
+    transformIndex(index, pushed = true) {
+        let newIndex = index;
+        let pos = 0;
+        for (const c of this.ops) {
+            if (pos > index) break;
+            if (typeof c === 'string') {
+                if (pushed || pos < index) {
+                    newIndex += c.length;
+                }
+            } else if (c > 0) {
+                pos += c;
+            } else {
+                newIndex -= Math.min(-c, index - pos);
+                pos -= c;
+            }
+        }
+        return newIndex;
+    }
+
+    compose(other) {
+        if (this.targetLength !== other.baseLength) {
+            throw new Error('Cannot compose operations of mismatched lengths');
+        }
+        const result = new TextOperation();
+        const a = this.ops.slice();
+        const b = other.ops.slice();
+        let i = 0, j = 0;
+        let ca = a[i++], cb = b[j++];
+
+        while (ca !== undefined || cb !== undefined) {
+            if (typeof ca === 'number' && ca < 0) {
+                result.delete(-ca);
+                ca = a[i++];
+                continue;
+            }
+            if (typeof cb === 'string') {
+                result.insert(cb);
+                cb = b[j++];
+                continue;
+            }
+            if (ca === undefined || cb === undefined) {
+                throw new Error('Cannot compose operations of different lengths');
+            }
+
+            if (typeof ca === 'number' && typeof cb === 'number' && cb > 0) {
+                const n = Math.min(ca, cb);
+                result.retain(n);
+                ca = ca > n ? ca - n : a[i++];
+                cb = cb > n ? cb - n : b[j++];
+            } else if (typeof ca === 'string' && cb < 0) {
+                const n = Math.min(ca.length, -cb);
+                ca = ca.length > n ? ca.slice(n) : a[i++];
+                cb = -cb > n ? cb + n : b[j++];
+            } else if (typeof ca === 'string') {
+                const n = Math.min(ca.length, cb);
+                result.insert(ca.slice(0, n));
+                ca = ca.length > n ? ca.slice(n) : a[i++];
+                cb = cb > n ? cb - n : b[j++];
+            } else {
+                const n = Math.min(ca, -cb);
+                result.delete(n);
+                ca = ca > n ? ca - n : a[i++];
+                cb = -cb > n ? cb + n : b[j++];
+            }
+        }
+        return result;
+    }
+
+    // Returns [a', b'] such that a.compose(b') equals b.compose(a'). Inserts
+    // from a win ties, matching ot.Transform on the server.
+    static transform(a, b) {
+        if (a.baseLength !== b.baseLength) {
+            throw new Error('Cannot transform operations of different base lengths');
+        }
+        const aPrime = new TextOperation();
+        const bPrime = new TextOperation();
+        const ops1 = a.ops.slice();
+        const ops2 = b.ops.slice();
+        let i = 0, j = 0;
+        let c1 = ops1[i++], c2 = ops2[j++];
+
+        while (c1 !== undefined || c2 !== undefined) {
+            if (typeof c1 === 'string') {
+                aPrime.insert(c1);
+                bPrime.retain(c1.length);
+                c1 = ops1[i++];
+                continue;
+            }
+            if (typeof c2 === 'string') {
+                aPrime.retain(c2.length);
+                bPrime.insert(c2);
+                c2 = ops2[j++];
+                continue;
+            }
+            if (c1 === undefined || c2 === undefined) {
+                throw new Error('Cannot transform operations of different lengths');
+            }
+
+            let n;
+            if (c1 > 0 && c2 > 0) {
+                n = Math.min(c1, c2);
+                aPrime.retain(n);
+                bPrime.retain(n);
+            } else if (c1 < 0 && c2 < 0) {
+                n = Math.min(-c1, -c2);
+            } else if (c1 < 0) {
+                n = Math.min(-c1, c2);
+                aPrime.delete(n);
+            } else {
+                n = Math.min(c1, -c2);
+                bPrime.delete(n);
+            }
+            c1 = Math.abs(c1) > n ? (c1 > 0 ? c1 - n : c1 + n) : ops1[i++];
+            c2 = Math.abs(c2) > n ? (c2 > 0 ? c2 - n : c2 + n) : ops2[j++];
+        }
+        return [aPrime, bPrime];
+    }
+}
+
+// Client side of the OT protocol. At most one operation is in flight; local
+// edits made while waiting for its ack are composed into a single buffer.
+// Every sent operation gets a sequence number the server echoes in its ack.
+class OTClient {
+    constructor(revision, sendOperation, applyOperation) {
+        this.revision = revision;
+        this.sendOperation = sendOperation;
+        this.applyOperation = applyOperation;
+        this.outstanding = null;
+        this.buffer = null;
+        this.seq = 0;
+    }
+
+    reset(revision) {
+        this.revision = revision;
+        this.outstanding = null;
+        this.buffer = null;
+    }
+
+    applyClient(op) {
+        if (!this.outstanding) {
+            this.outstanding = op;
+            this.sendOperation(this.revision, ++this.seq, op);
+        } else if (!this.buffer) {
+            this.buffer = op;
+        } else {
+            this.buffer = this.buffer.compose(op);
+        }
+    }
+
+    applyServer(revision, op) {
+        this.revision = revision;
+        if (this.outstanding) {
+            [this.outstanding, op] = TextOperation.transform(this.outstanding, op);
+        }
+        if (this.buffer) {
+            [this.buffer, op] = TextOperation.transform(this.buffer, op);
+        }
+        this.applyOperation(op);
+    }
+
+    serverAck(revision, seq) {
+        if (seq && seq !== this.seq) {
+            console.warn(`Ack for operation ${seq} while ${this.seq} is outstanding`);
+        }
+        this.revision = revision;
+        this.outstanding = this.buffer;
+        this.buffer = null;
+        if (this.outstanding) {
+            this.sendOperation(this.revision, ++this.seq, this.outstanding);
+        }
+    }
+}
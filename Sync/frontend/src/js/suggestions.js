@@ -0,0 +1,133 @@
+// Suggested changes, kept apart from the text until an editor accepts them.
+// Like comment threads, their ranges follow edits to the local text.
+class SuggestionsPanel {
+    constructor(container, editor, send) {
+        this.container = container;
+        this.editor = editor;
+        this.send = send;
+        this.suggestions = new Map();
+        this.canEdit = false;
+        this.dbUserId = null;
+    }
+
+    // Replaces every pending suggestion, as sent with init and resync
+    setSuggestions(suggestions) {
+        this.suggestions.clear();
+        suggestions.forEach(suggestion => this.suggestions.set(suggestion.id, suggestion));
+        this.render();
+    }
+
+    // Takes in new, changed and resolved suggestions. Like thread anchors,
+    // the server's ranges do not know about our edits in flight.
+    update(suggestions, pending) {
+        suggestions.forEach(suggestion => {
+            if (suggestion.status !== 'pending') {
+                this.suggestions.delete(suggestion.id);
+                return;
+            }
+            pending.forEach(op => {
+                suggestion.start = op.transformIndex(suggestion.start, true);
+                suggestion.end = Math.max(op.transformIndex(suggestion.end, false), suggestion.start);
+            });
+            this.suggestions.set(suggestion.id, suggestion);
+        });
+        this.render();
+    }
+
+    // Moves every range through an operation applied to the local text
+    transform(operation) {
+        this.suggestions.forEach(suggestion => {
+            suggestion.start = operation.transformIndex(suggestion.start, true);
+            suggestion.end = Math.max(operation.transformIndex(suggestion.end, false), suggestion.start);
+        });
+        // The text a suggestion replaces may have changed too
+        if (this.suggestions.size > 0) this.render();
+    }
+
+    // Editors may accept and reject anything, authors withdraw their own
+    setPermissions(canEdit, dbUserId) {
+        this.canEdit = canEdit;
+        this.dbUserId = dbUserId;
+        this.render();
+    }
+
+    render() {
+        this.container.replaceChildren();
+        const visible = [...this.suggestions.values()]
+            .sort((a, b) => a.start - b.start || a.id - b.id);
+
+        if (visible.length === 0) {
+            const empty = document.createElement('p');
+            empty.className = 'text-sm text-gray-500';
+            empty.textContent = 'No suggestions';
+            this.container.appendChild(empty);
+            return;
+        }
+
+        if (this.canEdit) {
+            const actions = document.createElement('div');
+            actions.className = 'flex gap-4';
+            actions.append(
+                this.button('Accept all', 'text-green-700 hover:text-green-900', () => this.send('acceptAll', {})),
+                this.button('Reject all', 'text-red-600 hover:text-red-800', () => this.send('rejectAll', {}))
+            );
+            this.container.appendChild(actions);
+        }
+        visible.forEach(suggestion => this.container.appendChild(this.renderSuggestion(suggestion)));
+    }
+
+    renderSuggestion(suggestion) {
+        const card = document.createElement('div');
+        card.className = 'border rounded-lg p-3 bg-white';
+
+        const meta = document.createElement('div');
+        meta.className = 'text-xs text-gray-500 mb-1';
+        meta.textContent = `${suggestion.author || 'Deleted user'} · ${new Date(suggestion.created_at).toLocaleString()}`;
+        card.appendChild(meta);
+
+        // Clicking the change selects the text it is about
+        const change = document.createElement('button');
+        change.className = 'block w-full text-left text-sm whitespace-pre-wrap mb-2';
+        const current = this.editor.value.slice(suggestion.start, suggestion.end);
+        if (current) {
+            const removed = document.createElement('del');
+            removed.className = 'text-red-600';
+            removed.textContent = current;
+            change.appendChild(removed);
+        }
+        if (suggestion.text) {
+            const added = document.createElement('ins');
+            added.className = 'text-green-700';
+            added.textContent = suggestion.text;
+            change.appendChild(added);
+        }
+        change.addEventListener('click', () => {
+            this.editor.focus();
+            this.editor.setSelectionRange(suggestion.start, suggestion.end);
+        });
+        card.appendChild(change);
+
+        const actions = document.createElement('div');
+        actions.className = 'flex gap-4';
+        if (this.canEdit) {
+            actions.append(
+                this.button('Accept', 'text-green-700 hover:text-green-900', () => this.send('accept', { suggestionId: suggestion.id })),
+                this.button('Reject', 'text-red-600 hover:text-red-800', () => this.send('reject', { suggestionId: suggestion.id }))
+            );
+        } else if (this.dbUserId && suggestion.user_id === this.dbUserId) {
+            actions.appendChild(
+                this.button('Withdraw', 'text-red-600 hover:text-red-800', () => this.send('reject', { suggestionId: suggestion.id }))
+            );
+        }
+        card.appendChild(actions);
+        return card;
+    }
+
+    button(label, color, onClick) {
+        const button = document.createElement('button');
+        button.className = 'text-sm ' + color;
+        button.textContent = label;
+        button.addEventListener('click', onClick);
+        return button;
+    }
+}
@@ -0,0 +1,80 @@
+// Access tokens only live for a few minutes. These helpers keep one fresh
+// with the refresh token and are shared by every page.
+const TOKEN_API = 'http://localhost:8080/api';
+
+function storeTokens(data) {
+    localStorage.setItem('token', data.token);
+    localStorage.setItem('refreshToken', data.refresh_token);
+    localStorage.setItem('tokenExpires', String(Date.now() + data.expires_in * 1000));
+    if (data.user) {
+        localStorage.setItem('user', JSON.stringify(data.user));
+    }
+}
+
+function clearTokens() {
+    ['token', 'refreshToken', 'tokenExpires', 'user'].forEach(key => localStorage.removeItem(key));
+}
+
+let refreshing = null;
+
+// Returns an access token that is good for at least another 30 seconds,
+// refreshing it if needed, or null if the user is not signed in.
+async function freshToken() {
+    const token = localStorage.getItem('token');
+    const refreshToken = localStorage.getItem('refreshToken');
+    if (!token || !refreshToken) {
+        // Tokens from before refresh tokens existed are no longer accepted
+        if (token) clearTokens();
+        return null;
+    }
+
+    const expires = Number(localStorage.getItem('tokenExpires') || 0);
+    if (expires - Date.now() > 30000) {
+        return token;
+    }
+
+    if (!refreshing) {
+        refreshing = fetch(`${TOKEN_API}/refresh`, {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ refresh_token: refreshToken })
+        })
+            .then(async response => {
+                if (!response.ok) {
+                    clearTokens();
+                    return null;
+                }
+                const data = await response.json();
+                storeTokens(data);
+                return data.token;
+            })
+            // Keep the old token if the server could not be reached
+            .catch(() => token)
+            .finally(() => { refreshing = null; });
+    }
+    return refreshing;
+}
+
+// Ends this login, or every login of the user, on the server
+async function signOut(everywhere = false) {
+    const refreshToken = localStorage.getItem('refreshToken');
+    const token = everywhere ? await freshToken() : null;
+    clearTokens();
+
+    try {
+        if (everywhere && token) {
+            await fetch(`${TOKEN_API}/logout-all`, {
+                method: 'POST',
+                headers: { 'Authorization': `Bearer ${token}` }
+            });
+        } else if (refreshToken) {
+            await fetch(`${TOKEN_API}/logout`, {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify({ refresh_token: refreshToken })
+            });
+        }
+    } catch (error) {
+        console.error('Failed to log out:', error);
+    }
+}
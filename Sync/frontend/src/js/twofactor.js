@@ -0,0 +1,106 @@
+// Two-factor authentication settings for the signed-in user
+
+async function twoFactorRequest(path, method = 'GET', body = null) {
+    const token = await freshToken();
+    if (!token) {
+        hideTwoFactorModal();
+        showLoginModal();
+        throw new Error('Please log in again');
+    }
+
+    const options = { method, headers: { 'Authorization': `Bearer ${token}` } };
+    if (body) {
+        options.headers['Content-Type'] = 'application/json';
+        options.body = JSON.stringify(body);
+    }
+
+    const response = await fetch(`${API_BASE}/2fa${path}`, options);
+    if (!response.ok) {
+        throw new Error(await response.text());
+    }
+    return response.json();
+}
+
+function showTwoFactorError(error) {
+    const errorDiv = document.getElementById('twoFactorError');
+    errorDiv.textContent = error.message;
+    errorDiv.classList.remove('hidden');
+}
+
+async function showTwoFactorModal() {
+    const modal = document.getElementById('twoFactorModal');
+    modal.classList.remove('hidden');
+    modal.classList.add('flex');
+    ['twoFactorSetup', 'recoveryCodes', 'twoFactorError'].forEach(id =>
+        document.getElementById(id).classList.add('hidden'));
+
+    try {
+        const status = await twoFactorRequest('');
+        document.getElementById('twoFactorStatus').textContent = status.enabled
+            ? `Enabled. ${status.recovery_codes_left} recovery codes left.`
+            : 'Not enabled. Protect your account with a code from your phone at every login.';
+        document.getElementById('enableTwoFactor').classList.toggle('hidden', status.enabled);
+        document.getElementById('disableTwoFactor').classList.toggle('hidden', !status.enabled);
+        document.getElementById('regenerateCodes').classList.toggle('hidden', !status.enabled);
+    } catch (error) {
+        showTwoFactorError(error);
+    }
+}
+
+function hideTwoFactorModal() {
+    document.getElementById('twoFactorModal').classList.add('hidden');
+}
+
+async function setupTwoFactor() {
+    try {
+        const setup = await twoFactorRequest('/setup', 'POST');
+        document.getElementById('twoFactorUri').href = setup.uri;
+        document.getElementById('twoFactorSecret').textContent = setup.secret;
+        document.getElementById('twoFactorCode').value = '';
+        document.getElementById('twoFactorSetup').classList.remove('hidden');
+        document.getElementById('enableTwoFactor').classList.add('hidden');
+    } catch (error) {
+        showTwoFactorError(error);
+    }
+}
+
+function showRecoveryCodes(codes) {
+    document.getElementById('recoveryCodesList').textContent = codes.join('\n');
+    document.getElementById('recoveryCodes').classList.remove('hidden');
+}
+
+async function confirmTwoFactor() {
+    try {
+        const code = document.getElementById('twoFactorCode').value.trim();
+        const result = await twoFactorRequest('/confirm', 'POST', { code });
+        await showTwoFactorModal();
+        showRecoveryCodes(result.recovery_codes);
+    } catch (error) {
+        showTwoFactorError(error);
+    }
+}
+
+async function disableTwoFactor() {
+    const code = prompt('Enter a code from your authenticator app to disable two-factor authentication:');
+    if (!code) return;
+
+    try {
+        await twoFactorRequest('/disable', 'POST', { code: code.trim() });
+        await showTwoFactorModal();
+    } catch (error) {
+        showTwoFactorError(error);
+    }
+}
+
+async function regenerateRecoveryCodes() {
+    const code = prompt('Enter a code from your authenticator app to replace your recovery codes:');
+    if (!code) return;
+
+    try {
+        const result = await twoFactorRequest('/recovery-codes', 'POST', { code: code.trim() });
+        await showTwoFactorModal();
+        showRecoveryCodes(result.recovery_codes);
+    } catch (error) {
+        showTwoFactorError(error);
+    }
+}
@@ -1,23 +1,39 @@
 class WebSocketManager {
-    constructor(userId, sessionCode, onMessage, onStatusChange, token = null, dbUserId = null) {
+    constructor(userId, sessionCode, onMessage, onStatusChange, token = null, dbUserId = null, invite = null) {
         this.userId = userId;
         this.sessionCode = sessionCode;
         this.onMessage = onMessage;
         this.onStatusChange = onStatusChange;
         this.token = token;
         this.dbUserId = dbUserId;
+        this.invite = invite;
+        // Guests who redeemed an invite reconnect with the pass they got for it
+        this.pass = sessionStorage.getItem(`guestPass:${sessionCode}`);
+        // Guests keep the connection ID the server gave them with this token
+        this.tabToken = null;
         this.ws = null;
         this.reconnectTimeout = null;
     }
 
-    connect() {
+    async connect() {
         let url = `ws://localhost:8080/ws?session=${this.sessionCode}&userId=${this.userId}`;
-        if (this.token) {
-            url += `&token=${this.token}`;
+        // Access tokens are short-lived, get a fresh one for every connect
+        const token = this.token ? await freshToken() : null;
+        if (token) {
+            url += `&token=${encodeURIComponent(token)}`;
         }
         if (this.dbUserId) {
             url += `&dbUserId=${this.dbUserId}`;
         }
+        if (this.tabToken) {
+            url += `&tab=${encodeURIComponent(this.tabToken)}`;
+        }
+        if (this.pass) {
+            url += `&pass=${encodeURIComponent(this.pass)}`;
+        }
+        if (this.invite) {
+            url += `&invite=${encodeURIComponent(this.invite)}`;
+        }
 
         this.ws = new WebSocket(url);
         
@@ -38,7 +54,28 @@ class WebSocketManager {
             }
         };
 
-        this.ws.onclose = () => {
+        this.ws.onclose = (event) => {
+            // 4001 means our login ended, reconnecting would not help
+            if (event.code === 4001) {
+                if (this.onStatusChange) {
+                    this.onStatusChange('loggedOut');
+                }
+                return;
+            }
+            // 4004 means the session was deleted
+            if (event.code === 4004) {
+                if (this.onStatusChange) {
+                    this.onStatusChange('deleted');
+                }
+                return;
+            }
+            // 1008 means our access to the session was revoked
+            if (event.code === 1008) {
+                if (this.onStatusChange) {
+                    this.onStatusChange('revoked');
+                }
+                return;
+            }
             if (this.onStatusChange) {
                 this.onStatusChange('disconnected');
             }